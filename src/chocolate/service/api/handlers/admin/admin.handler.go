@@ -0,0 +1,51 @@
+package admin
+
+import (
+	"net/http"
+
+	"chocolate/service/api/shared/apierror"
+	"chocolate/service/api/shared/responses"
+	"chocolate/service/models/outbox"
+	"chocolate/service/shared/logger"
+	"chocolate/service/shared/reqcontext"
+)
+
+// GetDBStats returns the DB connection pool statistics
+func GetDBStats(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	logger.Debugf("%v:admin:GetDBStats() Starts", reqID)
+
+	db := reqcontext.GetDB(r)
+	if db == nil {
+		logger.Errorf("%s:admin:GetDBStats() Missing DB", reqID)
+		apierr := apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	responses.Ok(r, w, db.PoolStats(), "/admin/db/stats")
+}
+
+// GetFailedEmails returns the outbox emails that failed to be delivered,
+// the dead-lettered ones and the ones waiting to be retried
+func GetFailedEmails(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	logger.Debugf("%v:admin:GetFailedEmails() Starts", reqID)
+
+	db := reqcontext.GetDB(r)
+	if db == nil {
+		logger.Errorf("%s:admin:GetFailedEmails() Missing DB", reqID)
+		apierr := apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	messages, dberr := outbox.GetFailed(r.Context(), db, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:admin:GetFailedEmails() Got error from GetFailed: err: %v", reqID, dberr)
+		responses.Error(r, w, apierror.FromDB(dberr))
+		return
+	}
+
+	responses.Ok(r, w, messages, "/admin/emails/failed")
+}
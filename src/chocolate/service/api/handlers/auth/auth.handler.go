@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"time"
@@ -10,14 +11,32 @@ import (
 	"chocolate/service/api/shared/responses"
 	"chocolate/service/database"
 	"chocolate/service/models/auth"
+	"chocolate/service/models/mfa"
+	"chocolate/service/models/roles"
+	"chocolate/service/models/tokens"
 	"chocolate/service/models/users"
 	"chocolate/service/shared/auth/jwt"
+	"chocolate/service/shared/auth/permissions"
 	"chocolate/service/shared/auth/utils"
 	"chocolate/service/shared/logger"
 	"chocolate/service/shared/reqcontext"
 	"chocolate/service/shared/security"
+	"chocolate/service/shared/utils/uuid"
 )
 
+// userTypeRoles maps the login user_type to the role of the issued tokens
+var userTypeRoles = map[string]string{
+	auth.UserTypeClient:   jwt.RoleUser,
+	auth.UserTypeBusiness: jwt.RoleBusiness,
+	auth.UserTypeAdmin:    jwt.RoleAdmin,
+}
+
+// mfaChallengeExpiration is how long the user has to answer the mfa_required challenge
+const mfaChallengeExpiration = time.Minute * 5
+
+// mfaChallengeMaxFailures is how many wrong codes a mfa_required challenge takes before it is revoked
+const mfaChallengeMaxFailures = 5
+
 // GenerateTokens Creates a user AccessToken/RefreshToken pair
 func GenerateTokens(w http.ResponseWriter, r *http.Request) {
 	reqID := reqcontext.GetReqID(r)
@@ -28,7 +47,8 @@ func GenerateTokens(w http.ResponseWriter, r *http.Request) {
 		authResponse *auth.Response
 	)
 	db := reqcontext.GetDB(r)
-	if db == nil {
+	repo := reqcontext.GetUserRepository(r)
+	if db == nil || repo == nil {
 		logger.Errorf("%s:auth:GenerateToken() Missing DB", reqID)
 		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
 		responses.Error(r, w, apierr)
@@ -48,26 +68,26 @@ func GenerateTokens(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if userAuth.UserType == auth.UserTypeClient {
-		if authResponse, apierr = formUserAuthResponse(db, userAuth.Remember,
-			userAuth.Username, userAuth.Password, reqID); apierr != nil {
-			logger.Errorf("%s:auth:GenerateToken() Error Forming Auth Response: %s", reqID, apierr.Error())
-			responses.Error(r, w, apierr)
-			return
-		}
-	} else {
-		responses.NotImplemented(r, w, "/tokens")
+	if authResponse, apierr = formUserAuthResponse(r.Context(), db, repo, userAuth.Remember, userAuth.UserType,
+		userAuth.Username, userAuth.Password, reqID); apierr != nil {
+		logger.Errorf("%s:auth:GenerateToken() Error Forming Auth Response: %s", reqID, apierr.Error())
+		responses.Error(r, w, apierr)
 		return
 	}
 
+	if authResponse.MFARequired {
+		// No tokens were created yet, user still has to answer the challenge at /tokens/mfa
+		responses.Ok(r, w, authResponse, "/tokens/mfa")
+		return
+	}
 	responses.Created(r, w, authResponse, "/tokens")
 	return
 }
 
-func formUserAuthResponse(db *database.DB, remember bool, username, password, reqID string) (authResponse *auth.Response, apierr *apierror.Error) {
+func formUserAuthResponse(ctx context.Context, db *database.DB, repo users.UserRepository, remember bool, userType, username, password, reqID string) (authResponse *auth.Response, apierr *apierror.Error) {
 	// Get User by username in DB
 	// TODO: users.GetByUsername
-	user, dberr := users.GetBy(db, "username", username, reqID)
+	user, dberr := repo.GetBy(ctx, "username", username, reqID)
 	if dberr != nil {
 		logger.Errorf("%s:auth:GenerateTokens() Got error from Get User: err: %v", reqID, dberr)
 		switch code := dberr.Code; code {
@@ -76,7 +96,7 @@ func formUserAuthResponse(db *database.DB, remember bool, username, password, re
 		/* case database.ErrorDB, database.ErrorExecute:
 		apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Something went wrong: %s", dberr.Error()), apierror.CodeInternalDB) */
 		default:
-			apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Something went wrong: %s", dberr.Error()), apierror.CodeInternalDB)
+			apierr = apierror.FromDB(dberr)
 		}
 	}
 	if apierr != nil {
@@ -90,18 +110,159 @@ func formUserAuthResponse(db *database.DB, remember bool, username, password, re
 		return
 	}
 	// Generate User Claims
-	userType := auth.UserTypeClient
+	role := userTypeRoles[userType]
 	userID := user.ID
+	// Every user is a client, other user types need the role granted
+	if role != jwt.RoleUser {
+		granted, dberr := roles.HasRole(ctx, db, userID, role, reqID)
+		if dberr != nil {
+			logger.Errorf("%s:auth:GenerateTokens() Got error from HasRole: err: %v", reqID, dberr)
+			apierr = apierror.FromDB(dberr)
+			return
+		}
+		if !granted {
+			apierr = apierror.New(http.StatusForbidden, fmt.Sprintf("User is not allowed to login as %s", userType), apierror.CodeForbidden)
+			return
+		}
+	}
 
-	var refreshExpiration time.Duration
+	// Users with MFA get a challenge instead of the token pair
+	mfaEnabled, dberr := mfa.IsEnabled(ctx, db, userID, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:auth:GenerateTokens() Got error from MFA IsEnabled: err: %v", reqID, dberr)
+		apierr = apierror.FromDB(dberr)
+		return
+	}
+	if mfaEnabled {
+		return generateMFAChallenge(reqID, role, userID, remember, user.Confirmed)
+	}
+
+	refreshExpiration := utils.RefreshExpiration
 	if remember {
-		refreshExpiration = time.Hour * 24 * 30
-	} else {
-		refreshExpiration = time.Hour * 24 * 8
+		refreshExpiration = utils.RefreshExpirationRemember
+	}
+
+	return utils.GenerateAuthResponse(ctx, db, reqID, role, userID, "", refreshExpiration, user.Confirmed)
+
+}
+
+func generateMFAChallenge(reqID, role, userID string, remember, eok bool) (authResponse *auth.Response, apierr *apierror.Error) {
+	claims := jwt.New()
+	now := time.Now()
+	nowEpoch := now.Unix()
+	claims.EmailOK = eok
+	claims.ExpiresAt = now.Add(mfaChallengeExpiration).Unix()
+	claims.IssuedAt = nowEpoch
+	claims.IssuedAtMs = now.UnixNano() / int64(time.Millisecond)
+	claims.NotBefore = nowEpoch
+	claims.UserID = userID
+	claims.Role = role
+	claims.Remember = remember
+	claims.Subject = "/tokens/mfa"
+	claims.TokenType = jwt.TokenTypeMFA
+
+	logger.Debugf("%s:auth:generateMFAChallenge()  Claims: %+v:", reqID, claims)
+	var mfaToken string
+	if mfaToken, apierr = jwt.Create(claims); apierr != nil {
+		return
+	}
+	authResponse = &auth.Response{
+		MFARequired: true,
+		MFAToken:    mfaToken,
+	}
+	return
+}
+
+// GenerateMFATokens Creates the AccessToken/RefreshToken pair once the user answered
+// the mfa_required challenge with a TOTP code or a recovery code
+func GenerateMFATokens(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	logger.Debugf("%v:auth:GenerateMFATokens() Starts", reqID)
+	var (
+		apierr       *apierror.Error
+		challenge    = &mfa.Challenge{}
+		mfaClaims    *jwt.Claims
+		authResponse *auth.Response
+	)
+	db := reqcontext.GetDB(r)
+	if db == nil {
+		logger.Errorf("%s:auth:GenerateMFATokens() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	// Get Body
+	if apierr = reqbody.Read(r, challenge); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+	if err := challenge.Valid(); err != nil {
+		apierr = apierror.New(http.StatusBadRequest, err.Error(), apierror.CodeBadRequestBody)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	if mfaClaims, apierr = jwt.Verify(challenge.MFAToken); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+	if mfaClaims.TokenType != jwt.TokenTypeMFA {
+		apierr = apierror.New(http.StatusUnauthorized, "This is not a mfa token", apierror.CodeUnauth)
+		responses.Error(r, w, apierr)
+		return
+	}
+	// The challenge can only be answered once
+	if apierr = utils.CheckRevoked(r.Context(), db, mfaClaims, reqID); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	userID := mfaClaims.UserID
+	if apierr = utils.VerifyMFACode(r.Context(), db, userID, challenge.Code, challenge.RecoveryCode, reqID); apierr != nil {
+		if apierr.HTTPStatus == http.StatusUnauthorized {
+			apierr = countMFAFailure(r.Context(), db, mfaClaims, apierr, reqID)
+		}
+		responses.Error(r, w, apierr)
+		return
 	}
 
-	return utils.GenerateAuthResponse(reqID, userType, userID, refreshExpiration, user.Confirmed)
+	if dberr := tokens.Revoke(r.Context(), db, mfaClaims.Id, userID, mfaClaims.ExpiresAt, reqID); dberr != nil {
+		logger.Errorf("%s:auth:GenerateMFATokens() Got error from Revoke: err: %v", reqID, dberr)
+		apierr = apierror.FromDB(dberr)
+		responses.Error(r, w, apierr)
+		return
+	}
 
+	refreshExpiration := utils.RefreshExpiration
+	if mfaClaims.Remember {
+		refreshExpiration = utils.RefreshExpirationRemember
+	}
+	if authResponse, apierr = utils.GenerateAuthResponse(r.Context(), db, reqID, mfaClaims.Role, userID, "",
+		refreshExpiration, mfaClaims.EmailOK); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+	responses.Created(r, w, authResponse, "/tokens")
+}
+
+// countMFAFailure counts the wrong code to the challenge and revokes it once it got mfaChallengeMaxFailures,
+// so the codes can't be guessed until the mfa_token expires. It returns the error to answer
+func countMFAFailure(ctx context.Context, db *database.DB, mfaClaims *jwt.Claims, apierr *apierror.Error, reqID string) *apierror.Error {
+	failures, dberr := mfa.CountChallengeFailure(ctx, db, mfaClaims.Id, mfaClaims.UserID, mfaClaims.ExpiresAt, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:auth:countMFAFailure() Got error from CountChallengeFailure: err: %v", reqID, dberr)
+		return apierror.FromDB(dberr)
+	}
+	if failures < mfaChallengeMaxFailures {
+		return apierr
+	}
+	if dberr = tokens.Revoke(ctx, db, mfaClaims.Id, mfaClaims.UserID, mfaClaims.ExpiresAt, reqID); dberr != nil {
+		logger.Errorf("%s:auth:countMFAFailure() Got error from Revoke: err: %v", reqID, dberr)
+		return apierror.FromDB(dberr)
+	}
+	logger.Infof("%s:auth:countMFAFailure() Revoked mfa challenge(%s) of user(%s) after %d failures", reqID, mfaClaims.Id, mfaClaims.UserID, failures)
+	return apierror.New(http.StatusUnauthorized, "Too many wrong MFA codes, login again", apierror.CodeUnauthRevoked)
 }
 
 // RefreshTokens generates a fresh pair of tokens based on original accesss_token
@@ -115,9 +276,18 @@ func RefreshTokens(w http.ResponseWriter, r *http.Request) {
 		accessClaims  jwt.Claims
 		refreshClaims *jwt.Claims
 	)
+	db := reqcontext.GetDB(r)
+	repo := reqcontext.GetUserRepository(r)
+	if db == nil || repo == nil {
+		logger.Errorf("%s:auth:RefreshTokens() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
 	// Get Request Body
 	if apierr = reqbody.Read(r, refreshReq); apierr != nil {
 		responses.Error(r, w, apierr)
+		return
 	}
 
 	// Get current accessClaims
@@ -129,7 +299,9 @@ func RefreshTokens(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Validate between tokens
-	if accessClaims.TokenType != jwt.TokenTypeRefresh {
+	if accessClaims.TokenType != jwt.TokenTypeAccess {
+		apierr = apierror.New(http.StatusUnauthorized, "This is not an access token", apierror.CodeUnauth)
+	} else if refreshClaims.TokenType != jwt.TokenTypeRefresh {
 		apierr = apierror.New(http.StatusUnauthorized, "This is not a refresh token", apierror.CodeUnauth)
 	} else if accessClaims.Id != refreshClaims.Subject {
 		apierr = apierror.New(http.StatusUnauthorized, "Refesh Token doesn't match Access Token", apierror.CodeUnauth)
@@ -140,19 +312,233 @@ func RefreshTokens(w http.ResponseWriter, r *http.Request) {
 		responses.Error(r, w, apierr)
 		return
 	}
-	// TODO Check what happens if we request GetAuthJWT and there are no Claims in context
+	// Refresh tokens revoked on logout or issued before a password reset are no longer valid
+	if apierr = utils.CheckRevoked(r.Context(), db, refreshClaims, reqID); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+	// Refresh tokens are single use, a reused one means it was stolen so the whole family is revoked
+	if apierr = useRefreshToken(r.Context(), db, refreshClaims, reqID); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
 	role := accessClaims.Role
 	userID := accessClaims.UserID
-	eok := accessClaims.EmailOK
+	// The email could have been confirmed or changed since the access token was issued
+	user, dberr := repo.GetByID(r.Context(), userID, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:auth:RefreshTokens() Got error from GetByID: err: %v", reqID, dberr)
+		if dberr.Code == database.ErrorNoRows {
+			apierr = apierror.New(http.StatusUnauthorized, "User is not registered", apierror.CodeUnauth)
+		} else {
+			apierr = apierror.FromDB(dberr)
+		}
+		responses.Error(r, w, apierr)
+		return
+	}
+	eok := user.Confirmed
 	exp := time.Unix(refreshClaims.ExpiresAt, 0)
 	iat := time.Unix(refreshClaims.IssuedAt, 0)
 	refreshExp := exp.Sub(iat)
 	//refreshExp := fmt.Sprintf("%v", delta.Hours()/24)
 	logger.Debugf("Refresh Expiration: %v", refreshExp.Hours())
-	if authResponse, apierr = utils.GenerateAuthResponse(reqID, role, userID, refreshExp, eok); apierr != nil {
+	if authResponse, apierr = utils.GenerateAuthResponse(r.Context(), db, reqID, role, userID, refreshClaims.Family, refreshExp, eok); apierr != nil {
 		responses.Error(r, w, apierr)
 		return
 	}
 	responses.Created(r, w, authResponse, "/tokens")
 	return
 }
+
+func useRefreshToken(ctx context.Context, db *database.DB, refreshClaims *jwt.Claims, reqID string) (apierr *apierror.Error) {
+	dberr := tokens.UseRefresh(ctx, db, refreshClaims.Id, reqID)
+	if dberr == nil {
+		return
+	}
+	if dberr.Code != database.ErrorNoRows {
+		logger.Errorf("%s:auth:useRefreshToken() Got error from UseRefresh: err: %v", reqID, dberr)
+		return apierror.FromDB(dberr)
+	}
+
+	refresh, dberr := tokens.GetRefresh(ctx, db, refreshClaims.Id, reqID)
+	if dberr != nil {
+		if dberr.Code == database.ErrorNoRows {
+			return apierror.New(http.StatusUnauthorized, "Unknown Refresh Token", apierror.CodeUnauth)
+		}
+		logger.Errorf("%s:auth:useRefreshToken() Got error from GetRefresh: err: %v", reqID, dberr)
+		return apierror.FromDB(dberr)
+	}
+	if refresh.UsedAt > 0 && refresh.RevokedAt == 0 {
+		logger.Warnf("%s:auth:useRefreshToken() Refresh Token %s reused, revoking family %s", reqID, refresh.ID, refresh.FamilyID)
+		if _, dberr = tokens.RevokeFamily(ctx, db, refresh.FamilyID, refresh.UserID, reqID); dberr != nil {
+			logger.Errorf("%s:auth:useRefreshToken() Got error from RevokeFamily: err: %v", reqID, dberr)
+			return apierror.FromDB(dberr)
+		}
+	}
+	return apierror.New(http.StatusUnauthorized, "Refresh Token was already used", apierror.CodeUnauthRevoked)
+}
+
+// DeleteTokens revokes the current access token and with it its refresh token (logout)
+func DeleteTokens(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	logger.Debugf("%v:auth:DeleteTokens() Starts", reqID)
+	var apierr *apierror.Error
+
+	db := reqcontext.GetDB(r)
+	if db == nil {
+		logger.Errorf("%s:auth:DeleteTokens() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	claims := reqcontext.GetAuthJWT(r)
+
+	// Keep it blacklisted as long as a refresh token paired with it could live
+	expiresAt := time.Unix(claims.IssuedAt, 0).Add(utils.RefreshExpirationRemember).Unix()
+	if claims.ExpiresAt > expiresAt {
+		expiresAt = claims.ExpiresAt
+	}
+	if dberr := tokens.Revoke(r.Context(), db, claims.Id, claims.UserID, expiresAt, reqID); dberr != nil {
+		logger.Errorf("%s:auth:DeleteTokens() Got error from Revoke: err: %v", reqID, dberr)
+		apierr = apierror.FromDB(dberr)
+		responses.Error(r, w, apierr)
+		return
+	}
+	if claims.Family != "" {
+		if _, dberr := tokens.RevokeFamily(r.Context(), db, claims.Family, claims.UserID, reqID); dberr != nil {
+			logger.Errorf("%s:auth:DeleteTokens() Got error from RevokeFamily: err: %v", reqID, dberr)
+			apierr = apierror.FromDB(dberr)
+			responses.Error(r, w, apierr)
+			return
+		}
+	}
+
+	responses.NoContent(r, w, "/tokens")
+}
+
+// DeleteUserTokens revokes every token issued to the user (logout everywhere)
+func DeleteUserTokens(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	vars := reqcontext.GetPathParams(r)
+	logger.Debugf("%v:auth:DeleteUserTokens() Starts vars= %v", reqID, vars)
+	var apierr *apierror.Error
+
+	db := reqcontext.GetDB(r)
+	if db == nil {
+		logger.Errorf("%s:auth:DeleteUserTokens() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	var userID string
+	if userID, apierr = getUserID(r, vars, reqID); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	if dberr := users.RevokeTokens(r.Context(), db, userID, reqID); dberr != nil {
+		logger.Errorf("%s:auth:DeleteUserTokens() Got error from RevokeTokens: err: %v", reqID, dberr)
+		apierr = apierror.FromDB(dberr)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	responses.NoContent(r, w, "/users/"+userID+"/tokens")
+}
+
+// GetSessions lists the refresh token families (sessions) of the user
+func GetSessions(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	vars := reqcontext.GetPathParams(r)
+	logger.Debugf("%v:auth:GetSessions() Starts vars= %v", reqID, vars)
+	var (
+		apierr *apierror.Error
+		userID string
+	)
+
+	db := reqcontext.GetDB(r)
+	if db == nil {
+		logger.Errorf("%s:auth:GetSessions() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	if userID, apierr = getUserID(r, vars, reqID); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	families, dberr := tokens.GetFamilies(r.Context(), db, userID, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:auth:GetSessions() Got error from GetFamilies: err: %v", reqID, dberr)
+		apierr = apierror.FromDB(dberr)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	responses.Ok(r, w, families, "/users/"+userID+"/sessions")
+}
+
+// DeleteSession revokes a refresh token family (session) of the user
+func DeleteSession(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	vars := reqcontext.GetPathParams(r)
+	logger.Debugf("%v:auth:DeleteSession() Starts vars= %v", reqID, vars)
+	var (
+		apierr *apierror.Error
+		userID string
+	)
+
+	db := reqcontext.GetDB(r)
+	if db == nil {
+		logger.Errorf("%s:auth:DeleteSession() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	if userID, apierr = getUserID(r, vars, reqID); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+	familyID := vars["session_id"]
+	if !uuid.Valid(familyID) {
+		apierr = apierror.New(http.StatusBadRequest, "Invalid Session ID", apierror.CodeBadRequestParams)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	revoked, dberr := tokens.RevokeFamily(r.Context(), db, familyID, userID, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:auth:DeleteSession() Got error from RevokeFamily: err: %v", reqID, dberr)
+		apierr = apierror.FromDB(dberr)
+		responses.Error(r, w, apierr)
+		return
+	}
+	if revoked == 0 {
+		apierr = apierror.New(http.StatusNotFound, "Session not found", apierror.CodeResourceNotFound)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	responses.NoContent(r, w, "/users/"+userID+"/sessions/"+familyID)
+}
+
+// getUserID gets the user_id path param, resolving "this" to the current user,
+// the route permission scope decides if the user can reach resources it doesn't own
+func getUserID(r *http.Request, vars map[string]string, reqID string) (userID string, apierr *apierror.Error) {
+	userID = vars["user_id"]
+	// Services have no user to resolve "this" to
+	if userID == "this" {
+		userID = reqcontext.GetAuthJWT(r).UserID
+	}
+	if userID == "" {
+		logger.Errorf("%s:auth:getUserID()  No User ID found in path", reqID)
+		apierr = apierror.New(http.StatusBadRequest, "No User ID", apierror.CodeBadRequestParams)
+		return
+	}
+	if !permissions.CanAccess(r, userID) {
+		apierr = apierror.New(http.StatusForbidden, "You can't modify this resource", apierror.CodeForbidden)
+	}
+	return
+}
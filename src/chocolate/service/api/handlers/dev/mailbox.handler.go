@@ -0,0 +1,103 @@
+package dev
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"chocolate/service/api/shared/apierror"
+	"chocolate/service/api/shared/responses"
+	"chocolate/service/shared/email"
+	"chocolate/service/shared/logger"
+	"chocolate/service/shared/reqcontext"
+)
+
+var mailboxTemplate = template.Must(template.New("mailbox").Funcs(template.FuncMap{
+	"date": func(epoch int64) string { return time.Unix(epoch, 0).Format(time.RFC1123) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="UTF-8"><title>Mailbox</title></head>
+<body>
+<h1>Mailbox</h1>
+<table>
+<tr><th>Date</th><th>From</th><th>To</th><th>Subject</th></tr>
+{{range .}}<tr><td>{{date .Date}}</td><td>{{.From}}</td><td>{{.To}}</td><td><a href="mailbox/{{.ID}}">{{.Subject}}</a></td></tr>
+{{else}}<tr><td colspan="4">No emails</td></tr>
+{{end}}</table>
+</body>
+</html>`))
+
+var textMailTemplate = template.Must(template.New("mail").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="UTF-8"><title>{{.Subject}}</title></head>
+<body><pre>{{.Body}}</pre></body>
+</html>`))
+
+// ListMailbox renders the list of the emails captured by the dev mailbox
+func ListMailbox(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	logger.Debugf("%v:dev:ListMailbox() Starts", reqID)
+
+	mailbox, ok := email.GetMailbox()
+	if !ok {
+		apierr := apierror.New(http.StatusNotFound, "Emails are delivered, there is no mailbox", apierror.CodeResourceNotFound)
+		responses.Error(r, w, apierr)
+		return
+	}
+	mails, emailErr := mailbox.List()
+	if emailErr != nil {
+		logger.Errorf("%s:dev:ListMailbox() Couldn't list mailbox: %s", reqID, emailErr.Error())
+		apierr := apierror.New(http.StatusInternalServerError, emailErr.Error(), apierror.CodeInternalEmail)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	if err := mailboxTemplate.Execute(buf, mails); err != nil {
+		apierr := apierror.New(http.StatusInternalServerError, err.Error(), apierror.CodeInternal)
+		responses.Error(r, w, apierr)
+		return
+	}
+	responses.HTML(r, w, buf)
+}
+
+// GetMail renders a captured email as it would be shown by an email client, so its links can be clicked
+func GetMail(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	mailID := reqcontext.GetPathParams(r)["mail_id"]
+	logger.Debugf("%v:dev:GetMail() Starts mail_id = %s", reqID, mailID)
+
+	mailbox, ok := email.GetMailbox()
+	if !ok {
+		apierr := apierror.New(http.StatusNotFound, "Emails are delivered, there is no mailbox", apierror.CodeResourceNotFound)
+		responses.Error(r, w, apierr)
+		return
+	}
+	mail, emailErr := mailbox.Get(mailID)
+	if emailErr != nil {
+		apierr := apierror.New(http.StatusNotFound, "Mail not found", apierror.CodeResourceNotFound)
+		responses.Error(r, w, apierr)
+		return
+	}
+	contentType, body, err := mail.Content()
+	if err != nil {
+		apierr := apierror.New(http.StatusInternalServerError, err.Error(), apierror.CodeInternalEmail)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	if strings.HasPrefix(strings.TrimSpace(contentType), "text/html") {
+		responses.HTML(r, w, strings.NewReader(body))
+		return
+	}
+	buf := new(bytes.Buffer)
+	data := struct{ Subject, Body string }{mail.Subject, body}
+	if err = textMailTemplate.Execute(buf, data); err != nil {
+		apierr := apierror.New(http.StatusInternalServerError, err.Error(), apierror.CodeInternal)
+		responses.Error(r, w, apierr)
+		return
+	}
+	responses.HTML(r, w, buf)
+}
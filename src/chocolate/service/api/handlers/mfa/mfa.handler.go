@@ -0,0 +1,269 @@
+package mfa
+
+import (
+	"encoding/base32"
+	"fmt"
+	"net/http"
+	"time"
+
+	"chocolate/service/api/shared/apierror"
+	"chocolate/service/api/shared/reqbody"
+	"chocolate/service/api/shared/responses"
+	"chocolate/service/database"
+	"chocolate/service/models/mfa"
+	"chocolate/service/shared/auth/permissions"
+	"chocolate/service/shared/auth/totp"
+	"chocolate/service/shared/auth/utils"
+	"chocolate/service/shared/config"
+	"chocolate/service/shared/logger"
+	"chocolate/service/shared/reqcontext"
+	"chocolate/service/shared/security"
+)
+
+// recoveryCodesCount is the number of recovery codes generated on enrollment
+const recoveryCodesCount = 10
+
+// recoveryCodeBytes is the number of random bytes of a recovery code, 16 base32 characters
+const recoveryCodeBytes = 10
+
+// EnrollTOTP generates a new TOTP secret and recovery codes for the user,
+// TOTP is not enabled until the user verifies a code generated with it
+func EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	vars := reqcontext.GetPathParams(r)
+	claims := reqcontext.GetAuthJWT(r)
+	logger.Debugf("%v:mfa:EnrollTOTP() Starts vars= %v", reqID, vars)
+	var (
+		apierr *apierror.Error
+		userID string
+	)
+	db := reqcontext.GetDB(r)
+	repo := reqcontext.GetUserRepository(r)
+	if db == nil || repo == nil {
+		logger.Errorf("%s:mfa:EnrollTOTP() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	if userID, apierr = getUserID(r, vars, reqID); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+	// Only the user can enroll its own authenticator
+	if userID != claims.UserID {
+		apierr = apierror.New(http.StatusForbidden, "You can't modify this resource", apierror.CodeForbidden)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	user, dberr := repo.GetByID(r.Context(), userID, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:mfa:EnrollTOTP() Got error from GetByID: err: %v", reqID, dberr)
+		apierr = apierror.FromDB(dberr)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Couldn't generate secret: %s", err.Error()), apierror.CodeInternal)
+		responses.Error(r, w, apierr)
+		return
+	}
+	t := &mfa.TOTP{UserID: userID, Secret: secret}
+	if dberr = t.Enroll(r.Context(), db, reqID); dberr != nil {
+		logger.Errorf("%s:mfa:EnrollTOTP() Got error from Enroll: err: %v", reqID, dberr)
+		switch code := dberr.Code; code {
+		case database.ErrorNoRows:
+			apierr = apierror.New(http.StatusConflict, "TOTP is already enabled", apierror.CodeResourceConflict)
+		default:
+			apierr = apierror.FromDB(dberr)
+		}
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	codes, codeHashes, err := generateRecoveryCodes()
+	if err != nil {
+		apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Couldn't generate recovery codes: %s", err.Error()), apierror.CodeInternal)
+		responses.Error(r, w, apierr)
+		return
+	}
+	if dberr = mfa.ReplaceRecoveryCodes(r.Context(), db, userID, codeHashes, reqID); dberr != nil {
+		logger.Errorf("%s:mfa:EnrollTOTP() Got error from ReplaceRecoveryCodes: err: %v", reqID, dberr)
+		apierr = apierror.FromDB(dberr)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	enrollment := mfa.Enrollment{
+		Secret:        secret,
+		URI:           totp.URI(config.GetConfiguration().MFA.Issuer, user.Username, secret),
+		RecoveryCodes: codes,
+	}
+	responses.Created(r, w, enrollment, "/users/"+userID+"/mfa/totp")
+}
+
+// VerifyTOTP enables the enrolled TOTP once the user sends a valid code
+func VerifyTOTP(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	vars := reqcontext.GetPathParams(r)
+	claims := reqcontext.GetAuthJWT(r)
+	logger.Debugf("%v:mfa:VerifyTOTP() Starts vars= %v", reqID, vars)
+	var (
+		apierr       *apierror.Error
+		userID       string
+		verification = &mfa.Verification{}
+	)
+	db := reqcontext.GetDB(r)
+	if db == nil {
+		logger.Errorf("%s:mfa:VerifyTOTP() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	if userID, apierr = getUserID(r, vars, reqID); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+	if userID != claims.UserID {
+		apierr = apierror.New(http.StatusForbidden, "You can't modify this resource", apierror.CodeForbidden)
+		responses.Error(r, w, apierr)
+		return
+	}
+	// Get Body
+	if apierr = reqbody.Read(r, verification); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+	if err := verification.Valid(); err != nil {
+		apierr = apierror.New(http.StatusBadRequest, err.Error(), apierror.CodeBadRequestBody)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	t, dberr := mfa.GetTOTP(r.Context(), db, userID, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:mfa:VerifyTOTP() Got error from GetTOTP: err: %v", reqID, dberr)
+		switch code := dberr.Code; code {
+		case database.ErrorNoRows:
+			apierr = apierror.New(http.StatusNotFound, "TOTP enrollment not found", apierror.CodeResourceNotFound)
+		default:
+			apierr = apierror.FromDB(dberr)
+		}
+		responses.Error(r, w, apierr)
+		return
+	}
+	if t.Enabled {
+		apierr = apierror.New(http.StatusConflict, "TOTP is already enabled", apierror.CodeResourceConflict)
+		responses.Error(r, w, apierr)
+		return
+	}
+	counter, ok := totp.Validate(t.Secret, verification.Code, time.Now(), 1)
+	if !ok {
+		apierr = apierror.New(http.StatusBadRequest, "Wrong TOTP code", apierror.CodeBadRequestBody)
+		responses.Error(r, w, apierr)
+		return
+	}
+	if dberr = mfa.Enable(r.Context(), db, userID, counter, reqID); dberr != nil {
+		logger.Errorf("%s:mfa:VerifyTOTP() Got error from Enable: err: %v", reqID, dberr)
+		apierr = apierror.FromDB(dberr)
+		responses.Error(r, w, apierr)
+		return
+	}
+	t.Enabled = true
+	t.EnabledAt = time.Now().Unix()
+
+	responses.Ok(r, w, t, "/users/"+userID+"/mfa/totp")
+}
+
+// DeleteTOTP disables TOTP for the user and removes its recovery codes. Users must send a current TOTP code
+// or a recovery code, so a stolen access token can't disable it. Admins can delete the TOTP of other users
+// without it, i.e. when they lost the device and the recovery codes
+func DeleteTOTP(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	vars := reqcontext.GetPathParams(r)
+	claims := reqcontext.GetAuthJWT(r)
+	logger.Debugf("%v:mfa:DeleteTOTP() Starts vars= %v", reqID, vars)
+	var (
+		apierr *apierror.Error
+		userID string
+		proof  = &mfa.Proof{}
+	)
+	db := reqcontext.GetDB(r)
+	if db == nil {
+		logger.Errorf("%s:mfa:DeleteTOTP() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	if userID, apierr = getUserID(r, vars, reqID); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	if userID == claims.UserID {
+		enabled, dberr := mfa.IsEnabled(r.Context(), db, userID, reqID)
+		if dberr != nil {
+			logger.Errorf("%s:mfa:DeleteTOTP() Got error from IsEnabled: err: %v", reqID, dberr)
+			apierr = apierror.FromDB(dberr)
+			responses.Error(r, w, apierr)
+			return
+		}
+		// A pending enrollment doesn't protect the account yet, it can be deleted without a code
+		if enabled {
+			if apierr = reqbody.Read(r, proof); apierr != nil {
+				responses.Error(r, w, apierr)
+				return
+			}
+			if err := proof.Valid(); err != nil {
+				apierr = apierror.New(http.StatusBadRequest, err.Error(), apierror.CodeBadRequestBody)
+				responses.Error(r, w, apierr)
+				return
+			}
+			if apierr = utils.VerifyMFACode(r.Context(), db, userID, proof.Code, proof.RecoveryCode, reqID); apierr != nil {
+				responses.Error(r, w, apierr)
+				return
+			}
+		}
+	}
+
+	if dberr := mfa.Delete(r.Context(), db, userID, reqID); dberr != nil {
+		logger.Errorf("%s:mfa:DeleteTOTP() Got error from Delete: err: %v", reqID, dberr)
+		apierr = apierror.FromDB(dberr)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	responses.NoContent(r, w, "/users/"+userID+"/mfa/totp")
+}
+
+// generateRecoveryCodes returns the recovery codes formatted as XXXX-XXXX-XXXX-XXXX and their hashes to be stored.
+// Each code has 80 random bits, so their unsalted hashes can't be reversed by trying every code
+func generateRecoveryCodes() (codes, codeHashes []string, err error) {
+	for i := 0; i < recoveryCodesCount; i++ {
+		var b []byte
+		if b, err = security.GenerateRandomBytes(recoveryCodeBytes); err != nil {
+			return
+		}
+		code := base32.StdEncoding.EncodeToString(b)
+		codes = append(codes, code[:4]+"-"+code[4:8]+"-"+code[8:12]+"-"+code[12:])
+		codeHashes = append(codeHashes, security.HashToken(mfa.NormalizeRecoveryCode(code)))
+	}
+	return
+}
+
+func getUserID(r *http.Request, vars map[string]string, reqID string) (userID string, apierr *apierror.Error) {
+	userID = vars["user_id"]
+	if userID == "this" {
+		userID = reqcontext.GetAuthJWT(r).UserID
+	} else if userID == "" {
+		logger.Errorf("%s:mfa:getUserID()  No User ID found in path", reqID)
+		apierr = apierror.New(http.StatusBadRequest, "No User ID", apierror.CodeBadRequestParams)
+		return
+	}
+	if !permissions.CanAccess(r, userID) {
+		apierr = apierror.New(http.StatusForbidden, "You can't modify this resource", apierror.CodeForbidden)
+	}
+	return
+}
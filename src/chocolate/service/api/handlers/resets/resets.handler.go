@@ -0,0 +1,374 @@
+package resets
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"chocolate/service/api/shared/apierror"
+	"chocolate/service/api/shared/reqbody"
+	"chocolate/service/api/shared/responses"
+	"chocolate/service/database"
+	"chocolate/service/models/outbox"
+	"chocolate/service/models/resets"
+	"chocolate/service/models/users"
+	"chocolate/service/shared/auth/jwt"
+	"chocolate/service/shared/email"
+	"chocolate/service/shared/email/templates"
+	"chocolate/service/shared/email/templates/reset"
+	"chocolate/service/shared/logger"
+	"chocolate/service/shared/reqcontext"
+	"chocolate/service/shared/security"
+)
+
+// resetExpiration is how long a password reset token is valid
+const resetExpiration = time.Hour
+
+// Reasons a reset link can't be used, they are the keys of the link error page messages
+const (
+	linkExpired = "expired"
+	linkUsed    = "used"
+	linkInvalid = "invalid"
+)
+
+// Create sends a password reset email to the user
+func Create(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	db := reqcontext.GetDB(r)
+	repo := reqcontext.GetUserRepository(r)
+
+	logger.Debugf("%s:resets:Create()", reqID)
+	var (
+		apierr     *apierror.Error
+		resetReq   = &resets.Request{}
+		resetToken string
+	)
+	if db == nil || repo == nil {
+		logger.Errorf("%s:resets:Create() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	// Get Body
+	if apierr = reqbody.Read(r, resetReq); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+	if err := resetReq.Valid(); err != nil {
+		apierr = apierror.New(http.StatusBadRequest, err.Error(), apierror.CodeBadRequestBody)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	user, dberr := repo.GetBy(r.Context(), "username", resetReq.Username, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:resets:Create() Got error from Get User: err: %v", reqID, dberr)
+		if dberr.Code == database.ErrorNoRows {
+			// Don't let the caller know which usernames are registered
+			responses.NoContent(r, w, "/password-resets")
+			return
+		}
+		apierr = apierror.FromDB(dberr)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	// The email is written to the outbox with the reset, so a registered username
+	// isn't told apart by a slower answer or a provider error
+	claims := generateResetClaims(&user)
+	if resetToken, apierr = jwt.Create(claims); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+	locale := templates.Locale(user.Locale, r.Header.Get("Accept-Language"))
+	var message *outbox.Message
+	if message, apierr = resetMessage(&user, reqcontext.GetBaseURL(r), resetToken, locale, reqID); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	pwdReset := &resets.Reset{ID: claims.Id, UserID: user.ID, ExpiresAt: claims.ExpiresAt}
+	dberr = db.WithTx(r.Context(), func(tx *database.Tx) error {
+		if dberr := pwdReset.Insert(r.Context(), tx, reqID); dberr != nil {
+			logger.Errorf("%s:resets:Create() Got error from Insert: err: %v", reqID, dberr)
+			return dberr
+		}
+		if dberr := message.Insert(r.Context(), tx, reqID); dberr != nil {
+			logger.Errorf("%s:resets:Create() Got error from outbox Insert: err: %v", reqID, dberr)
+			return dberr
+		}
+		return nil
+	})
+	if dberr != nil {
+		apierr = apierror.FromDB(dberr)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	responses.NoContent(r, w, "/password-resets")
+}
+
+// ResetPage shows the page the reset email links to, its form POSTs the new password to Reset
+// in this same path. Invalid or expired links show a page explaining it
+func ResetPage(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	logger.Debugf("%s:resets:ResetPage()", reqID)
+
+	locale := templates.Locale("", r.Header.Get("Accept-Language"))
+	resetToken := reqcontext.GetPathParams(r)["token"]
+	if _, reason := verifyResetToken(resetToken, reqID); reason != "" {
+		linkErrorPage(w, r, reason, locale)
+		return
+	}
+	resetPage(w, r, http.StatusOK, resetToken, "", locale)
+}
+
+// Reset sets a new password for the user that owns the reset token, the token can only be used once.
+// The reset page posts it as a form and gets a page back, API clients send JSON
+func Reset(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	db := reqcontext.GetDB(r)
+	repo := reqcontext.GetUserRepository(r)
+
+	logger.Debugf("%s:resets:Reset()", reqID)
+	var (
+		apierr      *apierror.Error
+		resetClaims *jwt.Claims
+		reason      string
+		pwd         = &resets.Password{}
+	)
+	if db == nil || repo == nil {
+		logger.Errorf("%s:resets:Reset() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	locale := templates.Locale("", r.Header.Get("Accept-Language"))
+	isForm := strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+	// fail answers the page of the reason the link can't be used or shows the form again with the error
+	// to the form posts, and the error to the API clients
+	fail := func(apierr *apierror.Error, reason string) {
+		switch {
+		case !isForm:
+			responses.Error(r, w, apierr)
+		case reason != "":
+			linkErrorPage(w, r, reason, locale)
+		case apierr.HTTPStatus == http.StatusBadRequest:
+			resetPage(w, r, http.StatusBadRequest, "", apierr.Message, locale)
+		default:
+			responses.Error(r, w, apierr)
+		}
+	}
+
+	// Get Reset Token
+	resetToken := reqcontext.GetPathParams(r)["token"]
+	if resetClaims, reason = verifyResetToken(resetToken, reqID); reason != "" {
+		switch reason {
+		case linkExpired:
+			apierr = apierror.New(http.StatusUnauthorized, "Reset token expired", apierror.CodeUnauthExpired)
+		default:
+			apierr = apierror.New(http.StatusForbidden, "Invalid reset token", apierror.CodeUnauth)
+		}
+		fail(apierr, reason)
+		return
+	}
+
+	// Get Body
+	if isForm {
+		pwd.Password, pwd.PasswordConfirm = r.PostFormValue("password"), r.PostFormValue("password_confirm")
+	} else if apierr = reqbody.Read(r, pwd); apierr != nil {
+		fail(apierr, "")
+		return
+	}
+	if err := pwd.Valid(); err != nil {
+		fail(apierror.New(http.StatusBadRequest, err.Error(), apierror.CodeBadRequestBody), "")
+		return
+	}
+	if strings.Compare(pwd.Password, pwd.PasswordConfirm) != 0 {
+		fail(apierror.New(http.StatusBadRequest, "Password confirmation doens't match", apierror.CodeBadReqPasswordConfirm), "")
+		return
+	}
+
+	// The policy checks the password doesn't contain the username
+	user, dberr := repo.GetByID(r.Context(), resetClaims.UserID, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:resets:Reset() Got error from GetByID: err: %v", reqID, dberr)
+		if dberr.Code == database.ErrorNoRows {
+			fail(apierror.New(http.StatusNotFound, "User is not registered", apierror.CodeResourceNotFound), linkInvalid)
+			return
+		}
+		fail(apierror.FromDB(dberr), "")
+		return
+	}
+	if err := security.CheckPasswordPolicy(pwd.Password, user.Username); err != nil {
+		fail(apierror.New(http.StatusBadRequest, err.Error(), apierror.CodeBadRequestBody), "")
+		return
+	}
+
+	password, err := security.GeneratePassword(pwd.Password)
+	if err != nil {
+		fail(apierror.New(http.StatusInternalServerError, fmt.Sprintf("Couldn't generate password: %s", err.Error()), apierror.CodeInternal), "")
+		return
+	}
+
+	// The reset token is only used if the password is changed and the tokens revoked
+	userID := resetClaims.UserID
+	dberr = db.WithTx(r.Context(), func(tx *database.Tx) error {
+		apierr, reason = nil, ""
+		if dberr := resets.Use(r.Context(), tx, resetClaims.Id, userID, reqID); dberr != nil {
+			logger.Errorf("%s:resets:Reset() Got error from Use: err: %v", reqID, dberr)
+			if dberr.Code == database.ErrorNoRows {
+				apierr = apierror.New(http.StatusUnauthorized, "Reset token was already used or expired", apierror.CodeUnauthRevoked)
+				reason = linkUsed
+			}
+			return dberr
+		}
+		if dberr := repo.WithExecutor(tx).UpdatePassword(r.Context(), userID, password.Hash, password.Salt, reqID); dberr != nil {
+			logger.Errorf("%s:resets:Reset() Got error from UpdatePassword: err: %v", reqID, dberr)
+			if dberr.Code == database.ErrorNoRows {
+				apierr = apierror.New(http.StatusNotFound, "User is not registered", apierror.CodeResourceNotFound)
+				reason = linkInvalid
+			}
+			return dberr
+		}
+		// Whoever had the old password shouldn't be able to keep using the account
+		if dberr := users.RevokeTokens(r.Context(), tx, userID, reqID); dberr != nil {
+			logger.Errorf("%s:resets:Reset() Got error from RevokeTokens: err: %v", reqID, dberr)
+			return dberr
+		}
+		// Not critical, pending resets will expire anyway
+		if dberr := tx.WithTx(r.Context(), func(tx *database.Tx) error {
+			return resets.Invalidate(r.Context(), tx, userID, reqID)
+		}); dberr != nil {
+			logger.Errorf("%s:resets:Reset() Got error from Invalidate: err: %v", reqID, dberr)
+		}
+		return nil
+	})
+	if dberr != nil {
+		if apierr == nil {
+			apierr = apierror.FromDB(dberr)
+		}
+		fail(apierr, reason)
+		return
+	}
+
+	if isForm {
+		resetDonePage(w, r, templates.Locale(user.Locale, r.Header.Get("Accept-Language")))
+		return
+	}
+	responses.NoContent(r, w, "/password-resets")
+}
+
+func generateResetClaims(u *users.User) jwt.Claims {
+	claims := jwt.New()
+	now := time.Now()
+	nowEpoch := now.Unix()
+	claims.ExpiresAt = now.Add(resetExpiration).Unix()
+	claims.IssuedAt = nowEpoch
+	claims.NotBefore = nowEpoch
+	claims.UserID = u.ID
+	claims.Role = jwt.RoleUser
+	claims.Subject = "/password-resets"
+	claims.TokenType = jwt.TokenTypeReset
+	return claims
+}
+
+// resetMessage renders the password reset email to write it to the outbox, it links to ResetPage
+func resetMessage(u *users.User, baseURL, token, locale, reqID string) (message *outbox.Message, apierr *apierror.Error) {
+	resetURL, err := url.Parse(baseURL)
+	if err != nil {
+		logger.Errorf("%s:Failed to genearate reset url: %s", reqID, err.Error())
+		return nil, apierror.New(http.StatusInternalServerError, "Couldn't send Reset email", apierror.CodeInternal)
+	}
+	resetURL.Path = path.Join(resetURL.Path, "password-resets", token)
+
+	body, err := reset.NewTemplate(locale, u.Username, resetURL.String(), token).Process()
+	if err != nil {
+		apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Couldnt render email: %s", err.Error()), apierror.CodeInternalEmail)
+		return
+	}
+	message = &outbox.Message{
+		Type:    string(email.HTMLEmail),
+		Subject: reset.Subject(locale),
+		From:    "fernandomitre7@gmail.com",
+		To:      u.Username,
+		Body:    body,
+	}
+	return
+}
+
+// verifyResetToken verifies the reset JWT, if it can't be used it returns why as the linkExpired or linkInvalid reason.
+// Used tokens are only found out when the password is changed
+func verifyResetToken(token, reqID string) (claims *jwt.Claims, reason string) {
+	if len(token) == 0 {
+		logger.Errorf("%s:resets:verifyResetToken() No Token found in path", reqID)
+		return nil, linkInvalid
+	}
+	claims, apierr := jwt.Verify(token)
+	if apierr != nil {
+		logger.Errorf("%s:resets:verifyResetToken() Got error from Verify: err: %v", reqID, apierr)
+		if apierr.APICode == apierror.CodeUnauthExpired {
+			return nil, linkExpired
+		}
+		return nil, linkInvalid
+	}
+	if claims.TokenType != jwt.TokenTypeReset {
+		logger.Errorf("%s:resets:verifyResetToken() Not a reset token", reqID)
+		return nil, linkInvalid
+	}
+	return claims, ""
+}
+
+// resetPage responds the page with the new password form, errMsg is shown above it.
+// The form posts to this same path, the token is the last segment
+func resetPage(w http.ResponseWriter, r *http.Request, status int, token, errMsg, locale string) {
+	if token == "" {
+		token = reqcontext.GetPathParams(r)["token"]
+	}
+	data := struct{ Action, Error string }{Action: token, Error: errMsg}
+	page, err := templates.Render("reset_page", locale, data)
+	if err != nil {
+		apierr := apierror.New(http.StatusInternalServerError, fmt.Sprintf("Couldn't parse reset page: %s", err.Error()), apierror.CodeInternal)
+		responses.Error(r, w, apierr)
+		return
+	}
+	responses.HTMLError(r, w, status, bytes.NewBufferString(page))
+}
+
+// resetDonePage responds the page that tells the user its password was changed
+func resetDonePage(w http.ResponseWriter, r *http.Request, locale string) {
+	page, err := templates.Render("password_reset", locale, nil)
+	if err != nil {
+		apierr := apierror.New(http.StatusInternalServerError, fmt.Sprintf("Couldn't parse password reset page: %s", err.Error()), apierror.CodeInternal)
+		responses.Error(r, w, apierr)
+		return
+	}
+	responses.HTML(r, w, bytes.NewBufferString(page))
+}
+
+// linkErrorPage responds the page that explains why the reset link can't be used,
+// its title and message are the "reset.<reason>" catalog messages
+func linkErrorPage(w http.ResponseWriter, r *http.Request, reason, locale string) {
+	status := http.StatusBadRequest
+	switch reason {
+	case linkExpired:
+		status = http.StatusGone
+	case linkUsed:
+		status = http.StatusConflict
+	}
+	data := struct{ Title, Message string }{
+		Title:   templates.Message("reset."+reason+".title", locale),
+		Message: templates.Message("reset."+reason+".message", locale),
+	}
+	page, err := templates.Render("confirm_error", locale, data)
+	if err != nil {
+		apierr := apierror.New(http.StatusInternalServerError, fmt.Sprintf("Couldn't parse link error page: %s", err.Error()), apierror.CodeInternal)
+		responses.Error(r, w, apierr)
+		return
+	}
+	responses.HTMLError(r, w, status, bytes.NewBufferString(page))
+}
@@ -0,0 +1,271 @@
+package roles
+
+import (
+	"fmt"
+	"net/http"
+
+	"chocolate/service/api/shared/apierror"
+	"chocolate/service/api/shared/reqbody"
+	"chocolate/service/api/shared/responses"
+	"chocolate/service/database"
+	"chocolate/service/models/roles"
+	"chocolate/service/models/users"
+	"chocolate/service/shared/auth/jwt"
+	"chocolate/service/shared/auth/permissions"
+	"chocolate/service/shared/logger"
+	"chocolate/service/shared/reqcontext"
+	"chocolate/service/shared/utils/uuid"
+)
+
+// protectedRoles can't be deleted, every user has jwt.RoleUser and
+// jwt.RoleAdmin is needed to manage the rest of the roles
+var protectedRoles = map[string]struct{}{
+	jwt.RoleUser:  struct{}{},
+	jwt.RoleAdmin: struct{}{},
+}
+
+// GetUserRoles lists the roles granted to a user
+func GetUserRoles(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	vars := reqcontext.GetPathParams(r)
+	claims := reqcontext.GetAuthJWT(r)
+	logger.Debugf("%v:roles:GetUserRoles() Starts vars= %v", reqID, vars)
+	var apierr *apierror.Error
+
+	db := reqcontext.GetDB(r)
+	if db == nil {
+		logger.Errorf("%s:roles:GetUserRoles() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	userID := vars["user_id"]
+	if userID == "this" {
+		userID = claims.UserID
+	}
+	if !permissions.CanAccess(r, userID) {
+		apierr = apierror.New(http.StatusForbidden, "You can't access this resource", apierror.CodeForbidden)
+		responses.Error(r, w, apierr)
+		return
+	}
+	if !uuid.Valid(userID) {
+		apierr = apierror.New(http.StatusBadRequest, "Invalid User ID", apierror.CodeBadRequestParams)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	userRoles, dberr := roles.GetUserRoles(r.Context(), db, userID, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:roles:GetUserRoles() Got error from GetUserRoles: err: %v", reqID, dberr)
+		apierr = apierror.FromDB(dberr)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	responses.Ok(r, w, userRoles, "/users/"+userID+"/roles")
+}
+
+// GrantRole grants a role to a user
+func GrantRole(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	vars := reqcontext.GetPathParams(r)
+	logger.Debugf("%v:roles:GrantRole() Starts vars= %v", reqID, vars)
+	var apierr *apierror.Error
+
+	db := reqcontext.GetDB(r)
+	if db == nil {
+		logger.Errorf("%s:roles:GrantRole() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	userID, role := vars["user_id"], vars["role"]
+	if !uuid.Valid(userID) {
+		apierr = apierror.New(http.StatusBadRequest, "Invalid User ID", apierror.CodeBadRequestParams)
+		responses.Error(r, w, apierr)
+		return
+	}
+	// Every user already has jwt.RoleUser
+	if role == jwt.RoleUser {
+		apierr = apierror.New(http.StatusBadRequest, fmt.Sprintf("Role %q can't be granted", role), apierror.CodeBadRequestParams)
+		responses.Error(r, w, apierr)
+		return
+	}
+	exists, dberr := roles.Exists(r.Context(), db, role, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:roles:GrantRole() Got error from Exists: err: %v", reqID, dberr)
+		apierr = apierror.FromDB(dberr)
+		responses.Error(r, w, apierr)
+		return
+	}
+	if !exists {
+		apierr = apierror.New(http.StatusNotFound, fmt.Sprintf("Role %q is not defined", role), apierror.CodeResourceNotFound)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	userRole := &roles.UserRole{UserID: userID, Role: role}
+	if dberr = userRole.Grant(r.Context(), db, reqID); dberr != nil {
+		logger.Errorf("%s:roles:GrantRole() Got error from Grant: err: %v", reqID, dberr)
+		switch code := dberr.Code; code {
+		case database.ErrorForeignKey:
+			apierr = apierror.New(http.StatusNotFound, "User is not registered", apierror.CodeResourceNotFound)
+		default:
+			apierr = apierror.FromDB(dberr)
+		}
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	responses.Ok(r, w, userRole, "/users/"+userID+"/roles/"+role)
+}
+
+// RevokeRole revokes a role from a user, the user tokens are revoked too
+// so no token with the old role keeps working
+func RevokeRole(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	vars := reqcontext.GetPathParams(r)
+	logger.Debugf("%v:roles:RevokeRole() Starts vars= %v", reqID, vars)
+	var apierr *apierror.Error
+
+	db := reqcontext.GetDB(r)
+	if db == nil {
+		logger.Errorf("%s:roles:RevokeRole() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	userID, role := vars["user_id"], vars["role"]
+	if !uuid.Valid(userID) {
+		apierr = apierror.New(http.StatusBadRequest, "Invalid User ID", apierror.CodeBadRequestParams)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	// The permissions are taken from the role in the token, the role is only revoked along with the tokens
+	dberr := db.WithTx(r.Context(), func(tx *database.Tx) error {
+		apierr = nil
+		if dberr := roles.Revoke(r.Context(), tx, userID, role, reqID); dberr != nil {
+			logger.Errorf("%s:roles:RevokeRole() Got error from Revoke: err: %v", reqID, dberr)
+			if dberr.Code == database.ErrorNoRows {
+				apierr = apierror.New(http.StatusNotFound, fmt.Sprintf("User doesn't have role %q", role), apierror.CodeResourceNotFound)
+			}
+			return dberr
+		}
+		if dberr := users.RevokeTokens(r.Context(), tx, userID, reqID); dberr != nil {
+			logger.Errorf("%s:roles:RevokeRole() Got error from RevokeTokens: err: %v", reqID, dberr)
+			return dberr
+		}
+		return nil
+	})
+	if dberr != nil {
+		if apierr == nil {
+			apierr = apierror.FromDB(dberr)
+		}
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	responses.NoContent(r, w, "/users/"+userID+"/roles/"+role)
+}
+
+// GetRoles lists the roles defined and their permissions
+func GetRoles(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	logger.Debugf("%v:roles:GetRoles() Starts", reqID)
+	var apierr *apierror.Error
+
+	db := reqcontext.GetDB(r)
+	if db == nil {
+		logger.Errorf("%s:roles:GetRoles() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	list, dberr := roles.GetRoles(r.Context(), db, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:roles:GetRoles() Got error from GetRoles: err: %v", reqID, dberr)
+		apierr = apierror.FromDB(dberr)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	responses.Ok(r, w, list, "/roles")
+}
+
+// SaveRole creates or replaces a role and its permissions
+func SaveRole(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	vars := reqcontext.GetPathParams(r)
+	logger.Debugf("%v:roles:SaveRole() Starts vars= %v", reqID, vars)
+	var (
+		apierr *apierror.Error
+		role   = &roles.Role{}
+	)
+	db := reqcontext.GetDB(r)
+	if db == nil {
+		logger.Errorf("%s:roles:SaveRole() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	// Get Body
+	if apierr = reqbody.Read(r, role); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+	role.Name = vars["role"]
+	if err := role.Valid(); err != nil {
+		apierr = apierror.New(http.StatusBadRequest, err.Error(), apierror.CodeBadRequestBody)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	if dberr := role.Save(r.Context(), db, reqID); dberr != nil {
+		logger.Errorf("%s:roles:SaveRole() Got error from Save: err: %v", reqID, dberr)
+		apierr = apierror.FromDB(dberr)
+		responses.Error(r, w, apierr)
+		return
+	}
+	permissions.Invalidate(role.Name)
+
+	responses.Ok(r, w, role, "/roles/"+role.Name)
+}
+
+// DeleteRole deletes a role, the users it was granted to lose it
+func DeleteRole(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	vars := reqcontext.GetPathParams(r)
+	logger.Debugf("%v:roles:DeleteRole() Starts vars= %v", reqID, vars)
+	var apierr *apierror.Error
+
+	db := reqcontext.GetDB(r)
+	if db == nil {
+		logger.Errorf("%s:roles:DeleteRole() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	role := vars["role"]
+	if _, ok := protectedRoles[role]; ok {
+		apierr = apierror.New(http.StatusBadRequest, fmt.Sprintf("Role %q can't be deleted", role), apierror.CodeBadRequestParams)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	if dberr := roles.DeleteRole(r.Context(), db, role, reqID); dberr != nil {
+		logger.Errorf("%s:roles:DeleteRole() Got error from DeleteRole: err: %v", reqID, dberr)
+		switch code := dberr.Code; code {
+		case database.ErrorNoRows:
+			apierr = apierror.New(http.StatusNotFound, fmt.Sprintf("Role %q is not defined", role), apierror.CodeResourceNotFound)
+		default:
+			apierr = apierror.FromDB(dberr)
+		}
+		responses.Error(r, w, apierr)
+		return
+	}
+	permissions.Invalidate(role)
+
+	responses.NoContent(r, w, "/roles/"+role)
+}
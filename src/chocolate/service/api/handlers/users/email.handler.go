@@ -0,0 +1,485 @@
+package users
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"chocolate/service/api/shared/apierror"
+	"chocolate/service/api/shared/reqbody"
+	"chocolate/service/api/shared/responses"
+	"chocolate/service/database"
+	"chocolate/service/models/emailchanges"
+	"chocolate/service/models/outbox"
+	"chocolate/service/models/users"
+	"chocolate/service/shared/auth/jwt"
+	"chocolate/service/shared/auth/permissions"
+	"chocolate/service/shared/email"
+	"chocolate/service/shared/email/templates"
+	"chocolate/service/shared/email/templates/emailchange"
+	"chocolate/service/shared/logger"
+	"chocolate/service/shared/reqcontext"
+	"chocolate/service/shared/security"
+)
+
+// emailUndoExpiration is how long the old address can undo an email change
+const emailUndoExpiration = 7 * 24 * time.Hour
+
+// ChangeEmail starts the change of the user email (username), the new address gets a link to confirm it and
+// the old one a notice with a link to undo it. The username only changes once the new address is confirmed
+func ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	vars := reqcontext.GetPathParams(r)
+	claims := reqcontext.GetAuthJWT(r)
+	logger.Debugf("%v:users:ChangeEmail() Starts vars= %v", reqID, vars)
+	var (
+		apierr    *apierror.Error
+		userID    string
+		changeReq = &emailchanges.Request{}
+	)
+	db := reqcontext.GetDB(r)
+	repo := reqcontext.GetUserRepository(r)
+	if db == nil || repo == nil {
+		logger.Errorf("%s:users:ChangeEmail() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	// Get user_id
+	if userID, apierr = getUserID(&claims, vars, reqID); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+	if !permissions.CanAccess(r, userID) {
+		apierr = apierror.New(http.StatusForbidden, "You can't modify this resource", apierror.CodeForbidden)
+		responses.Error(r, w, apierr)
+		return
+	}
+	// Get Body
+	if apierr = reqbody.Read(r, changeReq); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+	if err := changeReq.Valid(); err != nil {
+		apierr = apierror.New(http.StatusBadRequest, err.Error(), apierror.CodeBadRequestBody)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	user, dberr := repo.GetBy(r.Context(), "id", userID, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:users:ChangeEmail() Got error from Get User: err: %v", reqID, dberr)
+		if dberr.Code == database.ErrorNoRows {
+			apierr = apierror.New(http.StatusNotFound, "User is not registered", apierror.CodeResourceNotFound)
+		} else {
+			apierr = apierror.FromDB(dberr)
+		}
+		responses.Error(r, w, apierr)
+		return
+	}
+	// Whoever has a session must also know the password to take over the account
+	if !security.CheckPasswordHash(changeReq.Password, user.Salt, user.Password) {
+		apierr = apierror.New(http.StatusUnauthorized, "Wrong credentials", apierror.CodeUnauth)
+		responses.Error(r, w, apierr)
+		return
+	}
+	if strings.EqualFold(changeReq.Email, user.Username) {
+		apierr = apierror.New(http.StatusBadRequest, "The email is already the user email", apierror.CodeBadRequestBody)
+		responses.Error(r, w, apierr)
+		return
+	}
+	// It is checked again when the change is confirmed
+	if _, dberr = repo.GetBy(r.Context(), "username", changeReq.Email, reqID); dberr == nil {
+		apierr = apierror.New(http.StatusConflict, "The email is already registered", apierror.CodeResourceConflict)
+		responses.Error(r, w, apierr)
+		return
+	} else if dberr.Code != database.ErrorNoRows {
+		logger.Errorf("%s:users:ChangeEmail() Got error from Get User by username: err: %v", reqID, dberr)
+		apierr = apierror.FromDB(dberr)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	// A new change replaces the pending one, its links can't be used anymore
+	change := &emailchanges.EmailChange{UserID: userID, OldEmail: user.Username, NewEmail: changeReq.Email}
+	baseURL := reqcontext.GetBaseURL(r)
+	dberr = db.WithTx(r.Context(), func(tx *database.Tx) error {
+		apierr = nil
+		if dberr := emailchanges.CancelPending(r.Context(), tx, userID, reqID); dberr != nil {
+			logger.Errorf("%s:users:ChangeEmail() Got error from CancelPending: err: %v", reqID, dberr)
+			return dberr
+		}
+		var messages []*outbox.Message
+		if messages, apierr = emailChangeMessages(&user, change, baseURL, reqID); apierr != nil {
+			return apierr
+		}
+		if dberr := change.Insert(r.Context(), tx, reqID); dberr != nil {
+			logger.Errorf("%s:users:ChangeEmail() Got error from Insert: err: %v", reqID, dberr)
+			return dberr
+		}
+		for _, message := range messages {
+			if dberr := message.Insert(r.Context(), tx, reqID); dberr != nil {
+				logger.Errorf("%s:users:ChangeEmail() Got error from outbox Insert: err: %v", reqID, dberr)
+				return dberr
+			}
+		}
+		return nil
+	})
+	if dberr != nil {
+		if apierr == nil {
+			apierr = apierror.FromDB(dberr)
+		}
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	responses.Created(r, w, change, "/users/"+userID+"/email")
+}
+
+// ConfirmEmailChangePage shows the page that confirms the new address of an email change,
+// like ConfirmPage its form POSTs the token to ConfirmEmailChange
+func ConfirmEmailChangePage(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	logger.Debugf("%v:users:ConfirmEmailChangePage() Starts", reqID)
+
+	db := reqcontext.GetDB(r)
+	if db == nil {
+		logger.Errorf("%s:users:ConfirmEmailChangePage() Missing DB", reqID)
+		apierr := apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	userID := reqcontext.GetPathParams(r)["user_id"]
+	locale := templates.Locale("", r.Header.Get("Accept-Language"))
+
+	token := r.FormValue("t")
+	change, reason, dberr := getEmailChange(r, db, userID, token, jwt.TokenTypeEmailChange, reqID)
+	if dberr != nil {
+		responses.Error(r, w, apierror.FromDB(dberr))
+		return
+	}
+	if reason == "" {
+		reason = emailChangeError(change, time.Now())
+	}
+	if reason != "" {
+		linkErrorPage(w, r, "email_change", reason, locale)
+		return
+	}
+
+	// The form posts to this same path, without the token in the query
+	data := struct{ Username, Action, Token string }{Username: change.NewEmail, Action: "confirm", Token: token}
+	emailPage(w, r, "confirm_page", locale, data)
+}
+
+// ConfirmEmailChange changes the user username to the new address with the token posted by the confirm page,
+// the new address is confirmed. The refreshed tokens of the user get EmailOK from the new state
+func ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	logger.Debugf("%v:users:ConfirmEmailChange() Starts", reqID)
+
+	var (
+		apierr   *apierror.Error
+		newEmail string
+	)
+	db := reqcontext.GetDB(r)
+	repo := reqcontext.GetUserRepository(r)
+	if db == nil || repo == nil {
+		logger.Errorf("%s:users:ConfirmEmailChange() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	userID := reqcontext.GetPathParams(r)["user_id"]
+	locale := templates.Locale("", r.Header.Get("Accept-Language"))
+
+	claims, reason := verifyLinkToken(userID, r.FormValue("t"), jwt.TokenTypeEmailChange, reqID)
+	if reason != "" {
+		linkErrorPage(w, r, "email_change", reason, locale)
+		return
+	}
+
+	dberr := db.WithTx(r.Context(), func(tx *database.Tx) error {
+		apierr = nil
+		var dberr *database.Error
+		if newEmail, dberr = emailchanges.Confirm(r.Context(), tx, claims.Id, userID, reqID); dberr != nil {
+			logger.Errorf("%s:users:ConfirmEmailChange() Got error from Confirm: err: %v", reqID, dberr)
+			return dberr
+		}
+		if dberr = repo.WithExecutor(tx).UpdateUsername(r.Context(), userID, newEmail, reqID); dberr != nil {
+			logger.Errorf("%s:users:ConfirmEmailChange() Got error from UpdateUsername: err: %v", reqID, dberr)
+			switch dberr.Code {
+			case database.ErrorAlreadyExists:
+				reason = linkTaken
+			case database.ErrorNoRows:
+				apierr = apierror.New(http.StatusNotFound, "User is not registered", apierror.CodeResourceNotFound)
+			}
+			return dberr
+		}
+		// The undo links of the older changes would put back an address this one replaced
+		if dberr = emailchanges.Supersede(r.Context(), tx, claims.Id, userID, reqID); dberr != nil {
+			logger.Errorf("%s:users:ConfirmEmailChange() Got error from Supersede: err: %v", reqID, dberr)
+			return dberr
+		}
+		return nil
+	})
+	if dberr != nil {
+		if dberr.Code == database.ErrorNoRows && apierr == nil {
+			// Tell apart why the change couldn't be confirmed
+			change, dberr := emailchanges.Get(r.Context(), db, claims.Id, reqID)
+			switch {
+			case dberr == nil:
+				reason = emailChangeError(change, time.Now())
+			case dberr.Code == database.ErrorNoRows:
+				reason = linkInvalid
+			}
+		}
+		if reason != "" {
+			linkErrorPage(w, r, "email_change", reason, locale)
+			return
+		}
+		if apierr == nil {
+			apierr = apierror.FromDB(dberr)
+		}
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	emailPage(w, r, "confirmed", locale, struct{ Username string }{Username: newEmail})
+}
+
+// UndoEmailChangePage shows the page that undoes an email change from the old address,
+// like ConfirmPage its form POSTs the token to UndoEmailChange
+func UndoEmailChangePage(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	logger.Debugf("%v:users:UndoEmailChangePage() Starts", reqID)
+
+	db := reqcontext.GetDB(r)
+	if db == nil {
+		logger.Errorf("%s:users:UndoEmailChangePage() Missing DB", reqID)
+		apierr := apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	userID := reqcontext.GetPathParams(r)["user_id"]
+	locale := templates.Locale("", r.Header.Get("Accept-Language"))
+
+	token := r.FormValue("t")
+	change, reason, dberr := getEmailChange(r, db, userID, token, jwt.TokenTypeEmailUndo, reqID)
+	if dberr != nil {
+		responses.Error(r, w, apierror.FromDB(dberr))
+		return
+	}
+	if reason == "" && change.UndoneAt > 0 {
+		reason = linkUsed
+	}
+	if reason != "" {
+		linkErrorPage(w, r, "email_change", reason, locale)
+		return
+	}
+
+	data := struct{ OldEmail, NewEmail, Action, Token string }{
+		OldEmail: change.OldEmail, NewEmail: change.NewEmail, Action: "undo", Token: token,
+	}
+	emailPage(w, r, "email_undo_page", locale, data)
+}
+
+// UndoEmailChange undoes the email change with the token posted by the undo page, if it was confirmed the old
+// address is the username again. Every token of the user is revoked as someone else could have asked for it.
+// Only the last confirmed change can be undone, confirming a change supersedes the older ones
+func UndoEmailChange(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	logger.Debugf("%v:users:UndoEmailChange() Starts", reqID)
+
+	var (
+		apierr *apierror.Error
+		change emailchanges.EmailChange
+	)
+	db := reqcontext.GetDB(r)
+	repo := reqcontext.GetUserRepository(r)
+	if db == nil || repo == nil {
+		logger.Errorf("%s:users:UndoEmailChange() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	userID := reqcontext.GetPathParams(r)["user_id"]
+	locale := templates.Locale("", r.Header.Get("Accept-Language"))
+
+	claims, reason := verifyLinkToken(userID, r.FormValue("t"), jwt.TokenTypeEmailUndo, reqID)
+	if reason != "" {
+		linkErrorPage(w, r, "email_change", reason, locale)
+		return
+	}
+
+	dberr := db.WithTx(r.Context(), func(tx *database.Tx) error {
+		apierr = nil
+		var dberr *database.Error
+		if change, dberr = emailchanges.Undo(r.Context(), tx, claims.Id, userID, reqID); dberr != nil {
+			logger.Errorf("%s:users:UndoEmailChange() Got error from Undo: err: %v", reqID, dberr)
+			if dberr.Code == database.ErrorNoRows {
+				reason = linkUsed
+			}
+			return dberr
+		}
+		if change.ConfirmedAt > 0 {
+			if dberr = repo.WithExecutor(tx).UpdateUsername(r.Context(), userID, change.OldEmail, reqID); dberr != nil {
+				logger.Errorf("%s:users:UndoEmailChange() Got error from UpdateUsername: err: %v", reqID, dberr)
+				switch dberr.Code {
+				case database.ErrorAlreadyExists:
+					reason = linkTaken
+				case database.ErrorNoRows:
+					apierr = apierror.New(http.StatusNotFound, "User is not registered", apierror.CodeResourceNotFound)
+				}
+				return dberr
+			}
+		}
+		if dberr = emailchanges.CancelPending(r.Context(), tx, userID, reqID); dberr != nil {
+			logger.Errorf("%s:users:UndoEmailChange() Got error from CancelPending: err: %v", reqID, dberr)
+			return dberr
+		}
+		if dberr = users.RevokeTokens(r.Context(), tx, userID, reqID); dberr != nil {
+			logger.Errorf("%s:users:UndoEmailChange() Got error from RevokeTokens: err: %v", reqID, dberr)
+			return dberr
+		}
+		return nil
+	})
+	if dberr != nil {
+		if reason != "" {
+			linkErrorPage(w, r, "email_change", reason, locale)
+			return
+		}
+		if apierr == nil {
+			apierr = apierror.FromDB(dberr)
+		}
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	emailPage(w, r, "email_undone", locale, struct{ Username string }{Username: change.OldEmail})
+}
+
+// getEmailChange gets the email change of the link token, if the link can't be used it returns why
+func getEmailChange(r *http.Request, db *database.DB, userID, token, tokenType, reqID string) (change emailchanges.EmailChange, reason string, dberr *database.Error) {
+	claims, reason := verifyLinkToken(userID, token, tokenType, reqID)
+	if reason != "" {
+		return
+	}
+	if change, dberr = emailchanges.Get(r.Context(), db, claims.Id, reqID); dberr != nil {
+		logger.Errorf("%s:users:getEmailChange() Got error from Get: err: %v", reqID, dberr)
+		if dberr.Code == database.ErrorNoRows {
+			return change, linkInvalid, nil
+		}
+		return
+	}
+	if change.UserID != userID {
+		reason = linkInvalid
+	}
+	return
+}
+
+// emailChangeError returns why the email change can't be confirmed, or "" if it can
+func emailChangeError(c emailchanges.EmailChange, now time.Time) string {
+	switch {
+	case c.ConfirmedAt > 0 || c.UndoneAt > 0:
+		return linkUsed
+	case c.ExpiresAt <= now.Unix():
+		return linkExpired
+	}
+	return ""
+}
+
+// emailPage responds the name page rendered in the locale
+func emailPage(w http.ResponseWriter, r *http.Request, name, locale string, data interface{}) {
+	page, err := templates.Render(name, locale, data)
+	if err != nil {
+		apierr := apierror.New(http.StatusInternalServerError, fmt.Sprintf("Couldn't parse %s page: %s", name, err.Error()), apierror.CodeInternal)
+		responses.Error(r, w, apierr)
+		return
+	}
+	responses.HTML(r, w, bytes.NewBufferString(page))
+}
+
+// emailChangeMessages renders the email that verifies the new address and the notice with the undo link sent
+// to the old one to write them to the outbox, the ID of the change is the ID of both link tokens
+func emailChangeMessages(u *users.User, change *emailchanges.EmailChange, baseURL, reqID string) (messages []*outbox.Message, apierr *apierror.Error) {
+	now := time.Now()
+	confirmClaims := generateEmailLinkClaims(u.ID, jwt.TokenTypeEmailChange, now.Add(jwt.ConfirmExpiration()))
+	undoClaims := generateEmailLinkClaims(u.ID, jwt.TokenTypeEmailUndo, now.Add(emailUndoExpiration))
+	undoClaims.Id = confirmClaims.Id
+	change.ID = confirmClaims.Id
+	change.ExpiresAt = confirmClaims.ExpiresAt
+
+	var confirmToken, undoToken, confirmURL, undoURL string
+	if confirmToken, apierr = jwt.Create(confirmClaims); apierr != nil {
+		return
+	}
+	if undoToken, apierr = jwt.Create(undoClaims); apierr != nil {
+		return
+	}
+	if confirmURL, apierr = generateEmailLinkURL(baseURL, u.ID, "confirm", confirmToken); apierr != nil {
+		logger.Errorf("%s:Failed to genearate email change confirm url: %s", reqID, apierr.Error())
+		return
+	}
+	if undoURL, apierr = generateEmailLinkURL(baseURL, u.ID, "undo", undoToken); apierr != nil {
+		logger.Errorf("%s:Failed to genearate email change undo url: %s", reqID, apierr.Error())
+		return
+	}
+
+	body, err := emailchange.NewTemplate(u.Locale, change.OldEmail, change.NewEmail, confirmURL).Process()
+	if err != nil {
+		apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Couldnt render email: %s", err.Error()), apierror.CodeInternalEmail)
+		return
+	}
+	notice, err := emailchange.NewNoticeTemplate(u.Locale, change.OldEmail, change.NewEmail, undoURL).Process()
+	if err != nil {
+		apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Couldnt render email: %s", err.Error()), apierror.CodeInternalEmail)
+		return
+	}
+
+	messages = []*outbox.Message{
+		{
+			Type:    string(email.HTMLEmail),
+			Subject: emailchange.Subject(u.Locale),
+			From:    "fernandomitre7@gmail.com",
+			To:      change.NewEmail,
+			Body:    body,
+		},
+		{
+			Type:    string(email.HTMLEmail),
+			Subject: emailchange.NoticeSubject(u.Locale),
+			From:    "fernandomitre7@gmail.com",
+			To:      change.OldEmail,
+			Body:    notice,
+		},
+	}
+	return
+}
+
+func generateEmailLinkClaims(userID, tokenType string, expiresAt time.Time) jwt.Claims {
+	claims := jwt.New()
+	nowEpoch := time.Now().Unix()
+	claims.ExpiresAt = expiresAt.Unix()
+	claims.IssuedAt = nowEpoch
+	claims.NotBefore = nowEpoch
+	claims.UserID = userID
+	claims.Role = jwt.RoleUser
+	claims.Subject = fmt.Sprintf("/users/%s/email", userID)
+	claims.TokenType = tokenType
+	return claims
+}
+
+func generateEmailLinkURL(baseURL, userID, action, token string) (string, *apierror.Error) {
+	linkURL, err := url.Parse(baseURL)
+	if err != nil {
+		return "", apierror.New(http.StatusInternalServerError, "Couldn't send email change emails", apierror.CodeInternal)
+	}
+	linkURL.Path = path.Join(linkURL.Path, "users", userID, "email", action)
+	q := linkURL.Query()
+	q.Set("t", token)
+	linkURL.RawQuery = q.Encode()
+	return linkURL.String(), nil
+}
@@ -0,0 +1,157 @@
+package users
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"chocolate/service/api/shared/apierror"
+	"chocolate/service/api/shared/reqbody"
+	"chocolate/service/api/shared/responses"
+	"chocolate/service/database"
+	"chocolate/service/models/outbox"
+	"chocolate/service/models/resets"
+	"chocolate/service/models/tokens"
+	"chocolate/service/models/users"
+	"chocolate/service/shared/auth/permissions"
+	"chocolate/service/shared/email"
+	"chocolate/service/shared/email/templates/passwordchange"
+	"chocolate/service/shared/logger"
+	"chocolate/service/shared/reqcontext"
+	"chocolate/service/shared/security"
+)
+
+// ChangePassword changes the password of the user, it requires the current one. The other sessions of the user
+// are revoked, the one that changed it is kept, and the user gets an email about the change
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	vars := reqcontext.GetPathParams(r)
+	claims := reqcontext.GetAuthJWT(r)
+	logger.Debugf("%v:users:ChangePassword() Starts vars= %v", reqID, vars)
+	var (
+		apierr    *apierror.Error
+		userID    string
+		changeReq = &users.PasswordChange{}
+	)
+	db := reqcontext.GetDB(r)
+	repo := reqcontext.GetUserRepository(r)
+	if db == nil || repo == nil {
+		logger.Errorf("%s:users:ChangePassword() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	// Get user_id
+	if userID, apierr = getUserID(&claims, vars, reqID); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+	if !permissions.CanAccess(r, userID) {
+		apierr = apierror.New(http.StatusForbidden, "You can't modify this resource", apierror.CodeForbidden)
+		responses.Error(r, w, apierr)
+		return
+	}
+	// Get Body
+	if apierr = reqbody.Read(r, changeReq); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+	if err := changeReq.Valid(); err != nil {
+		apierr = apierror.New(http.StatusBadRequest, err.Error(), apierror.CodeBadRequestBody)
+		responses.Error(r, w, apierr)
+		return
+	}
+	if strings.Compare(changeReq.Password, changeReq.PasswordConfirm) != 0 {
+		apierr = apierror.New(http.StatusBadRequest, "Password confirmation doens't match", apierror.CodeBadReqPasswordConfirm)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	user, dberr := repo.GetBy(r.Context(), "id", userID, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:users:ChangePassword() Got error from Get User: err: %v", reqID, dberr)
+		if dberr.Code == database.ErrorNoRows {
+			apierr = apierror.New(http.StatusNotFound, "User is not registered", apierror.CodeResourceNotFound)
+		} else {
+			apierr = apierror.FromDB(dberr)
+		}
+		responses.Error(r, w, apierr)
+		return
+	}
+	if !security.CheckPasswordHash(changeReq.CurrentPassword, user.Salt, user.Password) {
+		apierr = apierror.New(http.StatusUnauthorized, "Wrong credentials", apierror.CodeUnauth)
+		responses.Error(r, w, apierr)
+		return
+	}
+	if changeReq.Password == changeReq.CurrentPassword {
+		apierr = apierror.New(http.StatusBadRequest, "The new password must be different", apierror.CodeBadRequestBody)
+		responses.Error(r, w, apierr)
+		return
+	}
+	if err := security.CheckPasswordPolicy(changeReq.Password, user.Username); err != nil {
+		apierr = apierror.New(http.StatusBadRequest, err.Error(), apierror.CodeBadRequestBody)
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	password, err := security.GeneratePassword(changeReq.Password)
+	if err != nil {
+		apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Couldn't generate password: %s", err.Error()), apierror.CodeInternal)
+		responses.Error(r, w, apierr)
+		return
+	}
+	var message *outbox.Message
+	if message, apierr = passwordChangedMessage(&user); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	dberr = db.WithTx(r.Context(), func(tx *database.Tx) error {
+		if dberr := repo.WithExecutor(tx).UpdatePassword(r.Context(), userID, password.Hash, password.Salt, reqID); dberr != nil {
+			logger.Errorf("%s:users:ChangePassword() Got error from UpdatePassword: err: %v", reqID, dberr)
+			return dberr
+		}
+		// Whoever had the old password shouldn't be able to keep using the account, the user stays logged in
+		if dberr := tokens.RevokeOtherFamilies(r.Context(), tx, userID, claims.Family, reqID); dberr != nil {
+			logger.Errorf("%s:users:ChangePassword() Got error from RevokeOtherFamilies: err: %v", reqID, dberr)
+			return dberr
+		}
+		if dberr := resets.Invalidate(r.Context(), tx, userID, reqID); dberr != nil {
+			logger.Errorf("%s:users:ChangePassword() Got error from Invalidate: err: %v", reqID, dberr)
+			return dberr
+		}
+		if dberr := message.Insert(r.Context(), tx, reqID); dberr != nil {
+			logger.Errorf("%s:users:ChangePassword() Got error from outbox Insert: err: %v", reqID, dberr)
+			return dberr
+		}
+		return nil
+	})
+	if dberr != nil {
+		if dberr.Code == database.ErrorNoRows {
+			apierr = apierror.New(http.StatusNotFound, "User is not registered", apierror.CodeResourceNotFound)
+		} else {
+			apierr = apierror.FromDB(dberr)
+		}
+		responses.Error(r, w, apierr)
+		return
+	}
+
+	responses.NoContent(r, w, "/users/"+userID+"/password")
+}
+
+// passwordChangedMessage renders the email that tells the user its password was changed
+func passwordChangedMessage(u *users.User) (message *outbox.Message, apierr *apierror.Error) {
+	body, err := passwordchange.NewTemplate(u.Locale, u.Username).Process()
+	if err != nil {
+		apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Couldnt render email: %s", err.Error()), apierror.CodeInternalEmail)
+		return
+	}
+	message = &outbox.Message{
+		Type:    string(email.HTMLEmail),
+		Subject: passwordchange.Subject(u.Locale),
+		From:    "fernandomitre7@gmail.com",
+		To:      u.Username,
+		Body:    body,
+	}
+	return
+}
@@ -3,7 +3,7 @@ package users
 import (
 	"bytes"
 	"fmt"
-	"html/template"
+	"math"
 	"net/http"
 	"net/url"
 	"path"
@@ -15,19 +15,39 @@ import (
 	"chocolate/service/api/shared/responses"
 	"chocolate/service/database"
 	"chocolate/service/models/auth"
+	"chocolate/service/models/confirmations"
+	"chocolate/service/models/outbox"
 	"chocolate/service/models/users"
 	"chocolate/service/shared/auth/jwt"
+	"chocolate/service/shared/auth/permissions"
 	"chocolate/service/shared/auth/utils"
 	"chocolate/service/shared/email"
+	"chocolate/service/shared/email/templates"
 	"chocolate/service/shared/email/templates/confirm"
 	"chocolate/service/shared/logger"
 	"chocolate/service/shared/reqcontext"
 	"chocolate/service/shared/security"
 )
 
+const (
+	// confirmationCooldown is how long a user waits to ask for another confirmation email
+	confirmationCooldown = 2 * time.Minute
+	// confirmationDailyCap is how many confirmation emails a user gets in 24 hours, the first one included
+	confirmationDailyCap = 5
+)
+
+// Reasons an email link can't be used, they are the keys of the link error page messages
+const (
+	linkExpired = "expired"
+	linkUsed    = "used"
+	linkInvalid = "invalid"
+	linkTaken   = "taken"
+)
+
 // Create creates a new user in database
 func Create(w http.ResponseWriter, r *http.Request) {
 	reqID := reqcontext.GetReqID(r)
+	repo := reqcontext.GetUserRepository(r)
 	db := reqcontext.GetDB(r)
 
 	logger.Debugf("%s:users:Create()", reqID)
@@ -36,7 +56,7 @@ func Create(w http.ResponseWriter, r *http.Request) {
 		dberr  *database.Error
 		user   = &users.User{}
 	)
-	if db == nil {
+	if repo == nil || db == nil {
 		logger.Errorf("%s:users:Create() Missing DB", reqID)
 		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
 		responses.Error(r, w, apierr)
@@ -63,32 +83,59 @@ func Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Hash Password
-	if apierr = generatePassword(user); apierr != nil {
+	if err := security.CheckPasswordPolicy(user.Password, user.Username); err != nil {
+		apierr = apierror.New(http.StatusBadRequest, err.Error(), apierror.CodeBadRequestBody)
 		responses.Error(r, w, apierr)
 		return
 	}
 
-	logger.Debugf("Got hash %s and salt %s", user.Password, user.Salt)
+	// The emails are sent in the requested locale, or the best one of the client languages
+	user.Locale = templates.Locale(user.Locale, r.Header.Get("Accept-Language"))
 
-	if dberr = user.Insert(db, reqID); dberr != nil {
-		logger.Errorf("%s:users:Create() Got error from Insert: err: %v", reqID, dberr)
-		switch code := dberr.Code; code {
-		case database.ErrorAlreadyExists:
-			apierr = apierror.New(http.StatusBadRequest, fmt.Sprintf("User %s already exists: %s", user.Username, dberr.Error()), apierror.CodeBadRequestBody)
-		case database.ErrorModelInvalid:
-			apierr = apierror.New(http.StatusBadRequest, fmt.Sprintf("User not valid: %s", dberr.Error()), apierror.CodeBadRequestBody)
-		case database.ErrorGeneric, database.ErrorExecute:
-			apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Something went wrong: %s", dberr.Error()), apierror.CodeInternalDB)
-		}
+	// Hash Password
+	if apierr = generatePassword(user); apierr != nil {
 		responses.Error(r, w, apierr)
 		return
 	}
 
+	logger.Debugf("Got hash %s and salt %s", user.Password, user.Salt)
+
+	// The confirmation email is written to the outbox along with the user, the dispatcher sends it
+	// once the user is committed so neither exists without the other
 	baseURL := reqcontext.GetBaseURL(r)
-	if apierr = sendConfirmationEmail(user, baseURL, reqID); apierr != nil {
-		// Should I delete recently created User?
-		// Should I send the conf email on a separate goroutine??
+	dberr = db.WithTx(r.Context(), func(tx *database.Tx) error {
+		apierr = nil
+		if dberr := repo.WithExecutor(tx).Insert(r.Context(), user, reqID); dberr != nil {
+			logger.Errorf("%s:users:Create() Got error from Insert: err: %v", reqID, dberr)
+			switch code := dberr.Code; code {
+			case database.ErrorAlreadyExists:
+				apierr = apierror.New(http.StatusBadRequest, fmt.Sprintf("User %s already exists: %s", user.Username, dberr.Error()), apierror.CodeBadRequestBody)
+			case database.ErrorModelInvalid:
+				apierr = apierror.New(http.StatusBadRequest, fmt.Sprintf("User not valid: %s", dberr.Error()), apierror.CodeBadRequestBody)
+			}
+			return dberr
+		}
+		var (
+			message      *outbox.Message
+			confirmation *confirmations.Confirmation
+		)
+		if message, confirmation, apierr = confirmationMessage(user, baseURL, reqID); apierr != nil {
+			return apierr
+		}
+		if dberr := message.Insert(r.Context(), tx, reqID); dberr != nil {
+			logger.Errorf("%s:users:Create() Got error from outbox Insert: err: %v", reqID, dberr)
+			return dberr
+		}
+		if dberr := confirmation.Insert(r.Context(), tx, reqID); dberr != nil {
+			logger.Errorf("%s:users:Create() Got error from confirmation Insert: err: %v", reqID, dberr)
+			return dberr
+		}
+		return nil
+	})
+	if dberr != nil {
+		if apierr == nil {
+			apierr = apierror.FromDB(dberr)
+		}
 		responses.Error(r, w, apierr)
 		return
 	}
@@ -101,25 +148,31 @@ func Create(w http.ResponseWriter, r *http.Request) {
 // Get gets all users
 func Get(w http.ResponseWriter, r *http.Request) {
 	reqID := reqcontext.GetReqID(r)
-	db := reqcontext.GetDB(r)
+	repo := reqcontext.GetUserRepository(r)
 	var apierr *apierror.Error
 	logger.Debugf("%s:users:Get()", reqID)
 
-	if db == nil {
+	if repo == nil {
 		logger.Errorf("%s:users:Get() Missing DB", reqID)
 		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
 		responses.Error(r, w, apierr)
 		return
 	}
+	// The list has every user, an "own" scope reaches none of the other users
+	if !permissions.CanAccessAll(r) {
+		apierr = apierror.New(http.StatusForbidden, "You can't access this resource", apierror.CodeForbidden)
+		responses.Error(r, w, apierr)
+		return
+	}
 
-	usersList, dbErr := users.GetList(db, reqID)
+	usersList, dbErr := repo.GetList(r.Context(), reqID)
 	if dbErr != nil {
 		logger.Errorf("%s:users:Get() Got error from Select: err: %v", reqID, dbErr)
 		switch code := dbErr.Code; code {
 		case database.ErrorModelInvalid:
 			apierr = apierror.New(http.StatusBadRequest, fmt.Sprintf("User not valid: %s", dbErr.Error()), apierror.CodeBadRequestBody)
-		case database.ErrorGeneric, database.ErrorExecute:
-			apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Something went wrong: %s", dbErr.Error()), apierror.CodeInternalDB)
+		case database.ErrorGeneric, database.ErrorExecute, database.ErrorTimeout, database.ErrorCanceled:
+			apierr = apierror.FromDB(dbErr)
 		default:
 			apierr = nil
 		}
@@ -148,8 +201,8 @@ func GetByID(w http.ResponseWriter, r *http.Request) {
 	// Get current accessClaims
 	claims = reqcontext.GetAuthJWT(r)
 	logger.Debugf("%v:auth:GetByID() claims %+v", reqID, claims)
-	db := reqcontext.GetDB(r)
-	if db == nil {
+	repo := reqcontext.GetUserRepository(r)
+	if repo == nil {
 		logger.Errorf("%s:users:GetByID() Missing DB", reqID)
 		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
 		responses.Error(r, w, apierr)
@@ -161,17 +214,17 @@ func GetByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	logger.Debugf("%s:users:GetByID() Path User ID: %s, Claim UserID: %s", reqID, userID, claims.UserID)
-	if claims.Role == jwt.RoleUser && userID != claims.UserID {
+	if !permissions.CanAccess(r, userID) {
 		apierr = apierror.New(http.StatusForbidden, "You can't modify this resource", apierror.CodeForbidden)
 		responses.Error(r, w, apierr)
 		return
 	}
-	user, dbErr := users.GetByID(db, userID, reqID)
+	user, dbErr := repo.GetByID(r.Context(), userID, reqID)
 	if dbErr != nil {
 		logger.Errorf("%s:users:GetByID() Got error from Select: err: %v", reqID, dbErr)
 		switch code := dbErr.Code; code {
-		case database.ErrorGeneric, database.ErrorExecute:
-			apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Something went wrong: %s", dbErr.Error()), apierror.CodeInternalDB)
+		case database.ErrorGeneric, database.ErrorExecute, database.ErrorTimeout, database.ErrorCanceled:
+			apierr = apierror.FromDB(dbErr)
 		default:
 			apierr = nil
 		}
@@ -199,7 +252,8 @@ func Update(w http.ResponseWriter, r *http.Request) {
 		returnJWT bool
 	)
 	db := reqcontext.GetDB(r)
-	if db == nil {
+	repo := reqcontext.GetUserRepository(r)
+	if db == nil || repo == nil {
 		logger.Errorf("%s:users:Update() Missing DB", reqID)
 		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
 		responses.Error(r, w, apierr)
@@ -208,7 +262,7 @@ func Update(w http.ResponseWriter, r *http.Request) {
 	// Get user_id
 	userID, apierr = getUserID(&claims, vars, reqID)
 	logger.Debugf("%s:users:Update() Path User ID: %s, Claim UserID: %s", reqID, userID, claims.UserID)
-	if claims.Role == jwt.RoleUser && userID != claims.UserID {
+	if !permissions.CanAccess(r, userID) {
 		apierr = apierror.New(http.StatusForbidden, "You can't modify this resource", apierror.CodeForbidden)
 		responses.Error(r, w, apierr)
 		return
@@ -229,13 +283,13 @@ func Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if dbErr := user.Update(db, reqID); dbErr != nil {
+	if dbErr := repo.Update(r.Context(), user, reqID); dbErr != nil {
 		logger.Errorf("%s:users:Update() Got error from Update: err: %v", reqID, dbErr)
 		switch code := dbErr.Code; code {
 		case database.ErrorModelInvalid:
 			apierr = apierror.New(http.StatusBadRequest, fmt.Sprintf("User not valid: %s", dbErr.Error()), apierror.CodeBadRequestBody)
-		case database.ErrorGeneric, database.ErrorExecute:
-			apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Something went wrong: %s", dbErr.Error()), apierror.CodeInternalDB)
+		case database.ErrorGeneric, database.ErrorExecute, database.ErrorTimeout, database.ErrorCanceled:
+			apierr = apierror.FromDB(dbErr)
 		}
 
 		responses.Error(r, w, apierr)
@@ -248,8 +302,8 @@ func Update(w http.ResponseWriter, r *http.Request) {
 		iat := time.Unix(claims.IssuedAt, 0)
 		refreshExp := exp.Sub(iat)
 		var authResponse *auth.Response
-		if authResponse, apierr = utils.GenerateAuthResponse(reqID, jwt.RoleUser, user.ID,
-			refreshExp, user.Confirmed); apierr != nil {
+		if authResponse, apierr = utils.GenerateAuthResponse(r.Context(), db, reqID, jwt.RoleUser, user.ID,
+			claims.Family, refreshExp, user.Confirmed); apierr != nil {
 			responses.Error(r, w, apierr)
 			return
 		}
@@ -269,29 +323,32 @@ func Delete(w http.ResponseWriter, r *http.Request) {
 		apierr *apierror.Error
 		userID string
 	)
-	db := reqcontext.GetDB(r)
-	if db == nil {
+	repo := reqcontext.GetUserRepository(r)
+	if repo == nil {
 		logger.Errorf("%s:users:Delete() Missing DB", reqID)
 		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
 		responses.Error(r, w, apierr)
 		return
 	}
 	// Get user_id
-	userID, ok := vars["user_id"]
-	if !ok {
-		logger.Errorf("%s:users:Delete()  No User ID found in path", reqID)
-		apierr = apierror.New(http.StatusInternalServerError, "User ID in path cannot be retrieved", apierror.CodeInternal)
+	claims := reqcontext.GetAuthJWT(r)
+	if userID, apierr = getUserID(&claims, vars, reqID); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+	if !permissions.CanAccess(r, userID) {
+		apierr = apierror.New(http.StatusForbidden, "You can't modify this resource", apierror.CodeForbidden)
 		responses.Error(r, w, apierr)
 		return
 	}
 
-	if dbErr := users.Delete(db, userID, reqID); dbErr != nil {
+	if dbErr := repo.Delete(r.Context(), userID, reqID); dbErr != nil {
 		logger.Errorf("%s:users:Delete() Got error from Delete: err: %v", reqID, dbErr)
 		switch code := dbErr.Code; code {
 		case database.ErrorModelInvalid:
 			apierr = apierror.New(http.StatusBadRequest, fmt.Sprintf("User not valid: %s", dbErr.Error()), apierror.CodeBadRequestBody)
-		case database.ErrorGeneric, database.ErrorExecute:
-			apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Something went wrong: %s", dbErr.Error()), apierror.CodeInternalDB)
+		case database.ErrorGeneric, database.ErrorExecute, database.ErrorTimeout, database.ErrorCanceled:
+			apierr = apierror.FromDB(dbErr)
 		}
 	}
 
@@ -304,19 +361,89 @@ func Delete(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// Confirm confirms email of specific user
+// ConfirmPage shows the page that confirms the email of the user, the link of the confirmation email only
+// shows it so the email clients that prefetch links don't confirm it. The page form POSTs the token to Confirm
+func ConfirmPage(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	logger.Debugf("%v:users:ConfirmPage() Starts", reqID)
+
+	var apierr *apierror.Error
+	db := reqcontext.GetDB(r)
+	repo := reqcontext.GetUserRepository(r)
+	if db == nil || repo == nil {
+		logger.Errorf("%s:users:ConfirmPage() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
+	}
+	// Get user_id
+	vars := reqcontext.GetPathParams(r)
+	userID, ok := vars["user_id"]
+	if !ok {
+		logger.Errorf("%s:users:ConfirmPage()  No User ID found in path", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "User ID in path cannot be retrieved", apierror.CodeInternal)
+		responses.Error(r, w, apierr)
+		return
+	}
+	locale := templates.Locale("", r.Header.Get("Accept-Language"))
+
+	confirmToken := r.FormValue("t")
+	confirmClaims, reason := verifyLinkToken(userID, confirmToken, jwt.TokenTypeConfirm, reqID)
+	if reason != "" {
+		linkErrorPage(w, r, "confirm", reason, locale)
+		return
+	}
+	confirmation, dberr := confirmations.Get(r.Context(), db, confirmClaims.Id, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:users:ConfirmPage() Got error from Get confirmation: err: %v", reqID, dberr)
+		if dberr.Code == database.ErrorNoRows {
+			linkErrorPage(w, r, "confirm", linkInvalid, locale)
+			return
+		}
+		responses.Error(r, w, apierror.FromDB(dberr))
+		return
+	}
+	if reason = confirmationError(confirmation, userID, time.Now()); reason != "" {
+		linkErrorPage(w, r, "confirm", reason, locale)
+		return
+	}
+
+	user, dberr := repo.GetByID(r.Context(), userID, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:users:ConfirmPage() Got error from GetByID: err: %v", reqID, dberr)
+		if dberr.Code == database.ErrorNoRows {
+			linkErrorPage(w, r, "confirm", linkInvalid, locale)
+			return
+		}
+		responses.Error(r, w, apierror.FromDB(dberr))
+		return
+	}
+
+	// The form posts to this same path, without the token in the query
+	data := struct{ Username, Action, Token string }{Username: user.Username, Action: "confirm", Token: confirmToken}
+	page, err := templates.Render("confirm_page", templates.Locale(user.Locale, r.Header.Get("Accept-Language")), data)
+	if err != nil {
+		apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Couldn't parse confirm page: %s", err.Error()), apierror.CodeInternal)
+		responses.Error(r, w, apierr)
+		return
+	}
+	responses.HTML(r, w, bytes.NewBufferString(page))
+}
+
+// Confirm confirms email of specific user with the token posted by the confirm page,
+// the token can only be used once and the other pending ones of the user are invalidated
 func Confirm(w http.ResponseWriter, r *http.Request) {
 	reqID := reqcontext.GetReqID(r)
 	logger.Debugf("%v:auth:Confirm() Starts", reqID)
 
 	var (
-		apierr        *apierror.Error
-		confirmToken  string
-		confirmClaims *jwt.Claims
+		apierr *apierror.Error
+		u      *users.User
 	)
 
 	db := reqcontext.GetDB(r)
-	if db == nil {
+	repo := reqcontext.GetUserRepository(r)
+	if db == nil || repo == nil {
 		logger.Errorf("%s:users:Confirm() Missing DB", reqID)
 		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
 		responses.Error(r, w, apierr)
@@ -331,60 +458,172 @@ func Confirm(w http.ResponseWriter, r *http.Request) {
 		responses.Error(r, w, apierr)
 		return
 	}
-	logger.Debugf("%s:users:Confirm() User ID: %s", userID)
+	logger.Debugf("%s:users:Confirm() User ID: %s", reqID, userID)
+	locale := templates.Locale("", r.Header.Get("Accept-Language"))
 
-	// Get Confirm Token
-	if confirmToken = r.FormValue("t"); len(confirmToken) == 0 {
-		apierr = apierror.New(http.StatusBadRequest, "Missing 'token' query parameter", apierror.CodeBadRequestParams)
+	// Verify Confirm JWT and get claims
+	confirmClaims, reason := verifyLinkToken(userID, r.FormValue("t"), jwt.TokenTypeConfirm, reqID)
+	if reason != "" {
+		linkErrorPage(w, r, "confirm", reason, locale)
+		return
+	}
+
+	dberr := db.WithTx(r.Context(), func(tx *database.Tx) error {
+		apierr = nil
+		if dberr := confirmations.Use(r.Context(), tx, confirmClaims.Id, userID, reqID); dberr != nil {
+			logger.Errorf("%s:users:Confirm() Got error from Use: err: %v", reqID, dberr)
+			return dberr
+		}
+		// Update User ID with email confirmed
+		u = &users.User{ID: userID, Confirmed: true}
+		if dberr := repo.WithExecutor(tx).Update(r.Context(), u, reqID); dberr != nil {
+			logger.Errorf("%s:users:Confirm() Got error from Update: err: %v", reqID, dberr)
+			if dberr.Code == database.ErrorNoRows {
+				apierr = apierror.New(http.StatusNotFound, "User is not registered", apierror.CodeResourceNotFound)
+			}
+			return dberr
+		}
+		// The links of the other confirmation emails can't be used anymore
+		if dberr := confirmations.Invalidate(r.Context(), tx, userID, reqID); dberr != nil {
+			logger.Errorf("%s:users:Confirm() Got error from Invalidate: err: %v", reqID, dberr)
+			return dberr
+		}
+		return nil
+	})
+	if dberr != nil {
+		if dberr.Code == database.ErrorNoRows && apierr == nil {
+			// Tell apart why the token couldn't be used
+			confirmation, dberr := confirmations.Get(r.Context(), db, confirmClaims.Id, reqID)
+			switch {
+			case dberr == nil:
+				reason = confirmationError(confirmation, userID, time.Now())
+			case dberr.Code == database.ErrorNoRows:
+				reason = linkInvalid
+			}
+			if reason != "" {
+				linkErrorPage(w, r, "confirm", reason, locale)
+				return
+			}
+		}
+		if apierr == nil {
+			apierr = apierror.FromDB(dberr)
+		}
 		responses.Error(r, w, apierr)
 		return
 	}
 
-	// Verify Confirm JWT and get claims
-	if confirmClaims, apierr = jwt.Verify(confirmToken); apierr != nil {
+	// Return HTML response
+	var page *bytes.Buffer
+	locale = templates.Locale(u.Locale, r.Header.Get("Accept-Language"))
+	if page, apierr = getConfirmedPage(u.Username, locale); apierr != nil {
 		responses.Error(r, w, apierr)
 		return
 	}
-	if userID != confirmClaims.UserID {
-		if confirmClaims.TokenType != jwt.TokenTypeConfirm {
-			apierr = apierror.New(http.StatusForbidden, "Token doesnt belong to user", apierror.CodeUnauth)
-			responses.Error(r, w, apierr)
-			return
-		}
+
+	responses.HTML(r, w, page)
+	return
+}
+
+// ResendConfirmation issues a new confirmation token and email to a user that hasn't confirmed its email yet,
+// a new one can be asked for after confirmationCooldown and up to confirmationDailyCap times a day
+func ResendConfirmation(w http.ResponseWriter, r *http.Request) {
+	reqID := reqcontext.GetReqID(r)
+	vars := reqcontext.GetPathParams(r)
+	claims := reqcontext.GetAuthJWT(r)
+	logger.Debugf("%v:users:ResendConfirmation() Starts vars= %v", reqID, vars)
+	var (
+		apierr     *apierror.Error
+		userID     string
+		retryAfter time.Duration
+	)
+	db := reqcontext.GetDB(r)
+	repo := reqcontext.GetUserRepository(r)
+	if db == nil || repo == nil {
+		logger.Errorf("%s:users:ResendConfirmation() Missing DB", reqID)
+		apierr = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+		responses.Error(r, w, apierr)
+		return
 	}
-	if confirmClaims.TokenType != jwt.TokenTypeConfirm {
-		apierr = apierror.New(http.StatusForbidden, "This is not a confirm token", apierror.CodeUnauth)
+	// Get user_id
+	if userID, apierr = getUserID(&claims, vars, reqID); apierr != nil {
+		responses.Error(r, w, apierr)
+		return
+	}
+	if !permissions.CanAccess(r, userID) {
+		apierr = apierror.New(http.StatusForbidden, "You can't modify this resource", apierror.CodeForbidden)
 		responses.Error(r, w, apierr)
 		return
 	}
 
-	// Update User ID with email confirmed
-	u := &users.User{ID: userID, Confirmed: true}
-	if dberr := u.Update(db, reqID); dberr != nil {
-		logger.Errorf("%s:users:Confirm() Got error from Update: err: %v", reqID, dberr)
-		switch code := dberr.Code; code {
-		case database.ErrorNoRows:
+	user, dberr := repo.GetByID(r.Context(), userID, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:users:ResendConfirmation() Got error from GetByID: err: %v", reqID, dberr)
+		if dberr.Code == database.ErrorNoRows {
 			apierr = apierror.New(http.StatusNotFound, "User is not registered", apierror.CodeResourceNotFound)
-		/* case database.ErrorDB, database.ErrorExecute:
-		apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Something went wrong: %s", dberr.Error()), apierror.CodeInternalDB) */
-		default:
-			apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Something went wrong: %s", dberr.Error()), apierror.CodeInternalDB)
+		} else {
+			apierr = apierror.FromDB(dberr)
 		}
+		responses.Error(r, w, apierr)
+		return
 	}
-	if apierr != nil {
+	if user.Confirmed {
+		apierr = apierror.New(http.StatusConflict, "Email is already confirmed", apierror.CodeResourceConflict)
 		responses.Error(r, w, apierr)
 		return
 	}
 
-	// Return HTML response
-	var page *bytes.Buffer
-	if page, apierr = getConfirmedPage(u.Username); apierr != nil {
+	// The stats are checked and the new confirmation inserted in a serializable transaction,
+	// so concurrent requests can't all pass the cooldown and the cap
+	baseURL := reqcontext.GetBaseURL(r)
+	dberr = db.WithSerializableTx(r.Context(), func(tx *database.Tx) error {
+		apierr = nil
+		retryAfter = 0
+		now := time.Now()
+		stats, dberr := confirmations.GetStats(r.Context(), tx, userID, now.Add(-24*time.Hour), reqID)
+		if dberr != nil {
+			logger.Errorf("%s:users:ResendConfirmation() Got error from GetStats: err: %v", reqID, dberr)
+			return dberr
+		}
+		if stats.Sent >= confirmationDailyCap {
+			retryAfter = time.Unix(stats.FirstSentAt, 0).Add(24 * time.Hour).Sub(now)
+			apierr = apierror.New(http.StatusTooManyRequests, "Too many confirmation emails today, try again later", apierror.CodeTooManyRequests)
+			return apierr
+		}
+		if stats.Sent > 0 && now.Sub(time.Unix(stats.LastSentAt, 0)) < confirmationCooldown {
+			retryAfter = time.Unix(stats.LastSentAt, 0).Add(confirmationCooldown).Sub(now)
+			apierr = apierror.New(http.StatusTooManyRequests, "A confirmation email was just sent, try again later", apierror.CodeTooManyRequests)
+			return apierr
+		}
+
+		var (
+			message      *outbox.Message
+			confirmation *confirmations.Confirmation
+		)
+		if message, confirmation, apierr = confirmationMessage(&user, baseURL, reqID); apierr != nil {
+			return apierr
+		}
+		if dberr := message.Insert(r.Context(), tx, reqID); dberr != nil {
+			logger.Errorf("%s:users:ResendConfirmation() Got error from outbox Insert: err: %v", reqID, dberr)
+			return dberr
+		}
+		if dberr := confirmation.Insert(r.Context(), tx, reqID); dberr != nil {
+			logger.Errorf("%s:users:ResendConfirmation() Got error from confirmation Insert: err: %v", reqID, dberr)
+			return dberr
+		}
+		return nil
+	})
+	if dberr != nil {
+		if apierr == nil {
+			apierr = apierror.FromDB(dberr)
+		}
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(retryAfter.Seconds()))))
+		}
 		responses.Error(r, w, apierr)
 		return
 	}
 
-	responses.HTML(r, w, page)
-	return
+	responses.NoContent(r, w, "/users/"+userID+"/confirmation")
 }
 
 func getUserID(claims *jwt.Claims, vars map[string]string, reqID string) (userID string, apierr *apierror.Error) {
@@ -395,28 +634,83 @@ func getUserID(claims *jwt.Claims, vars map[string]string, reqID string) (userID
 		apierr = apierror.New(http.StatusInternalServerError, "User ID in path cannot be retrieved", apierror.CodeInternal)
 		return
 	}
+	// Services have no user to resolve "this" to
 	if userID == "this" {
 		userID = claims.UserID
-	} else if userID == "" {
+	}
+	if userID == "" {
 		apierr = apierror.New(http.StatusBadRequest, "No User ID", apierror.CodeBadRequestParams)
 	}
 	return
 }
 
-func getConfirmedPage(username string) (buf *bytes.Buffer, apierr *apierror.Error) {
-	// TODO: Move location to config file
-	t, err := template.ParseFiles("data/pages/confirmed.html")
+// verifyLinkToken verifies the JWT of an email link of the user, if it can't be used
+// it returns why as the linkExpired or linkInvalid reason
+func verifyLinkToken(userID, token, tokenType, reqID string) (claims *jwt.Claims, reason string) {
+	if len(token) == 0 {
+		logger.Errorf("%s:users:verifyLinkToken() Missing token", reqID)
+		return nil, linkInvalid
+	}
+	claims, apierr := jwt.Verify(token)
+	if apierr != nil {
+		logger.Errorf("%s:users:verifyLinkToken() Got error from Verify: err: %v", reqID, apierr)
+		if apierr.APICode == apierror.CodeUnauthExpired {
+			return nil, linkExpired
+		}
+		return nil, linkInvalid
+	}
+	if claims.TokenType != tokenType || claims.UserID != userID {
+		logger.Errorf("%s:users:verifyLinkToken() Not a %s of user %s", reqID, tokenType, userID)
+		return nil, linkInvalid
+	}
+	return claims, ""
+}
+
+// confirmationError returns why the confirmation can't be used by the user, or "" if it can.
+// The ones issued before confirmation links expired have no expiration and are taken as expired
+func confirmationError(c confirmations.Confirmation, userID string, now time.Time) string {
+	switch {
+	case c.UserID != userID:
+		return linkInvalid
+	case c.UsedAt > 0:
+		return linkUsed
+	case c.ExpiresAt <= now.Unix():
+		return linkExpired
+	}
+	return ""
+}
+
+// linkErrorPage responds the page that explains why the email link can't be used,
+// its title and message are the "<messages>.<reason>" catalog messages
+func linkErrorPage(w http.ResponseWriter, r *http.Request, messages, reason, locale string) {
+	status := http.StatusBadRequest
+	switch reason {
+	case linkExpired:
+		status = http.StatusGone
+	case linkUsed, linkTaken:
+		status = http.StatusConflict
+	}
+	data := struct{ Title, Message string }{
+		Title:   templates.Message(messages+"."+reason+".title", locale),
+		Message: templates.Message(messages+"."+reason+".message", locale),
+	}
+	page, err := templates.Render("confirm_error", locale, data)
 	if err != nil {
-		apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Couldn't get confirmed page: %s", err.Error()), apierror.CodeInternal)
+		apierr := apierror.New(http.StatusInternalServerError, fmt.Sprintf("Couldn't parse link error page: %s", err.Error()), apierror.CodeInternal)
+		responses.Error(r, w, apierr)
 		return
 	}
-	buf = new(bytes.Buffer)
+	responses.HTMLError(r, w, status, bytes.NewBufferString(page))
+}
+
+func getConfirmedPage(username, locale string) (buf *bytes.Buffer, apierr *apierror.Error) {
 	data := struct{ Username string }{Username: username}
-	if err = t.Execute(buf, data); err != nil {
+	page, err := templates.Render("confirmed", locale, data)
+	if err != nil {
 		apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Couldn't parse confirmed page: %s", err.Error()), apierror.CodeInternal)
 		return
 	}
-	return
+	return bytes.NewBufferString(page), nil
 }
 
 func generatePassword(u *users.User) (apierr *apierror.Error) {
@@ -429,10 +723,13 @@ func generatePassword(u *users.User) (apierr *apierror.Error) {
 	return
 }
 
-// sendConfirmationEmail uses email provider to send the new account confirmation email
-func sendConfirmationEmail(u *users.User, baseURL, reqID string) (apierr *apierror.Error) {
+// confirmationMessage renders the account confirmation email to write it to the outbox,
+// along with the confirmation record of its token
+func confirmationMessage(u *users.User, baseURL, reqID string) (message *outbox.Message, confirmation *confirmations.Confirmation, apierr *apierror.Error) {
 	var token, confURL string
-	if token, apierr = generateConfirmationToken(u, reqID); apierr != nil {
+	claims := generateConfirmationClaims(u)
+	logger.Debugf("%s:users:confirmationMessage()  Claims: %+v:", reqID, claims)
+	if token, apierr = jwt.Create(claims); apierr != nil {
 		logger.Errorf("%s:Failed to generate confirmation token: %s", reqID, apierr.Error())
 		return
 	}
@@ -441,26 +738,20 @@ func sendConfirmationEmail(u *users.User, baseURL, reqID string) (apierr *apierr
 		return
 	}
 
-	sender, emailErr := email.NewSender()
-	if emailErr != nil {
-		apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Couldnt Create Email Sender: %s", emailErr.Error()), apierror.CodeInternalEmail)
+	body, err := confirm.NewTemplate(u.Locale, u.Username, confURL).Process()
+	if err != nil {
+		apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Couldnt render email: %s", err.Error()), apierror.CodeInternalEmail)
 		return
 	}
 
-	confTemplate := confirm.NewTemplate(u.Username, confURL)
-
-	mail := &email.Email{
-		Type:     email.HTMLEmail,
-		Subject:  "Bienvenido a Zale",
-		From:     "fernandomitre7@gmail.com",
-		To:       u.Username,
-		Template: confTemplate,
+	message = &outbox.Message{
+		Type:    string(email.HTMLEmail),
+		Subject: confirm.Subject(u.Locale),
+		From:    "fernandomitre7@gmail.com",
+		To:      u.Username,
+		Body:    body,
 	}
-	if emailErr = sender.Send(mail); emailErr != nil {
-		apierr = apierror.New(http.StatusInternalServerError, fmt.Sprintf("Couldnt send email: %s", emailErr.Error()), apierror.CodeInternalEmail)
-		return
-	}
-
+	confirmation = &confirmations.Confirmation{ID: claims.Id, UserID: u.ID, ExpiresAt: claims.ExpiresAt}
 	return
 }
 
@@ -479,19 +770,17 @@ func generateConfirmationURL(baseURL, userID, confToken string) (string, *apierr
 	return confURL.String(), nil
 }
 
-func generateConfirmationToken(u *users.User, reqID string) (string, *apierror.Error) {
+func generateConfirmationClaims(u *users.User) jwt.Claims {
 	claims := jwt.New()
 	now := time.Now()
 	nowEpoch := now.Unix()
 	claims.EmailOK = false
-	claims.ExpiresAt = 0
+	claims.ExpiresAt = now.Add(jwt.ConfirmExpiration()).Unix()
 	claims.IssuedAt = nowEpoch
 	claims.NotBefore = nowEpoch
 	claims.UserID = u.ID
 	claims.Role = jwt.RoleUser
 	claims.Subject = fmt.Sprintf("/users/%s/confirm", u.ID)
 	claims.TokenType = jwt.TokenTypeConfirm
-
-	logger.Debugf("%s:users:generateConfirmationToken()  Claims: %+v:", reqID, claims)
-	return jwt.Create(claims)
+	return claims
 }
@@ -0,0 +1,199 @@
+package users
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"chocolate/service/database"
+	"chocolate/service/models"
+	"chocolate/service/models/users"
+	"chocolate/service/shared/auth/jwt"
+	"chocolate/service/shared/config"
+	"chocolate/service/shared/logger"
+	"chocolate/service/shared/reqcontext"
+)
+
+// newTestDB opens a migrated SQLite DB and loads a JWT key pair, both in a temporary dir
+func newTestDB(t *testing.T) *database.DB {
+	t.Helper()
+	logger.Init("", false)
+	dir := t.TempDir()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &config.Configuration{}
+	conf.JWT.PrivKey, conf.JWT.PubKey = filepath.Join(dir, "jwt.priv"), filepath.Join(dir, "jwt.pub")
+	privPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+	if err = ioutil.WriteFile(conf.JWT.PrivKey, privPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(conf.JWT.PubKey, pubPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = jwt.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	// A single connection so the foreign keys pragma applies to every query
+	db, err := database.New(config.SQLConfig{Driver: "sqlite3", File: filepath.Join(dir, "test.db"), MaxOpenConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	migs, err := models.GetMigrations(db.Dialect())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dberr := db.Init(migs); dberr != nil {
+		t.Fatal(dberr)
+	}
+	// The users are kept in a MemoryRepository, the tables that reference them can't find them
+	if _, err = db.GetInstance().ExecContext(context.Background(), `PRAGMA foreign_keys = OFF`); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newRequest creates a request with the context the router sets, the users are stored in repo
+func newRequest(db *database.DB, repo users.UserRepository, method, body string) *http.Request {
+	r := httptest.NewRequest(method, "/v1/users", bytes.NewBufferString(body))
+	r.Header.Set("Content-Type", "application/json")
+	ctx := context.WithValue(r.Context(), reqcontext.ReqIDKey, "test")
+	ctx = context.WithValue(ctx, reqcontext.DbKey, db)
+	ctx = context.WithValue(ctx, reqcontext.BaseURLKey, "http://localhost/v1")
+	ctx = context.WithValue(ctx, reqcontext.UserRepositoryKey, repo)
+	return r.WithContext(ctx)
+}
+
+func TestCreate(t *testing.T) {
+	db := newTestDB(t)
+	repo := users.NewMemoryRepository()
+	body := `{"username":"ana@example.com","password":"Secret123!","password_confirm":"Secret123!"}`
+
+	w := httptest.NewRecorder()
+	Create(w, newRequest(db, repo, "POST", body))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Create() status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body.String())
+	}
+	if _, dberr := repo.GetBy(context.Background(), "username", "ana@example.com", "test"); dberr != nil {
+		t.Fatalf("GetBy() got error %v, want the created user", dberr)
+	}
+
+	w = httptest.NewRecorder()
+	Create(w, newRequest(db, repo, "POST", body))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Create() of a duplicated user status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCreateWeakPassword(t *testing.T) {
+	db := newTestDB(t)
+	repo := users.NewMemoryRepository()
+
+	w := httptest.NewRecorder()
+	Create(w, newRequest(db, repo, "POST", `{"username":"ana@example.com","password":"secret","password_confirm":"secret"}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Create() status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+// TestCreateRollback checks that the user isn't kept when the transaction that writes its email fails
+func TestCreateRollback(t *testing.T) {
+	db := newTestDB(t)
+	repo := users.NewMemoryRepository()
+	if _, err := db.GetInstance().ExecContext(context.Background(), `DROP TABLE email_outbox`); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	Create(w, newRequest(db, repo, "POST", `{"username":"ana@example.com","password":"Secret123!","password_confirm":"Secret123!"}`))
+	if w.Code == http.StatusCreated {
+		t.Fatalf("Create() status = %d, want an error", w.Code)
+	}
+	if _, dberr := repo.GetBy(context.Background(), "username", "ana@example.com", "test"); dberr == nil || dberr.Code != database.ErrorNoRows {
+		t.Errorf("GetBy() got error %v, want %v", dberr, database.ErrorNoRows)
+	}
+}
+
+// withAuth adds the claims of the user and the scope the route permission was granted with to the request
+func withAuth(r *http.Request, userID, scope string, vars map[string]string) *http.Request {
+	claims := jwt.New()
+	claims.UserID = userID
+	ctx := context.WithValue(r.Context(), reqcontext.AuthJWTKey, claims)
+	ctx = context.WithValue(ctx, reqcontext.ScopeKey, scope)
+	ctx = context.WithValue(ctx, reqcontext.PathParamsKey, vars)
+	return r.WithContext(ctx)
+}
+
+// createUser registers the user and returns its ID
+func createUser(t *testing.T, db *database.DB, repo users.UserRepository, username string) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	Create(w, newRequest(db, repo, "POST", `{"username":"`+username+`","password":"Secret123!","password_confirm":"Secret123!"}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Create() status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body.String())
+	}
+	user, dberr := repo.GetBy(context.Background(), "username", username, "test")
+	if dberr != nil {
+		t.Fatal(dberr)
+	}
+	return user.ID
+}
+
+func TestDeleteScope(t *testing.T) {
+	db := newTestDB(t)
+	repo := users.NewMemoryRepository()
+	ana, bob := createUser(t, db, repo, "ana@example.com"), createUser(t, db, repo, "bob@example.com")
+
+	tests := []struct {
+		userID string
+		scope  string
+		want   int
+	}{
+		{bob, "own", http.StatusForbidden},
+		{"this", "own", http.StatusNoContent},
+		{bob, "any", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		Delete(w, withAuth(newRequest(db, repo, "DELETE", ""), ana, tt.scope, map[string]string{"user_id": tt.userID}))
+		if w.Code != tt.want {
+			t.Errorf("Delete() of %s with scope %s status = %d, want %d", tt.userID, tt.scope, w.Code, tt.want)
+		}
+	}
+	for _, id := range []string{ana, bob} {
+		if _, dberr := repo.GetByID(context.Background(), id, "test"); dberr == nil || dberr.Code != database.ErrorNoRows {
+			t.Errorf("GetByID(%s) got error %v, want %v", id, dberr, database.ErrorNoRows)
+		}
+	}
+}
+
+func TestGetScope(t *testing.T) {
+	db := newTestDB(t)
+	repo := users.NewMemoryRepository()
+	ana := createUser(t, db, repo, "ana@example.com")
+
+	for scope, want := range map[string]int{"own": http.StatusForbidden, "any": http.StatusOK} {
+		w := httptest.NewRecorder()
+		Get(w, withAuth(newRequest(db, repo, "GET", ""), ana, scope, nil))
+		if w.Code != want {
+			t.Errorf("Get() with scope %s status = %d, want %d", scope, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"chocolate/service/api/shared/apierror"
+	"chocolate/service/api/shared/responses"
+)
+
+// BodyLimit rejects requests with a body bigger than maxBytes,
+// reqbody.Read fails with 413 if the body is bigger than declared
+func BodyLimit(maxBytes int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > maxBytes {
+				apierr := apierror.New(http.StatusRequestEntityTooLarge, fmt.Sprintf("Body is bigger than %d bytes", maxBytes), apierror.CodeBadRequestBodyTooLarge)
+				responses.Error(r, w, apierr)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"chocolate/service/shared/reqcontext"
+)
+
+// ClientIP stores the client IP in the request context, it is read by RateLimit.
+// X-Forwarded-For is only used when the request comes from one of the trustedProxies (IPs or CIDRs),
+// otherwise any client could set it to dodge the limits
+func ClientIP(trustedProxies []string) (Middleware, error) {
+	proxies, err := parseNetworks(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), reqcontext.ClientIPKey, clientIP(r, proxies))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}, nil
+}
+
+// clientIP walks the proxies chain from the closest hop, X-Forwarded-For entries are appended by each
+// proxy so the first one not added by a trusted proxy is the client
+func clientIP(r *http.Request, proxies []*net.IPNet) string {
+	ip := remoteIP(r)
+	if !trusted(ip, proxies) {
+		return ip
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !trusted(ip, proxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// remoteIP is the IP of the peer connected to the server
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+func trusted(ip string, proxies []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, proxy := range proxies {
+		if proxy.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetworks parses IPs and CIDRs, an IP is a network with only that address
+func parseNetworks(addrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted proxy %q, use an IP or a CIDR", addr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy %q, use an IP or a CIDR", addr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"chocolate/service/shared/reqcontext"
+)
+
+func TestClientIP(t *testing.T) {
+	mw, err := ClientIP([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("ClientIP() got error: %v", err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"no proxy", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"untrusted peer sets header", "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed entry before the client", "10.1.2.3:1234", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"proxies chain", "10.1.2.3:1234", []string{"198.51.100.1, 192.168.1.1", "10.9.9.9"}, "198.51.100.1"},
+		{"only proxies", "10.1.2.3:1234", []string{"10.4.4.4, 192.168.1.1"}, "10.4.4.4"},
+		{"trusted proxy without header", "192.168.1.1:1234", nil, "192.168.1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = reqcontext.GetClientIP(r)
+			}))
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, header := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			if got != tt.want {
+				t.Errorf("client IP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIPInvalidProxy(t *testing.T) {
+	for _, proxy := range []string{"10.0.0", "10.0.0.0/33", "proxy.internal"} {
+		if _, err := ClientIP([]string{proxy}); err == nil {
+			t.Errorf("ClientIP(%q) got no error", proxy)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+// Package middleware has the handler wrappers that can be attached to the API routes
+// or registered router-wide with api.Use
+package middleware
+
+import (
+	"net/http"
+)
+
+// Middleware wraps a handler with extra behaviour, it must call next to continue the flow
+type Middleware func(next http.Handler) http.Handler
+
+// Chain wraps the handler with the middleware so they are executed in the order they are given
+func Chain(handler http.Handler, middleware ...Middleware) http.Handler {
+	// middleware = {0, 1, 2} is added as 2, 1, 0 and executed as 0, 1, 2
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
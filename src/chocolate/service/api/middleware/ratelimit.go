@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"chocolate/service/api/shared/apierror"
+	"chocolate/service/api/shared/responses"
+	"chocolate/service/shared/logger"
+	"chocolate/service/shared/reqcontext"
+)
+
+// RateLimit allows up to limit requests per client IP in each window, the client IP is the one
+// resolved by the ClientIP middleware. The routes the returned Middleware is attached to share the same counters
+func RateLimit(limit int, window time.Duration) Middleware {
+	l := &limiter{
+		limit:  limit,
+		window: window,
+		hits:   make(map[string]*windowCount),
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientIP := reqcontext.GetClientIP(r)
+			if clientIP == "" {
+				clientIP = remoteIP(r)
+			}
+			if ok, retryAfter := l.allow(clientIP, time.Now()); !ok {
+				reqID := reqcontext.GetReqID(r)
+				logger.Warnf("%s:RateLimit: Too many requests from %s", reqID, clientIP)
+				w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(retryAfter.Seconds()))))
+				apierr := apierror.New(http.StatusTooManyRequests, "Too many requests, try again later", apierror.CodeTooManyRequests)
+				responses.Error(r, w, apierr)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type windowCount struct {
+	start time.Time
+	count int
+}
+
+// limiter is a fixed window counter per key
+type limiter struct {
+	mu        sync.Mutex
+	limit     int
+	window    time.Duration
+	hits      map[string]*windowCount
+	lastSweep time.Time
+}
+
+// allow counts the hit for the key, when the limit was reached it returns
+// false and how long until the window is over
+func (l *limiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Drop the counters of the windows already over so the map doesn't grow forever
+	if now.Sub(l.lastSweep) > l.window {
+		for k, c := range l.hits {
+			if now.Sub(c.start) >= l.window {
+				delete(l.hits, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	c, ok := l.hits[key]
+	if !ok || now.Sub(c.start) >= l.window {
+		c = &windowCount{start: now}
+		l.hits[key] = c
+	}
+	if c.count >= l.limit {
+		return false, c.start.Add(l.window).Sub(now)
+	}
+	c.count++
+	return true, 0
+}
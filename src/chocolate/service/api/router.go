@@ -10,7 +10,9 @@ import (
 	"github.com/gorilla/mux"
 
 	"chocolate/service/api/metrics"
+	"chocolate/service/api/middleware"
 	"chocolate/service/database"
+	"chocolate/service/models/users"
 	"chocolate/service/shared/auth"
 	"chocolate/service/shared/config"
 	"chocolate/service/shared/logger"
@@ -18,39 +20,45 @@ import (
 	"chocolate/service/shared/utils/uuid"
 )
 
-// NewRouter creates a new Router, gets the routes and registers them in router
-func NewRouter(conf *config.Configuration, apidb *database.DB) *mux.Router {
+// globalMiddleware is executed for every route, before the authorization validation
+var globalMiddleware []middleware.Middleware
+
+// Use registers middleware executed for every route, it must be called before NewRouter
+func Use(mw ...middleware.Middleware) {
+	globalMiddleware = append(globalMiddleware, mw...)
+}
+
+// NewRouter creates a new Router, gets the routes and registers them in router,
+// handlers get apidb and userRepo thru the request context
+func NewRouter(conf *config.Configuration, apidb *database.DB, userRepo users.UserRepository) *mux.Router {
 
 	audience := conf.JWT.Audience
 
 	router := mux.NewRouter().StrictSlash(true)
 
-	for _, route := range routes {
-		handler := route.HandlerFunc
+	installed := routes
+	if conf.Environment == "dev" || conf.Test {
+		installed = append(append(Routes{}, routes...), devRoutes...)
+	}
+	for _, route := range installed {
+		var handler http.Handler = route.HandlerFunc
 
 		// Middleware is executed in the reverse on how it is added
+		// added as metrics, route middleware, auth, global middleware, ctx
+		// executed as ctx, global middleware, auth, route middleware, metrics
 
 		handler = metrics.Log(handler, route.Name)
 
-		// TODO: implement routes Middleware
-		/* if len(route.Middleware) > 0 {
-			// add them in reverse because middleware is executed in the reverse on how it is added
-			// middleware = {0, 1, 2}
-			// added as 2, 1, 0, auth, ctx
-			// executed as ctx, auth, 0, 1, 2
-
-			for i := len(route.Middleware) - 1; i >= 0; i-- {
-				handler = route.Middleware[i]
-			}
-
-		} */
+		handler = middleware.Chain(handler, route.Middleware...)
 
 		if route.Auth != nil {
 			// Assign Authorization Validation
-			handler = auth.Validate(handler, audience, route.Auth.Roles, route.Auth.CheckEmail)
+			handler = auth.Validate(handler, audience, route.Auth.Permission, route.Auth.Services)
 		}
 
-		handler = addContext(handler, conf, apidb)
+		handler = middleware.Chain(handler, globalMiddleware...)
+
+		handler = addContext(handler, conf, apidb, userRepo)
 
 		logger.Debugf("Installing route '%s' for pattern '%s' with method '%s'", route.Name, route.Pattern, route.Method)
 
@@ -63,7 +71,7 @@ func NewRouter(conf *config.Configuration, apidb *database.DB) *mux.Router {
 	return router
 }
 
-func addContext(next http.Handler, conf *config.Configuration, apidb *database.DB) http.HandlerFunc {
+func addContext(next http.Handler, conf *config.Configuration, apidb *database.DB, userRepo users.UserRepository) http.HandlerFunc {
 	// Get necessary env vars we might need to pass to the req
 	env := conf.Environment
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
@@ -74,10 +82,12 @@ func addContext(next http.Handler, conf *config.Configuration, apidb *database.D
 		}
 		logger.Debugf("%s:Path Params: %v", reqID, pathParams)
 		startTime := time.Now()
-		ctx := context.WithValue(context.Background(), reqcontext.StartTimeKey, startTime)
+		// The request context is canceled when the client goes away, cancelling the DB calls too
+		ctx := context.WithValue(r.Context(), reqcontext.StartTimeKey, startTime)
 		ctx = context.WithValue(ctx, reqcontext.PathParamsKey, pathParams)
 		ctx = context.WithValue(ctx, reqcontext.BaseURLKey, apiRoutesBaseURL(conf.Server))
 		ctx = context.WithValue(ctx, reqcontext.DbKey, apidb)
+		ctx = context.WithValue(ctx, reqcontext.UserRepositoryKey, userRepo)
 		ctx = context.WithValue(ctx, reqcontext.ReqIDKey, reqID)
 		ctx = context.WithValue(ctx, reqcontext.EnvKey, env)
 		next.ServeHTTP(rw, r.WithContext(ctx))
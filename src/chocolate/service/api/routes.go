@@ -4,11 +4,20 @@ import (
 	"bytes"
 	"html/template"
 	"net/http"
+	"time"
 
+	"chocolate/service/api/handlers/admin"
 	"chocolate/service/api/handlers/auth"
+	"chocolate/service/api/handlers/dev"
+	"chocolate/service/api/handlers/mfa"
+	"chocolate/service/api/handlers/resets"
+	"chocolate/service/api/handlers/roles"
 	"chocolate/service/api/handlers/users"
+	"chocolate/service/api/middleware"
 	"chocolate/service/api/shared/apierror"
 	"chocolate/service/api/shared/responses"
+	authmw "chocolate/service/shared/auth"
+	"chocolate/service/shared/auth/permissions"
 )
 
 // Route describes an API Route
@@ -18,16 +27,19 @@ type Route struct {
 	Pattern     string
 	Auth        *RouteAuth
 	HandlerFunc http.HandlerFunc
+	// Middleware is executed in order after the authorization validation
+	Middleware []middleware.Middleware
 }
 
 // NewRoute creates a new route based on paramerters
-func NewRoute(name, method, pattern string, auth *RouteAuth, handler http.HandlerFunc) Route {
+func NewRoute(name, method, pattern string, auth *RouteAuth, handler http.HandlerFunc, mw ...middleware.Middleware) Route {
 	return Route{
 		Name:        name,
 		Method:      method,
 		Pattern:     pattern,
 		Auth:        auth,
 		HandlerFunc: handler,
+		Middleware:  mw,
 	}
 }
 
@@ -36,24 +48,29 @@ type Routes []Route
 
 // RouteAuth defines the authorization parameters of the route
 type RouteAuth struct {
-	// Roles this Route is authorized to serve, right now only a map[string]struct{}
-	// In the future it should be a map[string]CRUD to see which crud operations this role is allowed
-	Roles map[string]struct{}
+	// Permission ("resource:action") the user role must have been granted to reach this Route,
+	// roles and their permissions are defined in DB
+	Permission string
+	// Services allows internal services authenticated with a client certificate (mTLS)
+	// to reach this Route, their role must have been granted Permission too
+	Services bool
 	// Audience defines who in the API is supposed to get this type of request.
 	// Not the User type, but the API type, (in case we have different api endpoints)
 	//Audience string
-	CheckEmail bool
 }
 
 // NewRouteAuth creates a new RouteAuth
-func NewRouteAuth(roles []string, checkEmail bool) *RouteAuth {
-	authRoles := make(map[string]struct{})
-	for _, role := range roles {
-		authRoles[role] = struct{}{}
+func NewRouteAuth(permission string) *RouteAuth {
+	return &RouteAuth{
+		Permission: permission,
 	}
+}
+
+// NewServiceRouteAuth creates a new RouteAuth that also accepts service principals
+func NewServiceRouteAuth(permission string) *RouteAuth {
 	return &RouteAuth{
-		Roles:      authRoles,
-		CheckEmail: checkEmail,
+		Permission: permission,
+		Services:   true,
 	}
 }
 
@@ -80,6 +97,17 @@ func TestSomething(w http.ResponseWriter, r *http.Request) {
 	responses.HTML(r, w, buf)
 }
 
+// loginRateLimit slows down guessing credentials, MFA codes and reset tokens,
+// every route gets its own counters so one flow can't use up the limit of another
+func loginRateLimit() middleware.Middleware {
+	return middleware.RateLimit(10, time.Minute)
+}
+
+// emailRateLimit slows down the requests that send emails, every route gets its own counters
+func emailRateLimit() middleware.Middleware {
+	return middleware.RateLimit(5, time.Minute)
+}
+
 var routes = Routes{
 	// For Testing
 	// NewRoute("Test", "POST", "/test", nil, TestSomething),
@@ -88,40 +116,201 @@ var routes = Routes{
 	NewRoute(
 		"Get Access Token",
 		"POST", "/v1/tokens",
-		nil, auth.GenerateTokens),
+		nil, auth.GenerateTokens,
+		loginRateLimit()),
+	NewRoute(
+		"Answer MFA Challenge",
+		"POST", "/v1/tokens/mfa",
+		nil, auth.GenerateMFATokens,
+		loginRateLimit()),
 	NewRoute(
 		"Get Refresh Token",
 		"POST", "/v1/tokens/refresh",
-		NewRouteAuth([]string{"user", "business", "admin"}, false),
+		NewRouteAuth(permissions.TokensRefresh),
 		auth.RefreshTokens),
+	NewRoute(
+		"Revoke Access Token",
+		"DELETE", "/v1/tokens",
+		NewRouteAuth(permissions.TokensDelete),
+		auth.DeleteTokens),
+	NewRoute(
+		"Revoke User Tokens",
+		"DELETE", "/v1/users/{user_id}/tokens",
+		NewServiceRouteAuth(permissions.TokensDelete),
+		auth.DeleteUserTokens),
+	NewRoute(
+		"Get User Sessions",
+		"GET", "/v1/users/{user_id}/sessions",
+		NewRouteAuth(permissions.SessionsRead),
+		auth.GetSessions),
+	NewRoute(
+		"Revoke User Session",
+		"DELETE", "/v1/users/{user_id}/sessions/{session_id}",
+		NewRouteAuth(permissions.SessionsDelete),
+		auth.DeleteSession),
+	// Password Resets
+	NewRoute(
+		"Request Password Reset",
+		"POST", "/v1/password-resets",
+		nil, resets.Create,
+		emailRateLimit()),
+	// The reset email link shows the page, its form POSTs the new password to the same path
+	NewRoute(
+		"Reset Password Page",
+		"GET", "/v1/password-resets/{token}",
+		nil, resets.ResetPage),
+	NewRoute(
+		"Reset Password",
+		"POST", "/v1/password-resets/{token}",
+		nil, resets.Reset,
+		loginRateLimit()),
 	// Users
 	NewRoute(
 		"Create User",
 		"POST", "/v1/users",
-		nil, users.Create),
+		nil, users.Create,
+		emailRateLimit()),
 	NewRoute(
 		"Get Users",
 		"GET", "/v1/users",
-		NewRouteAuth([]string{"admin"}, false),
+		NewServiceRouteAuth(permissions.UsersList),
 		users.Get),
 	NewRoute(
 		"Get User By ID",
 		"GET", "/v1/users/{user_id}",
-		NewRouteAuth([]string{"user", "admin"}, true),
-		users.GetByID),
+		NewServiceRouteAuth(permissions.UsersRead),
+		users.GetByID,
+		authmw.RequireConfirmedEmail),
 	NewRoute(
 		"Update User By ID",
 		"PUT", "/v1/users/{user_id}",
-		NewRouteAuth([]string{"user", "admin"}, true),
-		users.Update),
+		NewRouteAuth(permissions.UsersUpdate),
+		users.Update,
+		authmw.RequireConfirmedEmail),
 	NewRoute(
 		"Delete User By ID",
 		"DELETE", "/v1/users/{user_id}",
-		NewRouteAuth([]string{"admin"}, false),
+		NewServiceRouteAuth(permissions.UsersDelete),
 		users.Delete),
-	// TODO: should confirm should just be a PUT /users/user_id?? maybe with a specific query_param??
+	// Roles
 	NewRoute(
-		"Confirm User",
+		"Get User Roles",
+		"GET", "/v1/users/{user_id}/roles",
+		NewServiceRouteAuth(permissions.RolesRead),
+		roles.GetUserRoles),
+	NewRoute(
+		"Grant User Role",
+		"PUT", "/v1/users/{user_id}/roles/{role}",
+		NewRouteAuth(permissions.RolesGrant),
+		roles.GrantRole),
+	NewRoute(
+		"Revoke User Role",
+		"DELETE", "/v1/users/{user_id}/roles/{role}",
+		NewRouteAuth(permissions.RolesGrant),
+		roles.RevokeRole),
+	NewRoute(
+		"Get Roles",
+		"GET", "/v1/roles",
+		NewRouteAuth(permissions.RolesManage),
+		roles.GetRoles),
+	NewRoute(
+		"Save Role",
+		"PUT", "/v1/roles/{role}",
+		NewRouteAuth(permissions.RolesManage),
+		roles.SaveRole),
+	NewRoute(
+		"Delete Role",
+		"DELETE", "/v1/roles/{role}",
+		NewRouteAuth(permissions.RolesManage),
+		roles.DeleteRole),
+	// MFA
+	NewRoute(
+		"Enroll User TOTP",
+		"POST", "/v1/users/{user_id}/mfa/totp",
+		NewRouteAuth(permissions.MFAUpdate),
+		mfa.EnrollTOTP,
+		authmw.RequireConfirmedEmail),
+	NewRoute(
+		"Verify User TOTP",
+		"POST", "/v1/users/{user_id}/mfa/totp/verify",
+		NewRouteAuth(permissions.MFAUpdate),
+		mfa.VerifyTOTP,
+		authmw.RequireConfirmedEmail),
+	NewRoute(
+		"Delete User TOTP",
+		"DELETE", "/v1/users/{user_id}/mfa/totp",
+		NewRouteAuth(permissions.MFADelete),
+		mfa.DeleteTOTP,
+		authmw.RequireConfirmedEmail),
+	// Admin
+	NewRoute(
+		"Get DB Pool Stats",
+		"GET", "/v1/admin/db/stats",
+		NewRouteAuth(permissions.DBRead),
+		admin.GetDBStats),
+	NewRoute(
+		"Get Failed Emails",
+		"GET", "/v1/admin/emails/failed",
+		NewRouteAuth(permissions.EmailsRead),
+		admin.GetFailedEmails),
+	// The email link shows the page, its form POSTs the token so link prefetchers don't confirm the user
+	NewRoute(
+		"Confirm User Page",
 		"GET", "/v1/users/{user_id}/confirm",
-		nil, users.Confirm),
+		nil, users.ConfirmPage),
+	NewRoute(
+		"Confirm User",
+		"POST", "/v1/users/{user_id}/confirm",
+		nil, users.Confirm,
+		loginRateLimit()),
+	NewRoute(
+		"Change User Password",
+		"PUT", "/v1/users/{user_id}/password",
+		NewRouteAuth(permissions.UsersUpdate),
+		users.ChangePassword,
+		loginRateLimit()),
+	// The email links show the pages, their forms POST the tokens
+	NewRoute(
+		"Change User Email",
+		"POST", "/v1/users/{user_id}/email",
+		NewRouteAuth(permissions.UsersUpdate),
+		users.ChangeEmail,
+		emailRateLimit()),
+	NewRoute(
+		"Confirm User Email Change Page",
+		"GET", "/v1/users/{user_id}/email/confirm",
+		nil, users.ConfirmEmailChangePage),
+	NewRoute(
+		"Confirm User Email Change",
+		"POST", "/v1/users/{user_id}/email/confirm",
+		nil, users.ConfirmEmailChange,
+		loginRateLimit()),
+	NewRoute(
+		"Undo User Email Change Page",
+		"GET", "/v1/users/{user_id}/email/undo",
+		nil, users.UndoEmailChangePage),
+	NewRoute(
+		"Undo User Email Change",
+		"POST", "/v1/users/{user_id}/email/undo",
+		nil, users.UndoEmailChange,
+		loginRateLimit()),
+	// Not confirmed users reach it from the link in the RequireConfirmedEmail error
+	NewRoute(
+		"Resend User Confirmation",
+		"POST", "/v1/users/{user_id}/confirmation",
+		NewRouteAuth(permissions.UsersUpdate),
+		users.ResendConfirmation,
+		emailRateLimit()),
+}
+
+// devRoutes are only installed in the dev environment or test mode
+var devRoutes = Routes{
+	NewRoute(
+		"List Dev Mailbox",
+		"GET", "/v1/_dev/mailbox",
+		nil, dev.ListMailbox),
+	NewRoute(
+		"Get Dev Mailbox Mail",
+		"GET", "/v1/_dev/mailbox/{mail_id}",
+		nil, dev.GetMail),
 }
@@ -2,13 +2,23 @@ package apierror
 
 import (
 	"fmt"
+	"net/http"
+
+	"chocolate/service/database"
 )
 
-// Error object for zale-api errors
+// Error object for zale-api errors, Links are the endpoints the client can call to solve it
 type Error struct {
-	HTTPStatus int    `json:"status,omitempty"`
-	Message    string `json:"message"`
-	APICode    Code   `json:"api_code"`
+	HTTPStatus int             `json:"status,omitempty"`
+	Message    string          `json:"message"`
+	APICode    Code            `json:"api_code"`
+	Links      map[string]Link `json:"links,omitempty"`
+}
+
+// Link is an endpoint related to the error
+type Link struct {
+	Href   string `json:"href"`
+	Method string `json:"method"`
 }
 
 func (e Error) Error() string {
@@ -24,6 +34,15 @@ func New(httpStatusCode int, message string, code Code) *Error {
 	}
 }
 
+// WithLink adds the endpoint as the rel link of the error
+func (e *Error) WithLink(rel, method, href string) *Error {
+	if e.Links == nil {
+		e.Links = make(map[string]Link)
+	}
+	e.Links[rel] = Link{Href: href, Method: method}
+	return e
+}
+
 // FromError creates a new Error from an error
 func FromError(err error) *Error {
 	return &Error{
@@ -32,3 +51,15 @@ func FromError(err error) *Error {
 		APICode:    CodeUnknown,
 	}
 }
+
+// FromDB creates a new Error from a DB error the handler has no specific response for,
+// timeouts are 504 and canceled requests 503 so clients can tell them apart and retry
+func FromDB(dberr *database.Error) *Error {
+	switch dberr.Code {
+	case database.ErrorTimeout:
+		return New(http.StatusGatewayTimeout, "The DB took too long to answer", CodeInternalDBTimeout)
+	case database.ErrorCanceled:
+		return New(http.StatusServiceUnavailable, "The request was canceled", CodeInternalDBTimeout)
+	}
+	return New(http.StatusInternalServerError, fmt.Sprintf("Something went wrong: %s", dberr.Error()), CodeInternalDB)
+}
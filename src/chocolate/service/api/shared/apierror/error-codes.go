@@ -16,6 +16,8 @@ const (
 	CodeInternalEmail = Code("0004")
 	// CodeInternalDB = Internal Error related DB
 	CodeInternalDB = Code("0010")
+	// CodeInternalDBTimeout = The DB didn't answer before the query timeout or the request was canceled
+	CodeInternalDBTimeout = Code("0011")
 	// CodeUnauth = Unauthorized
 	CodeUnauth = Code("0100")
 	// CodeUnauthMalformed = Unauthorized because JWT was malformed
@@ -24,6 +26,8 @@ const (
 	CodeUnauthExpired = Code("0103")
 	// CodeUnauthNotActive = Unauthorized because JWT is not active yet
 	CodeUnauthNotActive = Code("104")
+	// CodeUnauthRevoked = Unauthorized because JWT was revoked or already used
+	CodeUnauthRevoked = Code("0105")
 	// CodeForbidden = Forbidden
 	CodeForbidden = Code("0110")
 	// CodeForbiddenNotConfirmed = User is OK but email is not confirmed
@@ -35,6 +39,12 @@ const (
 	CodeBadRequestBody = Code("0204")
 	// CodeBadRequestParams = Ban Request Query params
 	CodeBadRequestParams = Code("0205")
+	// CodeBadRequestBodyTooLarge = Bad Request because body is bigger than allowed
+	CodeBadRequestBodyTooLarge = Code("0206")
 	// CodeResourceNotFound = Resource doesnt exists
 	CodeResourceNotFound = Code("0301")
+	// CodeResourceConflict = Resource is in a state that doesn't allow the operation
+	CodeResourceConflict = Code("0302")
+	// CodeTooManyRequests = Client reached the rate limit of the route
+	CodeTooManyRequests = Code("0400")
 )
@@ -1,6 +1,7 @@
 package reqbody
 
 import (
+	"errors"
 	"io/ioutil"
 	"net/http"
 
@@ -12,6 +13,12 @@ import (
 func Read(r *http.Request, out models.APIObject) (apierr *apierror.Error) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
+		// middleware.BodyLimit was attached to the route
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			apierr = apierror.New(http.StatusRequestEntityTooLarge, err.Error(), apierror.CodeBadRequestBodyTooLarge)
+			return
+		}
 		apierr = apierror.New(http.StatusInternalServerError, err.Error(), apierror.CodeInternalReadBody)
 		return
 	}
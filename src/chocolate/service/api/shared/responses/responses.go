@@ -98,6 +98,15 @@ func NotImplemented(r *http.Request, rw http.ResponseWriter, location string) {
 
 // HTML returns an html page response
 func HTML(r *http.Request, w http.ResponseWriter, reader io.Reader) {
+	respondHTML(w, http.StatusOK, reader)
+}
+
+// HTMLError returns an html page response with the error status
+func HTMLError(r *http.Request, w http.ResponseWriter, status int, reader io.Reader) {
+	respondHTML(w, status, reader)
+}
+
+func respondHTML(w http.ResponseWriter, code int, reader io.Reader) {
 	now := time.Now().UTC()
 	// IMPORTANT NOTE: The client MUST NOT change its own time to the time returned by server
 	//                 as it opens the possibility of some time attacks.
@@ -110,7 +119,7 @@ func HTML(r *http.Request, w http.ResponseWriter, reader io.Reader) {
 	w.Header().Set("Pragma", "no-cache")
 
 	w.Header().Set("Content-Type", mimeHTML)
-	w.WriteHeader(200)
+	w.WriteHeader(code)
 	io.Copy(w, reader)
 }
 
@@ -1,10 +1,14 @@
-// Package database wraps `lib/pq` providing the basic methods for creating an entrypoint for our database.
+// Package database wraps `lib/pq` (or `mattn/go-sqlite3` for single node deployments) providing
+// the basic methods for creating an entrypoint for our database.
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"regexp"
 	"strings"
+	"time"
 
 	// Using the blank identifier in order to solely
 	// provide the side-effects of the package.
@@ -18,13 +22,58 @@ import (
 	"chocolate/service/shared/logger"
 
 	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
 )
 
 const (
 	connectionErrorClass = "08"
 	internalErrorClass   = "XX"
+	// queryCanceledCode is raised when the statement_timeout is reached or the query is canceled
+	queryCanceledCode = "57014"
+	// serializationFailureCode and deadlockDetectedCode fail transactions that can succeed if retried
+	serializationFailureCode = "40001"
+	deadlockDetectedCode     = "40P01"
 )
 
+// defaultQueryTimeout is used when SQLConfig.QueryTimeout isn't set
+const defaultQueryTimeout = 5 * time.Second
+
+// Dialect is the SQL flavour spoken by the configured driver
+type Dialect string
+
+const (
+	// DialectPostgres is the default dialect
+	DialectPostgres Dialect = "postgres"
+	// DialectSQLite runs the service from a single file DB
+	DialectSQLite Dialect = "sqlite3"
+)
+
+// placeholderRegexp matches the postgres positional placeholders ($1, $2...)
+var placeholderRegexp = regexp.MustCompile(`\$(\d+)`)
+
+// Rebind rewrites the postgres placeholders the queries are written with to the dialect ones,
+// SQLite takes $1 as a named parameter numbered by appearance so it must be ?1
+func (d Dialect) Rebind(query string) string {
+	if d != DialectSQLite {
+		return query
+	}
+	return placeholderRegexp.ReplaceAllString(query, "?$1")
+}
+
+// bindArgs converts the query arguments to what the dialect compares correctly,
+// SQLite stores timestamps as text so they must all be in UTC like current_timestamp
+func (d Dialect) bindArgs(args []interface{}) []interface{} {
+	if d != DialectSQLite {
+		return args
+	}
+	for i, arg := range args {
+		if t, ok := arg.(time.Time); ok {
+			args[i] = t.UTC()
+		}
+	}
+	return args
+}
+
 // DB holds the connection pool to the database - created by a configuration object (`SQLConfig`).
 type DB struct {
 	// dbsql holds a sql.DB pointer that represents a pool of zero or more
@@ -34,61 +83,154 @@ type DB struct {
 	dbsql *sql.DB
 	// The DB configuration
 	cfg config.SQLConfig
+	// dialect of the driver used
+	dialect Dialect
+}
+
+// querier is implemented by sql.DB and sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Instance runs the Models queries in the sql.DB or sql.Tx, they are written for postgres
+// and rebound to the DB dialect
+type Instance struct {
+	dbsql   querier
+	dialect Dialect
+}
+
+// ExecContext executes a query without returning any rows
+func (i *Instance) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return i.dbsql.ExecContext(ctx, i.dialect.Rebind(query), i.dialect.bindArgs(args)...)
 }
 
-// Table is the interface needed by the API Models to be able to create themselves,
-// This means creating the Tables and Indexes needed for the specific Model
-type Table interface {
-	Create(db *DB) (dberr *Error)
-	Name() string
+// QueryContext executes a query that returns rows
+func (i *Instance) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return i.dbsql.QueryContext(ctx, i.dialect.Rebind(query), i.dialect.bindArgs(args)...)
 }
 
-// GetInstance returns the actual sql.DB
-func (db DB) GetInstance() *sql.DB {
-	return db.dbsql
+// QueryRowContext executes a query that is expected to return at most one row
+func (i *Instance) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return i.dbsql.QueryRowContext(ctx, i.dialect.Rebind(query), i.dialect.bindArgs(args)...)
 }
 
-// New returns a SQL DB with the sql.DB set with the postgres
-// DB connection string in the configuration
+// GetInstance returns the Instance to run queries in the actual sql.DB
+func (db DB) GetInstance() *Instance {
+	return &Instance{db.dbsql, db.dialect}
+}
+
+// WithTimeout returns a copy of ctx that is canceled after the configured query timeout,
+// the Models call it so a slow DB never holds the request longer than that.
+// cancel must be called once the rows were scanned
+func (db DB) WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := defaultQueryTimeout
+	if db.cfg.QueryTimeout > 0 {
+		timeout = time.Duration(db.cfg.QueryTimeout) * time.Second
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Dialect returns the SQL dialect of the DB driver
+func (db DB) Dialect() Dialect {
+	return db.dialect
+}
+
+// New returns a SQL DB with the sql.DB set with the connection string
+// of the configured driver, postgres if none
 func New(cfg config.SQLConfig) (db *DB, err error) {
-	logger.Infof("Starting DB at host: %s port: %s...", cfg.Host, cfg.Port)
-	if cfg.Host == "" || cfg.Port == "" || cfg.User == "" ||
-		cfg.Password == "" || cfg.Database == "" {
-		err = errors.New("All db configuration fields must be set")
+	var (
+		dialect    Dialect
+		connString string
+	)
+	switch Dialect(cfg.Driver) {
+	case "", DialectPostgres:
+		dialect = DialectPostgres
+		connString, err = postgresConnString(cfg)
+	case DialectSQLite:
+		dialect = DialectSQLite
+		connString, err = sqliteConnString(cfg)
+	default:
+		err = fmt.Errorf("Unknown db driver %q, must be postgres or sqlite3", cfg.Driver)
+	}
+	if err != nil {
 		return
 	}
-
-	// The first argument corresponds to the driver name that the driver
-	// (in this case, `lib/pq`) used to register itself in `database/sql`.
-	// The next argument specifies the parameters to be used in the connection.
-	// Details about this string can be seen at https://godoc.org/github.com/lib/pq
-	connString := fmt.Sprintf(
-		"user=%s password=%s dbname=%s host=%s port=%s sslmode=disable",
-		cfg.User, cfg.Password, cfg.Database, cfg.Host, cfg.Port)
 	logger.Debugf("DB Connection string: %s", connString)
 
-	dbsql, err := sql.Open("postgres", connString)
+	// The first argument corresponds to the driver name that the driver
+	// (`lib/pq` or `mattn/go-sqlite3`) used to register itself in `database/sql`.
+	dbsql, err := sql.Open(string(dialect), connString)
 	if err != nil {
-		err = fmt.Errorf("Couldn't open connection to postgre database: %s", err.Error())
+		err = fmt.Errorf("Couldn't open connection to %s database: %s", dialect, err.Error())
 		return
 	}
-	logger.Infof("Pinging DB...")
+	configurePool(dbsql, cfg)
+
 	// Ping verifies if the connection to the database is alive or if a
 	// new connection can be made.
-	if err = dbsql.Ping(); err != nil {
-		err = fmt.Errorf("Couldn't ping postgres database: %s", err.Error())
+	if err = pingWithRetry(dbsql, cfg); err != nil {
+		dbsql.Close()
+		err = fmt.Errorf("Couldn't ping %s database: %s", dialect, err.Error())
 		return
 	}
 
-	db = &DB{dbsql, cfg}
+	db = &DB{dbsql, cfg, dialect}
+	return
+}
+
+// postgresConnString returns the `lib/pq` connection string
+func postgresConnString(cfg config.SQLConfig) (connString string, err error) {
+	logger.Infof("Starting DB at host: %s port: %s...", cfg.Host, cfg.Port)
+	if cfg.Host == "" || cfg.Port == "" || cfg.User == "" ||
+		cfg.Password == "" || cfg.Database == "" {
+		err = errors.New("All db configuration fields must be set")
+		return
+	}
 
-	/* if err = createTables(db); err != nil {
-		logger.Errorf("Couldnt create tables: %s", err.Error())
+	sslMode := cfg.SSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	switch sslMode {
+	case "disable", "require", "verify-ca", "verify-full":
+	default:
+		err = fmt.Errorf("Unknown db sslmode %q, must be disable, require, verify-ca or verify-full", sslMode)
 		return
-	} */
+	}
+	if (sslMode == "verify-ca" || sslMode == "verify-full") && cfg.SSLRootCert == "" {
+		err = fmt.Errorf("The db sslrootcert must be set to verify the server with sslmode %s", sslMode)
+		return
+	}
+	if (cfg.SSLCert == "") != (cfg.SSLKey == "") {
+		err = errors.New("Both db sslcert and sslkey must be set to use a client certificate")
+		return
+	}
+
+	// Details about this string can be seen at https://godoc.org/github.com/lib/pq
+	params := [][2]string{
+		{"user", cfg.User}, {"password", cfg.Password}, {"dbname", cfg.Database},
+		{"host", cfg.Host}, {"port", cfg.Port}, {"sslmode", sslMode},
+		{"sslrootcert", cfg.SSLRootCert}, {"sslcert", cfg.SSLCert}, {"sslkey", cfg.SSLKey},
+	}
+	var pairs []string
+	for _, param := range params {
+		if param[1] != "" {
+			pairs = append(pairs, param[0]+"="+quoteConnParam(param[1]))
+		}
+	}
+	connString = strings.Join(pairs, " ")
 	return
 }
 
+// quoteConnParam quotes the value of a connection string parameter so it can have spaces and quotes
+func quoteConnParam(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
+}
+
 // Close performs the release of any resources that
 // `sql/database` DB pool created. This is usually meant
 // to be used in the exitting of a program or `panic`ing.
@@ -104,56 +246,31 @@ func (db *DB) Close() (err error) {
 	return
 }
 
-func installExtensions(db *DB) *Error {
-	qry := `CREATE EXTENSION IF NOT EXISTS "uuid-ossp"`
-	if _, err := db.dbsql.Exec(qry); err != nil {
-		logger.Errorf("database:installExtensions() Failed to install extension err: %s", err.Error())
-		return db.FormError(err, qry, "extensions")
-	}
-	return nil
-}
-
 // Init will hold any type of initialization logic needed by the DB,
-// Right now it only creates the needed Model's tables
-func (db *DB) Init(tables []Table) *Error {
-	// check that extensions are properly installed
-
-	extQry := `SELECT uuid_generate_v4()`
-
-	if _, err := db.dbsql.Exec(extQry); err != nil {
-		logger.Errorf("database:Init() checking of extensions failed %s", err.Error())
-		dberr := db.FormError(err, extQry, "")
-		if dberr.Code == ErrorMissingExtensions {
-			logger.Infof("database:Init() missing uuid extensions, installing now")
-			if dberr = installExtensions(db); dberr != nil {
-				return dberr
-			}
-		} else {
-			return dberr
-		}
-	}
-
-	for _, table := range tables {
-
-		logger.Infof("Creating table %q", table.Name())
-		if dberr := table.Create(db); dberr != nil {
-			// NOTE: what happens if one table is created but another isn't?
-			// I guess is OK, we need the tables and they all should have the "IF NOT EXISTS" clause
-			logger.Errorf("Error creating table %q. err = %v", table.Name(), dberr.Error())
-			return dberr
-		}
-	}
-
-	return nil
+// Right now it only applies the pending schema migrations needed by the Models
+func (db *DB) Init(migrations []Migration) *Error {
+	return db.Migrate(migrations)
 }
 
-// FormError returns the pq(postgres) error wrapped in a Error
+// FormError returns the pq(postgres) or sqlite3 error wrapped in a Error
 func (db *DB) FormError(err error, query, table string) (dberr *Error) {
 	logger.Debugf("DB.FormError() err = %v, table = %q, query = %q", err, table, query)
 	if err == sql.ErrNoRows {
 		dberr = NewError(ErrorNoRows, "No rows found", query, table, err)
 		return
 	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		dberr = NewError(ErrorTimeout, "Query timed out", query, table, err)
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		dberr = NewError(ErrorCanceled, "Query canceled", query, table, err)
+		return
+	}
+	if sqliteErr, ok := err.(sqlite3.Error); ok {
+		dberr = formSQLiteError(sqliteErr, query, table)
+		return
+	}
 	if pqerr, ok := err.(*pq.Error); ok {
 		code := string(pqerr.Code)
 		logger.Debugf("pq error %s:", code)
@@ -162,12 +279,19 @@ func (db *DB) FormError(err error, query, table string) (dberr *Error) {
 			dberr = NewError(ErrorInternal, "Connection Error", query, table, pqerr)
 		} else if strings.HasPrefix(code, internalErrorClass) {
 			dberr = NewError(ErrorInternal, "Internal DB Error", query, table, pqerr)
+		} else if code == serializationFailureCode || code == deadlockDetectedCode {
+			dberr = NewError(ErrorSerialization, "Transaction failed, it can be retried", query, table, pqerr)
+		} else if code == queryCanceledCode {
+			dberr = NewError(ErrorTimeout, "Query timed out", query, table, pqerr)
 		} else if code == "42883" {
 			// 42883 = "undefined_function"
 			dberr = NewError(ErrorMissingExtensions, "Missing Postgres extension", query, table, pqerr)
 		} else if code == "23505" {
 			// unique constrain violation
 			dberr = NewError(ErrorAlreadyExists, "Already Exists, unique constrain violation", query, table, pqerr)
+		} else if code == "23503" {
+			// foreign key violation
+			dberr = NewError(ErrorForeignKey, "Referenced row doesn't exist, foreign key violation", query, table, pqerr)
 		} else if code == "02000" {
 			// "02000": "no_data"
 			dberr = NewError(ErrorNoData, "No Data", query, table, pqerr)
@@ -178,7 +302,7 @@ func (db *DB) FormError(err error, query, table string) (dberr *Error) {
 		return
 
 	}
-	logger.Errorf("This is not a PQ or SQL error: %s", err.Error())
+	logger.Errorf("This is not a PQ, SQLite or SQL error: %s", err.Error())
 	dberr = NewError(ErrorGeneric, "", query, table, err)
 
 	return
@@ -19,6 +19,14 @@ const (
 	ErrorExecute           = errorCode(7)
 	ErrorNoRows            = errorCode(8)
 	ErrorMissingExtensions = errorCode(9)
+	// ErrorForeignKey when the referenced row doesn't exist
+	ErrorForeignKey = errorCode(10)
+	// ErrorTimeout when the query didn't finish before the context deadline
+	ErrorTimeout = errorCode(11)
+	// ErrorCanceled when the context was canceled (i.e. the client went away) before the query finished
+	ErrorCanceled = errorCode(12)
+	// ErrorSerialization when the transaction conflicted with a concurrent one and can be retried
+	ErrorSerialization = errorCode(13)
 )
 
 // Error holds DB errors
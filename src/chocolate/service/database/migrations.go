@@ -0,0 +1,257 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"chocolate/service/shared/logger"
+)
+
+// migrationsLockKey is the pg_advisory_lock key held while migrating,
+// so instances starting at the same time don't apply the same migration twice
+const migrationsLockKey int64 = 7239147
+
+const qryCreateMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version bigint PRIMARY KEY NOT NULL,
+	description text NOT NULL,
+	applied_at %s DEFAULT current_timestamp
+)`
+
+// timestampTypes is the column type of timestamps per dialect, SQLite only
+// converts the columns declared exactly as timestamp
+var timestampTypes = map[Dialect]string{
+	DialectPostgres: "timestamp with time zone",
+	DialectSQLite:   "timestamp",
+}
+
+// Migration is a versioned schema change, Up applies it and Down reverts it.
+// Each one runs inside a transaction
+type Migration struct {
+	Version     int64
+	Description string
+	Up          string
+	Down        string
+}
+
+// MigrationStatus tells if a Migration was applied
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt sql.NullTime
+}
+
+// LoadMigrations reads the migrations from the files in dir named <version>_<description>.up.sql
+// and <version>_<description>.down.sql, they are returned sorted by version
+func LoadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read migrations dir %s: %s", dir, err.Error())
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSuffix(name, ".sql"), "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Migration file %s is not named <version>_<description>.(up|down).sql", name)
+		}
+		version, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Migration file %s has an invalid version: %s", name, err.Error())
+		}
+		description, direction := parts[1], path.Ext(parts[1])
+		description = strings.Replace(strings.TrimSuffix(description, direction), "_", " ", -1)
+
+		content, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read migration file %s: %s", name, err.Error())
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Description: description}
+			byVersion[version] = m
+		}
+		switch direction {
+		case ".up":
+			m.Up = string(content)
+		case ".down":
+			m.Down = string(content)
+		default:
+			return nil, fmt.Errorf("Migration file %s must end in .up.sql or .down.sql", name)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("Migration %d %q has no up file", m.Version, m.Description)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrate applies the migrations that weren't applied yet, in version order
+func (db *DB) Migrate(migrations []Migration) *Error {
+	return db.withMigrationsLock(func(conn *sql.Conn) *Error {
+		applied, dberr := db.appliedMigrations(conn)
+		if dberr != nil {
+			return dberr
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			logger.Infof("database:Migrate() Applying migration %d %q", m.Version, m.Description)
+			insertQry := `INSERT INTO schema_migrations(version, description) VALUES($1, $2)`
+			if dberr = db.runMigration(conn, m.Up, insertQry, m.Version, m.Description); dberr != nil {
+				logger.Errorf("database:Migrate() Migration %d failed: %v", m.Version, dberr)
+				return dberr
+			}
+		}
+		return nil
+	})
+}
+
+// Rollback reverts the last steps applied migrations
+func (db *DB) Rollback(migrations []Migration, steps int) *Error {
+	byVersion := make(map[int64]Migration, len(migrations))
+	for _, m := range migrations {
+		byVersion[m.Version] = m
+	}
+	return db.withMigrationsLock(func(conn *sql.Conn) *Error {
+		applied, dberr := db.appliedMigrations(conn)
+		if dberr != nil {
+			return dberr
+		}
+		versions := make([]int64, 0, len(applied))
+		for version := range applied {
+			versions = append(versions, version)
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+
+		for i := 0; i < steps && i < len(versions); i++ {
+			m, ok := byVersion[versions[i]]
+			if !ok || m.Down == "" {
+				return NewError(ErrorExecute, fmt.Sprintf("Migration %d can't be reverted, it has no down file", versions[i]), "", "schema_migrations", nil)
+			}
+			logger.Infof("database:Rollback() Reverting migration %d %q", m.Version, m.Description)
+			deleteQry := `DELETE FROM schema_migrations WHERE version = $1`
+			if dberr = db.runMigration(conn, m.Down, deleteQry, m.Version); dberr != nil {
+				logger.Errorf("database:Rollback() Migration %d failed: %v", m.Version, dberr)
+				return dberr
+			}
+		}
+		return nil
+	})
+}
+
+// MigrationsStatus returns every migration telling if it was applied
+func (db *DB) MigrationsStatus(migrations []Migration) (status []MigrationStatus, dberr *Error) {
+	dberr = db.withMigrationsLock(func(conn *sql.Conn) *Error {
+		applied, dberr := db.appliedMigrations(conn)
+		if dberr != nil {
+			return dberr
+		}
+		for _, m := range migrations {
+			appliedAt, ok := applied[m.Version]
+			status = append(status, MigrationStatus{Migration: m, Applied: ok, AppliedAt: appliedAt})
+		}
+		return nil
+	})
+	return
+}
+
+// withMigrationsLock runs fn holding the migrations lock, the advisory lock belongs
+// to the DB session so everything must run in the same connection.
+// SQLite has no advisory locks, it is meant for a single instance and each
+// migration transaction takes the DB write lock anyway
+func (db *DB) withMigrationsLock(fn func(conn *sql.Conn) *Error) *Error {
+	ctx := context.Background()
+	conn, err := db.dbsql.Conn(ctx)
+	if err != nil {
+		return db.FormError(err, "", "schema_migrations")
+	}
+	defer conn.Close()
+
+	createQry := fmt.Sprintf(qryCreateMigrationsTable, timestampTypes[db.dialect])
+	if db.dialect == DialectSQLite {
+		if _, err = conn.ExecContext(ctx, createQry); err != nil {
+			return db.FormError(err, createQry, "schema_migrations")
+		}
+		return fn(conn)
+	}
+
+	lockQry := `SELECT pg_advisory_lock($1)`
+	logger.Debug("database:withMigrationsLock() waiting for migrations lock")
+	if _, err = conn.ExecContext(ctx, lockQry, migrationsLockKey); err != nil {
+		return db.FormError(err, lockQry, "schema_migrations")
+	}
+	defer func() {
+		unlockQry := `SELECT pg_advisory_unlock($1)`
+		if _, err := conn.ExecContext(ctx, unlockQry, migrationsLockKey); err != nil {
+			logger.Errorf("database:withMigrationsLock() Couldn't release migrations lock: %s", err.Error())
+		}
+	}()
+
+	if _, err = conn.ExecContext(ctx, createQry); err != nil {
+		return db.FormError(err, createQry, "schema_migrations")
+	}
+	return fn(conn)
+}
+
+// appliedMigrations returns the applied versions and when they were applied
+func (db *DB) appliedMigrations(conn *sql.Conn) (map[int64]sql.NullTime, *Error) {
+	qry := `SELECT version, applied_at FROM schema_migrations`
+	rows, err := conn.QueryContext(context.Background(), qry)
+	if err != nil {
+		return nil, db.FormError(err, qry, "schema_migrations")
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]sql.NullTime)
+	for rows.Next() {
+		var (
+			version   int64
+			appliedAt sql.NullTime
+		)
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, db.FormError(err, qry, "schema_migrations")
+		}
+		applied[version] = appliedAt
+	}
+	if err = rows.Err(); err != nil {
+		return nil, db.FormError(err, qry, "schema_migrations")
+	}
+	return applied, nil
+}
+
+// runMigration executes the migration script and records it in schema_migrations in the same transaction
+func (db *DB) runMigration(conn *sql.Conn, script, recordQry string, recordArgs ...interface{}) *Error {
+	ctx := context.Background()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return db.FormError(err, "", "schema_migrations")
+	}
+	if _, err = tx.ExecContext(ctx, script); err != nil {
+		tx.Rollback()
+		return db.FormError(err, script, "schema_migrations")
+	}
+	if _, err = tx.ExecContext(ctx, db.dialect.Rebind(recordQry), recordArgs...); err != nil {
+		tx.Rollback()
+		return db.FormError(err, recordQry, "schema_migrations")
+	}
+	if err = tx.Commit(); err != nil {
+		return db.FormError(err, "", "schema_migrations")
+	}
+	return nil
+}
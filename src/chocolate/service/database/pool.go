@@ -0,0 +1,87 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"chocolate/service/shared/config"
+	"chocolate/service/shared/logger"
+)
+
+const (
+	// defaultPingRetries is used when SQLConfig.PingRetries isn't set
+	defaultPingRetries = 5
+	// pingBackoff is the wait before the first Ping retry, it doubles on every retry up to pingMaxBackoff
+	pingBackoff    = time.Second
+	pingMaxBackoff = 30 * time.Second
+)
+
+// PoolStats are the connection pool statistics
+type PoolStats struct {
+	// MaxOpenConnections is the configured limit, 0 is unlimited
+	MaxOpenConnections int `json:"max_open_connections"`
+	OpenConnections    int `json:"open_connections"`
+	InUse              int `json:"in_use"`
+	Idle               int `json:"idle"`
+	// WaitCount is how many times a connection was waited for, WaitDuration
+	// (milliseconds) the total time waited
+	WaitCount    int64 `json:"wait_count"`
+	WaitDuration int64 `json:"wait_duration_ms"`
+	// Connections closed by the pool limits since it started
+	MaxIdleClosed     int64 `json:"max_idle_closed"`
+	MaxIdleTimeClosed int64 `json:"max_idle_time_closed"`
+	MaxLifetimeClosed int64 `json:"max_lifetime_closed"`
+}
+
+// PoolStats returns the current connection pool statistics
+func (db *DB) PoolStats() PoolStats {
+	stats := db.dbsql.Stats()
+	return PoolStats{
+		MaxOpenConnections: stats.MaxOpenConnections,
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDuration:       stats.WaitDuration.Milliseconds(),
+		MaxIdleClosed:      stats.MaxIdleClosed,
+		MaxIdleTimeClosed:  stats.MaxIdleTimeClosed,
+		MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+	}
+}
+
+// configurePool sets the connection pool limits, the ones not configured keep the sql.DB defaults
+func configurePool(dbsql *sql.DB, cfg config.SQLConfig) {
+	if cfg.MaxOpenConns > 0 {
+		dbsql.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		dbsql.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.ConnMaxLifetime > 0 {
+		dbsql.SetConnMaxLifetime(time.Duration(cfg.ConnMaxLifetime) * time.Second)
+	}
+	if cfg.ConnMaxIdleTime > 0 {
+		dbsql.SetConnMaxIdleTime(time.Duration(cfg.ConnMaxIdleTime) * time.Second)
+	}
+}
+
+// pingWithRetry pings the DB retrying with exponential backoff, so the service
+// can start at the same time as the DB (i.e. docker compose)
+func pingWithRetry(dbsql *sql.DB, cfg config.SQLConfig) (err error) {
+	retries := cfg.PingRetries
+	if retries <= 0 {
+		retries = defaultPingRetries
+	}
+	backoff := pingBackoff
+	for attempt := 0; ; attempt++ {
+		logger.Infof("Pinging DB...")
+		if err = dbsql.Ping(); err == nil || attempt == retries {
+			return
+		}
+		logger.Errorf("database:pingWithRetry() Ping failed: %s, retrying in %s", err.Error(), backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > pingMaxBackoff {
+			backoff = pingMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"chocolate/service/shared/config"
+	"chocolate/service/shared/logger"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteBusyTimeout is how long (ms) a connection waits for the write lock
+// held by another one before failing with SQLITE_BUSY
+const sqliteBusyTimeout = 5000
+
+// sqliteConnString returns the `mattn/go-sqlite3` connection string, foreign keys are
+// enforced like in postgres and transactions take the write lock when they begin
+// so concurrent ones wait for each other instead of failing when they write
+func sqliteConnString(cfg config.SQLConfig) (connString string, err error) {
+	logger.Infof("Starting DB at file: %s...", cfg.File)
+	if cfg.File == "" {
+		err = errors.New("The db file must be set for the sqlite3 driver")
+		return
+	}
+
+	params := url.Values{}
+	params.Set("_foreign_keys", "on")
+	params.Set("_journal_mode", "WAL")
+	params.Set("_busy_timeout", fmt.Sprint(sqliteBusyTimeout))
+	params.Set("_txlock", "immediate")
+	connString = fmt.Sprintf("file:%s?%s", cfg.File, params.Encode())
+	return
+}
+
+// formSQLiteError maps the sqlite3 error to the same Error the equivalent pq error gets
+func formSQLiteError(sqliteErr sqlite3.Error, query, table string) (dberr *Error) {
+	logger.Debugf("sqlite3 error %d (%d):", sqliteErr.Code, sqliteErr.ExtendedCode)
+
+	switch sqliteErr.Code {
+	case sqlite3.ErrBusy, sqlite3.ErrLocked, sqlite3.ErrCantOpen, sqlite3.ErrIoErr:
+		dberr = NewError(ErrorInternal, "Connection Error", query, table, sqliteErr)
+		return
+	case sqlite3.ErrInternal, sqlite3.ErrCorrupt, sqlite3.ErrNomem, sqlite3.ErrFull, sqlite3.ErrReadonly:
+		dberr = NewError(ErrorInternal, "Internal DB Error", query, table, sqliteErr)
+		return
+	}
+	switch sqliteErr.ExtendedCode {
+	case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+		// unique constrain violation
+		dberr = NewError(ErrorAlreadyExists, "Already Exists, unique constrain violation", query, table, sqliteErr)
+	case sqlite3.ErrConstraintForeignKey:
+		// foreign key violation
+		dberr = NewError(ErrorForeignKey, "Referenced row doesn't exist, foreign key violation", query, table, sqliteErr)
+	default:
+		if strings.HasPrefix(sqliteErr.Error(), "no such function") {
+			dberr = NewError(ErrorMissingExtensions, "Missing SQLite function", query, table, sqliteErr)
+			return
+		}
+		dberr = NewError(ErrorExecute, "Error executing query", query, table, sqliteErr)
+	}
+	return
+}
+
+// NullTime scans the timestamps computed by a query (i.e. aggregates), SQLite only
+// converts the values of the columns declared as timestamp and returns these as text
+type NullTime struct {
+	sql.NullTime
+}
+
+// Scan implements the sql.Scanner interface
+func (t *NullTime) Scan(value interface{}) error {
+	var text string
+	switch v := value.(type) {
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return t.NullTime.Scan(value)
+	}
+	text = strings.TrimSuffix(text, "Z")
+	for _, format := range sqlite3.SQLiteTimestampFormats {
+		if parsed, err := time.ParseInLocation(format, text, time.UTC); err == nil {
+			t.Time, t.Valid = parsed, true
+			return nil
+		}
+	}
+	return fmt.Errorf("Couldn't parse %q as a timestamp", text)
+}
@@ -0,0 +1,181 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"chocolate/service/shared/logger"
+)
+
+const (
+	// txAttempts is how many times WithTx runs a transaction that failed to serialize
+	txAttempts = 3
+	// txRetryWait is multiplied by the attempt number to wait before retrying
+	txRetryWait = 20 * time.Millisecond
+)
+
+// Executor is what the Models run their queries in, the *DB or a *Tx,
+// so the same model functions work inside and outside a transaction
+type Executor interface {
+	// GetInstance returns the Instance to run queries in
+	GetInstance() *Instance
+	// WithTimeout returns a copy of ctx that is canceled after the configured query timeout
+	WithTimeout(ctx context.Context) (context.Context, context.CancelFunc)
+	// FormError wraps the driver error in a Error
+	FormError(err error, query, table string) *Error
+	// Dialect returns the SQL dialect of the DB driver
+	Dialect() Dialect
+	// WithTx runs fn in a transaction, or in a savepoint if already in one
+	WithTx(ctx context.Context, fn func(tx *Tx) error) *Error
+}
+
+// Tx is a DB transaction, it is an Executor so the model functions can run in it
+type Tx struct {
+	db    *DB
+	sqltx *sql.Tx
+	// depth is the number of nested savepoints
+	depth int
+	// onCommit and onRollback run when the transaction ends, see OnCommit
+	onCommit, onRollback []func()
+}
+
+// OnCommit registers fn to run once the transaction is committed, i.e. to apply the writes kept out of the DB.
+// The functions belong to the whole transaction, rolling back a savepoint doesn't drop them
+func (tx *Tx) OnCommit(fn func()) {
+	tx.onCommit = append(tx.onCommit, fn)
+}
+
+// OnRollback registers fn to run once the transaction is rolled back, or fails to commit
+func (tx *Tx) OnRollback(fn func()) {
+	tx.onRollback = append(tx.onRollback, fn)
+}
+
+// end runs the functions registered for the transaction outcome
+func (tx *Tx) end(committed bool) {
+	fns := tx.onRollback
+	if committed {
+		fns = tx.onCommit
+	}
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// GetInstance returns the Instance to run queries in the transaction
+func (tx *Tx) GetInstance() *Instance {
+	return &Instance{tx.sqltx, tx.db.dialect}
+}
+
+// WithTimeout returns a copy of ctx that is canceled after the configured query timeout
+func (tx *Tx) WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return tx.db.WithTimeout(ctx)
+}
+
+// FormError wraps the driver error in a Error
+func (tx *Tx) FormError(err error, query, table string) *Error {
+	return tx.db.FormError(err, query, table)
+}
+
+// Dialect returns the SQL dialect of the DB driver
+func (tx *Tx) Dialect() Dialect {
+	return tx.db.dialect
+}
+
+// WithTx runs fn in a savepoint of the transaction, if fn fails only what it did is rolled back
+// and the transaction can go on, i.e. for the writes whose failure isn't critical
+func (tx *Tx) WithTx(ctx context.Context, fn func(tx *Tx) error) (dberr *Error) {
+	tx.depth++
+	defer func() { tx.depth-- }()
+	savepoint := fmt.Sprintf("sp_%d", tx.depth)
+
+	qry := "SAVEPOINT " + savepoint
+	if _, err := tx.sqltx.ExecContext(ctx, qry); err != nil {
+		return tx.FormError(err, qry, "")
+	}
+	if dberr = txError(fn(tx)); dberr != nil {
+		qry = "ROLLBACK TO SAVEPOINT " + savepoint
+		if _, err := tx.sqltx.ExecContext(ctx, qry); err != nil {
+			logger.Errorf("database:Tx.WithTx() Couldn't rollback to savepoint %s: %s", savepoint, err.Error())
+		}
+		return
+	}
+	qry = "RELEASE SAVEPOINT " + savepoint
+	if _, err := tx.sqltx.ExecContext(ctx, qry); err != nil {
+		return tx.FormError(err, qry, "")
+	}
+	return nil
+}
+
+// WithTx runs fn in a transaction, it is committed if fn returns nil and rolled back otherwise.
+// When the transaction fails to serialize with the concurrent ones (or deadlocks) fn is run again
+// in a new one, so it must not have side effects out of the DB. The *Error fn returns is returned
+// as is so the handlers can map its code
+func (db *DB) WithTx(ctx context.Context, fn func(tx *Tx) error) (dberr *Error) {
+	return db.withTx(ctx, nil, fn)
+}
+
+// WithSerializableTx is WithTx in a SERIALIZABLE transaction, for the ones that check the rows before writing
+// (i.e. count them before an insert) so concurrent ones can't both pass the check, one of them fails to serialize
+// and is run again. SQLite transactions are serialized already by the write lock they take when they begin
+func (db *DB) WithSerializableTx(ctx context.Context, fn func(tx *Tx) error) (dberr *Error) {
+	return db.withTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable}, fn)
+}
+
+// withTx runs fn in a transaction with opts retrying it when it fails to serialize
+func (db *DB) withTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *Tx) error) (dberr *Error) {
+	for attempt := 1; ; attempt++ {
+		if dberr = db.runTx(ctx, opts, fn); dberr == nil || dberr.Code != ErrorSerialization || attempt == txAttempts {
+			return
+		}
+		logger.Infof("database:WithTx() Transaction failed to serialize, retrying (attempt %d): %v", attempt, dberr.Inner)
+		select {
+		case <-ctx.Done():
+			return db.FormError(ctx.Err(), "", "")
+		case <-time.After(time.Duration(attempt) * txRetryWait):
+		}
+	}
+}
+
+// runTx runs fn in a single transaction
+func (db *DB) runTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *Tx) error) (dberr *Error) {
+	sqltx, err := db.dbsql.BeginTx(ctx, opts)
+	if err != nil {
+		return db.FormError(err, "BEGIN", "")
+	}
+	tx := &Tx{db: db, sqltx: sqltx}
+	defer func() {
+		if p := recover(); p != nil {
+			sqltx.Rollback()
+			tx.end(false)
+			panic(p)
+		}
+	}()
+
+	if dberr = txError(fn(tx)); dberr != nil {
+		if err = sqltx.Rollback(); err != nil && err != sql.ErrTxDone {
+			logger.Errorf("database:WithTx() Couldn't rollback transaction: %s", err.Error())
+		}
+		tx.end(false)
+		return
+	}
+	if err = sqltx.Commit(); err != nil {
+		tx.end(false)
+		return db.FormError(err, "COMMIT", "")
+	}
+	tx.end(true)
+	return nil
+}
+
+// txError returns the error of a transaction function as a *Error, the model
+// functions return a *Error that could be a nil one in a non nil error
+func txError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	if dberr, ok := err.(*Error); ok {
+		return dberr
+	}
+	return NewError(ErrorGeneric, "Transaction failed", "", "", err)
+}
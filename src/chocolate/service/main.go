@@ -14,9 +14,12 @@ import (
 
 	"chocolate/service/database"
 	"chocolate/service/models"
+	"chocolate/service/models/outbox"
+	"chocolate/service/models/tokens"
 	"chocolate/service/shared/auth/jwt"
 	"chocolate/service/shared/config"
 	"chocolate/service/shared/email"
+	"chocolate/service/shared/email/templates"
 	"chocolate/service/shared/logger"
 )
 
@@ -92,7 +95,7 @@ func main() {
 	signal.Notify(interruptC, os.Interrupt)
 
 	var (
-		server       *http.Server
+		servers      []*http.Server
 		serverErrorC chan error
 	)
 
@@ -104,7 +107,9 @@ func main() {
 		// <-ctx.Done() if your application should wait for other services
 		// to finalize based on context cancellation.
 		close(serverErrorC)
-		server.Shutdown(context.Background())
+		for _, server := range servers {
+			server.Shutdown(context.Background())
+		}
 		return
 	}
 	// Stop function to be called when received error from server
@@ -120,20 +125,35 @@ func main() {
 		panic(err)
 	}
 	defer serviceDB.Close()
-	if err := serviceDB.Init(models.GetDBTables()); err != nil {
+	migrations, err := models.GetMigrations(serviceDB.Dialect())
+	if err != nil {
+		panic(err)
+	}
+	if err := serviceDB.Init(migrations); err != nil {
 		fmt.Printf("serviceDB.Init() error = %v\n", err)
 		panic(err)
 	}
 
+	// Periodically remove expired entries from the revoked tokens blacklist
+	pruneDone := make(chan struct{})
+	defer close(pruneDone)
+	go tokens.PruneEvery(serviceDB, time.Hour, pruneDone)
+
 	// Initialize Auth Keys
 	if err = jwt.Init(_conf); err != nil {
 		panic(err)
 	}
 	// Initialize Email Service
-	email.Init(_conf.Email)
+	email.Init(_conf.Email, _conf.Test)
+	if err = templates.Init(_conf.Email); err != nil {
+		panic(err)
+	}
+	dispatchDone := make(chan struct{})
+	defer close(dispatchDone)
+	go outbox.NewDispatcher(serviceDB, _conf.Email.Outbox).Run(dispatchDone)
 
 	// Start Server
-	server, serverErrorC = startServer(_conf, serviceDB)
+	servers, serverErrorC = startServer(_conf, serviceDB)
 	logger.Debug("Http Server Started")
 
 	// This select will prevent program to stop until is forcelly shutdown
@@ -157,21 +177,60 @@ func main() {
 	fmt.Println("Stopped.")
 }
 
-func startServer(conf *config.Configuration, serviceDB *database.DB) (*http.Server, chan error) {
-	logger.Debug("Starting HTTP Server")
-
+func startServer(conf *config.Configuration, serviceDB *database.DB) ([]*http.Server, chan error) {
 	errC := make(chan error)
 
-	server := NewServer(conf, serviceDB)
+	if !conf.Server.TLS.Enabled {
+		logger.Debug("Starting HTTP Server")
+		server, err := NewServer(conf, serviceDB)
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Errorf("Error from http server %s", err.Error())
+				errC <- err
+			}
+		}()
+		return []*http.Server{server}, errC
+	}
 
+	logger.Debug("Starting HTTPS Server")
+	server, reloader, err := NewSecureServer(conf, serviceDB)
+	if err != nil {
+		panic(err)
+	}
+	// Reload the certificate on SIGHUP so renewed certificates are used without a restart
+	hupC := make(chan os.Signal, 1)
+	signal.Notify(hupC, syscall.SIGHUP)
 	go func() {
-		if err := server.ListenAndServe(); err != nil {
-			logger.Errorf("Error from http server %s", err.Error())
+		for range hupC {
+			logger.Info("SIGHUP signal received! reloading TLS certificate...")
+			if err := reloader.Reload(); err != nil {
+				logger.Errorf("Keeping current TLS certificate: %s", err.Error())
+			}
+		}
+	}()
+	go func() {
+		// Certificate is given by the TLSConfig GetCertificate
+		if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("Error from https server %s", err.Error())
 			errC <- err
 		}
 	}()
+	servers := []*http.Server{server}
+
+	if conf.Server.TLS.RedirectPort != "" {
+		logger.Debugf("Starting HTTP to HTTPS redirect Server on port %s", conf.Server.TLS.RedirectPort)
+		redirect := NewRedirectServer(conf)
+		go func() {
+			if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Errorf("Error from http redirect server %s", err.Error())
+				errC <- err
+			}
+		}()
+		servers = append(servers, redirect)
+	}
 
-	return server, errC
+	return servers, errC
 }
-
-// TODO: start https server
@@ -47,10 +47,13 @@ func DecodeUserAuth(data []byte) (userAuth *UserAuth, err error) {
 	return
 }
 
-// AuthResponse object for authentication responses with jwt pairs
+// AuthResponse object for authentication responses with jwt pairs,
+// when the user has MFA enabled it only holds the mfa_token challenge
 type Response struct {
-	AccessToken  string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
+	AccessToken  string `json:"access_token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	MFARequired  bool   `json:"mfa_required,omitempty"`
+	MFAToken     string `json:"mfa_token,omitempty"`
 }
 
 // JSON returns the json bytes of the object
@@ -0,0 +1,18 @@
+package confirmations
+
+// Confirmation is a confirmation email issued to a user, its ID is the ID (jti) of the confirm JWT.
+// It can be used once before it expires
+type Confirmation struct {
+	ID        string `json:"id,omitempty"`
+	UserID    string `json:"user_id,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	UsedAt    int64  `json:"used_at,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// Stats are the confirmation emails issued to a user since a given time
+type Stats struct {
+	Sent        int
+	FirstSentAt int64
+	LastSentAt  int64
+}
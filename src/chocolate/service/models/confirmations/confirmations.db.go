@@ -0,0 +1,118 @@
+package confirmations
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"chocolate/service/database"
+	"chocolate/service/shared/logger"
+)
+
+// Insert creates a Confirmation record in DB, created_at is set here instead of by the DB
+// default so the queries compare timestamps of the same format on every dialect
+func (c *Confirmation) Insert(ctx context.Context, db database.Executor, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `INSERT INTO email_confirmations(id, user_id, expires_at, created_at) VALUES($1, $2, $3, $4)`
+
+	createdAt := time.Now().UTC()
+	expiresAt := time.Unix(c.ExpiresAt, 0).UTC()
+	if _, err := db.GetInstance().ExecContext(ctx, qry, c.ID, c.UserID, expiresAt, createdAt); err != nil {
+		logger.Errorf("%v:Confirmation:Insert() Couldn't insert confirmation: %s", reqID, err.Error())
+		dberr = db.FormError(err, qry, "email_confirmations")
+		return
+	}
+
+	c.CreatedAt = createdAt.Unix()
+	return
+}
+
+// GetStats counts the confirmations issued to the user since the given time
+func GetStats(ctx context.Context, db database.Executor, userID string, since time.Time, reqID string) (stats Stats, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `SELECT count(id), min(created_at), max(created_at)
+			FROM email_confirmations WHERE user_id = $1 AND created_at > $2`
+
+	// Aggregated timestamps don't have a column type SQLite can convert them by
+	var firstSentAt, lastSentAt database.NullTime
+	err := db.GetInstance().QueryRowContext(ctx, qry, userID, since.UTC()).Scan(&stats.Sent, &firstSentAt, &lastSentAt)
+	if err != nil {
+		logger.Errorf("%v:Confirmation:GetStats() Couldn't count confirmations of user(%s): %s", reqID, userID, err.Error())
+		dberr = db.FormError(err, qry, "email_confirmations")
+		return
+	}
+
+	if firstSentAt.Valid {
+		stats.FirstSentAt = firstSentAt.Time.Unix()
+	}
+	if lastSentAt.Valid {
+		stats.LastSentAt = lastSentAt.Time.Unix()
+	}
+	return
+}
+
+// Get gets a Confirmation by ID
+func Get(ctx context.Context, db database.Executor, confirmationID, reqID string) (c Confirmation, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `SELECT id, user_id, expires_at, used_at, created_at FROM email_confirmations WHERE id = $1`
+
+	var (
+		createdAt         time.Time
+		expiresAt, usedAt sql.NullTime
+	)
+	err := db.GetInstance().QueryRowContext(ctx, qry, confirmationID).Scan(&c.ID, &c.UserID, &expiresAt, &usedAt, &createdAt)
+	if err != nil {
+		logger.Errorf("%v:Confirmation:Get() Couldn't get confirmation(%s): %s", reqID, confirmationID, err.Error())
+		dberr = db.FormError(err, qry, "email_confirmations")
+		return
+	}
+
+	c.CreatedAt = createdAt.Unix()
+	if expiresAt.Valid {
+		c.ExpiresAt = expiresAt.Time.Unix()
+	}
+	if usedAt.Valid {
+		c.UsedAt = usedAt.Time.Unix()
+	}
+	return
+}
+
+// Use marks the confirmation as used, it fails with database.ErrorNoRows
+// if the confirmation doesn't exist, was already used or is expired
+func Use(ctx context.Context, db database.Executor, confirmationID, userID, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `UPDATE email_confirmations SET used_at = $3
+			WHERE id = $1 AND user_id = $2 AND used_at IS NULL AND expires_at > $3
+			RETURNING id`
+
+	var id string
+	if err := db.GetInstance().QueryRowContext(ctx, qry, confirmationID, userID, time.Now().UTC()).Scan(&id); err != nil {
+		logger.Errorf("%v:Confirmation:Use() Couldn't use confirmation(%s): %s", reqID, confirmationID, err.Error())
+		dberr = db.FormError(err, qry, "email_confirmations")
+		return
+	}
+	return
+}
+
+// Invalidate marks every pending confirmation of the user as used
+func Invalidate(ctx context.Context, db database.Executor, userID, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `UPDATE email_confirmations SET used_at = $2 WHERE user_id = $1 AND used_at IS NULL`
+
+	if _, err := db.GetInstance().ExecContext(ctx, qry, userID, time.Now().UTC()); err != nil {
+		logger.Errorf("%v:Confirmation:Invalidate() Couldn't invalidate confirmations: %s", reqID, err.Error())
+		dberr = db.FormError(err, qry, "email_confirmations")
+		return
+	}
+	return
+}
@@ -0,0 +1,50 @@
+package emailchanges
+
+import (
+	"encoding/json"
+	"errors"
+	"net/mail"
+)
+
+// EmailChange is a change of the user email (username), its ID is the ID (jti) of the JWTs of the
+// verification link sent to the new address and of the undo link sent to the old one
+type EmailChange struct {
+	ID          string `json:"id,omitempty"`
+	UserID      string `json:"user_id,omitempty"`
+	OldEmail    string `json:"old_email"`
+	NewEmail    string `json:"new_email"`
+	ExpiresAt   int64  `json:"expires_at,omitempty"`
+	ConfirmedAt int64  `json:"confirmed_at,omitempty"`
+	UndoneAt    int64  `json:"undone_at,omitempty"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+// Request is the body to change the user email, the current password is required
+type Request struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// JSON returns the json bytes of the object
+func (r Request) JSON() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// Valid validates that Request fields are correct
+func (r Request) Valid() error {
+	if len(r.Email) == 0 {
+		return errors.New("Missing 'email'")
+	}
+	if addr, err := mail.ParseAddress(r.Email); err != nil || addr.Address != r.Email {
+		return errors.New("'email' is not a valid email address")
+	}
+	if len(r.Password) == 0 {
+		return errors.New("Missing 'password'")
+	}
+	return nil
+}
+
+// Decode takes data and Unmarshals it into itself
+func (r *Request) Decode(data []byte) error {
+	return json.Unmarshal(data, r)
+}
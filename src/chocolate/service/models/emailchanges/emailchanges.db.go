@@ -0,0 +1,137 @@
+package emailchanges
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"chocolate/service/database"
+	"chocolate/service/shared/logger"
+)
+
+// Insert creates an EmailChange record in DB, created_at is set here instead of by the DB
+// default so the queries compare timestamps of the same format on every dialect
+func (c *EmailChange) Insert(ctx context.Context, db database.Executor, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `INSERT INTO email_changes(id, user_id, old_email, new_email, expires_at, created_at)
+			VALUES($1, $2, $3, $4, $5, $6)`
+
+	createdAt := time.Now().UTC()
+	expiresAt := time.Unix(c.ExpiresAt, 0).UTC()
+	if _, err := db.GetInstance().ExecContext(ctx, qry, c.ID, c.UserID, c.OldEmail, c.NewEmail, expiresAt, createdAt); err != nil {
+		logger.Errorf("%v:EmailChange:Insert() Couldn't insert email change: %s", reqID, err.Error())
+		dberr = db.FormError(err, qry, "email_changes")
+		return
+	}
+
+	c.CreatedAt = createdAt.Unix()
+	return
+}
+
+// Get gets an EmailChange by ID
+func Get(ctx context.Context, db database.Executor, changeID, reqID string) (c EmailChange, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `SELECT id, user_id, old_email, new_email, expires_at, confirmed_at, undone_at, created_at
+			FROM email_changes WHERE id = $1`
+
+	var (
+		expiresAt, createdAt  time.Time
+		confirmedAt, undoneAt sql.NullTime
+	)
+	err := db.GetInstance().QueryRowContext(ctx, qry, changeID).Scan(&c.ID, &c.UserID, &c.OldEmail, &c.NewEmail,
+		&expiresAt, &confirmedAt, &undoneAt, &createdAt)
+	if err != nil {
+		logger.Errorf("%v:EmailChange:Get() Couldn't get email change(%s): %s", reqID, changeID, err.Error())
+		dberr = db.FormError(err, qry, "email_changes")
+		return
+	}
+
+	c.ExpiresAt = expiresAt.Unix()
+	c.CreatedAt = createdAt.Unix()
+	if confirmedAt.Valid {
+		c.ConfirmedAt = confirmedAt.Time.Unix()
+	}
+	if undoneAt.Valid {
+		c.UndoneAt = undoneAt.Time.Unix()
+	}
+	return
+}
+
+// Confirm marks the change as confirmed and returns the new email, it fails with database.ErrorNoRows
+// if the change doesn't exist, was already confirmed or undone, or is expired
+func Confirm(ctx context.Context, db database.Executor, changeID, userID, reqID string) (newEmail string, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `UPDATE email_changes SET confirmed_at = $3
+			WHERE id = $1 AND user_id = $2 AND confirmed_at IS NULL AND undone_at IS NULL AND expires_at > $3
+			RETURNING new_email`
+
+	if err := db.GetInstance().QueryRowContext(ctx, qry, changeID, userID, time.Now().UTC()).Scan(&newEmail); err != nil {
+		logger.Errorf("%v:EmailChange:Confirm() Couldn't confirm email change(%s): %s", reqID, changeID, err.Error())
+		dberr = db.FormError(err, qry, "email_changes")
+		return
+	}
+	return
+}
+
+// Undo marks the change as undone and returns it, it fails with database.ErrorNoRows
+// if the change doesn't exist, was already undone or a newer confirmed change replaced it
+func Undo(ctx context.Context, db database.Executor, changeID, userID, reqID string) (c EmailChange, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `UPDATE email_changes SET undone_at = $3
+			WHERE id = $1 AND user_id = $2 AND undone_at IS NULL
+			RETURNING id, user_id, old_email, new_email, confirmed_at`
+
+	var confirmedAt sql.NullTime
+	err := db.GetInstance().QueryRowContext(ctx, qry, changeID, userID, time.Now().UTC()).Scan(&c.ID, &c.UserID,
+		&c.OldEmail, &c.NewEmail, &confirmedAt)
+	if err != nil {
+		logger.Errorf("%v:EmailChange:Undo() Couldn't undo email change(%s): %s", reqID, changeID, err.Error())
+		dberr = db.FormError(err, qry, "email_changes")
+		return
+	}
+
+	if confirmedAt.Valid {
+		c.ConfirmedAt = confirmedAt.Time.Unix()
+	}
+	return
+}
+
+// Supersede marks the confirmed changes of the user older than the confirmed changeID as undone,
+// so their undo links can't swap back a username the newer change already replaced
+func Supersede(ctx context.Context, db database.Executor, changeID, userID, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `UPDATE email_changes SET undone_at = $3
+			WHERE user_id = $1 AND id <> $2 AND confirmed_at IS NOT NULL AND undone_at IS NULL`
+
+	if _, err := db.GetInstance().ExecContext(ctx, qry, userID, changeID, time.Now().UTC()); err != nil {
+		logger.Errorf("%v:EmailChange:Supersede() Couldn't supersede email changes: %s", reqID, err.Error())
+		dberr = db.FormError(err, qry, "email_changes")
+		return
+	}
+	return
+}
+
+// CancelPending marks the changes of the user that weren't confirmed yet as undone
+func CancelPending(ctx context.Context, db database.Executor, userID, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `UPDATE email_changes SET undone_at = $2 WHERE user_id = $1 AND confirmed_at IS NULL AND undone_at IS NULL`
+
+	if _, err := db.GetInstance().ExecContext(ctx, qry, userID, time.Now().UTC()); err != nil {
+		logger.Errorf("%v:EmailChange:CancelPending() Couldn't cancel pending email changes: %s", reqID, err.Error())
+		dberr = db.FormError(err, qry, "email_changes")
+		return
+	}
+	return
+}
@@ -0,0 +1,202 @@
+package mfa
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"chocolate/service/database"
+	"chocolate/service/shared/logger"
+	"chocolate/service/shared/utils/uuid"
+)
+
+// Enroll stores a new not yet enabled TOTP secret for the user, it fails with
+// database.ErrorNoRows if the user already has TOTP enabled
+func (t *TOTP) Enroll(ctx context.Context, db database.Executor, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `INSERT INTO user_totp(user_id, secret) VALUES($1, $2)
+			ON CONFLICT (user_id) DO UPDATE
+			SET secret = EXCLUDED.secret, last_counter = 0, enabled_at = NULL, created_at = current_timestamp
+			WHERE user_totp.enabled = FALSE
+			RETURNING enabled, created_at`
+
+	var createdAt time.Time
+	if err := db.GetInstance().QueryRowContext(ctx, qry, t.UserID, t.Secret).Scan(&t.Enabled, &createdAt); err != nil {
+		logger.Errorf("%v:TOTP:Enroll() Couldn't enroll user(%s): %s", reqID, t.UserID, err.Error())
+		dberr = db.FormError(err, qry, "user_totp")
+		return
+	}
+	t.CreatedAt = createdAt.Unix()
+	return
+}
+
+// GetTOTP gets the user TOTP
+func GetTOTP(ctx context.Context, db database.Executor, userID, reqID string) (t TOTP, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `SELECT user_id, secret, enabled, last_counter, enabled_at, created_at FROM user_totp WHERE user_id = $1`
+
+	var (
+		createdAt time.Time
+		enabledAt sql.NullTime
+	)
+	err := db.GetInstance().QueryRowContext(ctx, qry, userID).Scan(&t.UserID, &t.Secret, &t.Enabled, &t.LastCounter, &enabledAt, &createdAt)
+	if err != nil {
+		logger.Errorf("%v:TOTP:GetTOTP() Couldn't get user(%s) totp: %s", reqID, userID, err.Error())
+		dberr = db.FormError(err, qry, "user_totp")
+		return
+	}
+	t.CreatedAt = createdAt.Unix()
+	if enabledAt.Valid {
+		t.EnabledAt = enabledAt.Time.Unix()
+	}
+	return
+}
+
+// IsEnabled checks if the user has TOTP enabled
+func IsEnabled(ctx context.Context, db database.Executor, userID, reqID string) (bool, *database.Error) {
+	t, dberr := GetTOTP(ctx, db, userID, reqID)
+	if dberr != nil {
+		if dberr.Code == database.ErrorNoRows {
+			return false, nil
+		}
+		return false, dberr
+	}
+	return t.Enabled, nil
+}
+
+// Enable enables the enrolled TOTP once the user proved it can generate codes
+func Enable(ctx context.Context, db database.Executor, userID string, counter int64, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `UPDATE user_totp SET enabled = TRUE, enabled_at = current_timestamp, last_counter = $2
+			WHERE user_id = $1 AND enabled = FALSE RETURNING user_id`
+
+	var id string
+	if err := db.GetInstance().QueryRowContext(ctx, qry, userID, counter).Scan(&id); err != nil {
+		logger.Errorf("%v:TOTP:Enable() Couldn't enable user(%s) totp: %s", reqID, userID, err.Error())
+		dberr = db.FormError(err, qry, "user_totp")
+		return
+	}
+	return
+}
+
+// UseCounter records the time step of an accepted code, it fails with database.ErrorNoRows
+// if the step was already used (replayed code)
+func UseCounter(ctx context.Context, db database.Executor, userID string, counter int64, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `UPDATE user_totp SET last_counter = $2
+			WHERE user_id = $1 AND enabled = TRUE AND last_counter < $2 RETURNING user_id`
+
+	var id string
+	if err := db.GetInstance().QueryRowContext(ctx, qry, userID, counter).Scan(&id); err != nil {
+		logger.Errorf("%v:TOTP:UseCounter() Couldn't use user(%s) totp counter: %s", reqID, userID, err.Error())
+		dberr = db.FormError(err, qry, "user_totp")
+		return
+	}
+	return
+}
+
+// Delete removes the user TOTP and its recovery codes
+func Delete(ctx context.Context, db database.Executor, userID, reqID string) *database.Error {
+	return db.WithTx(ctx, func(tx *database.Tx) error {
+		return deleteMFA(ctx, tx, userID, reqID)
+	})
+}
+
+// deleteMFA runs the queries of Delete in a transaction
+func deleteMFA(ctx context.Context, db database.Executor, userID, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	for _, qry := range []string{
+		`DELETE FROM mfa_recovery_codes WHERE user_id = $1`,
+		`DELETE FROM user_totp WHERE user_id = $1`,
+	} {
+		if _, err := db.GetInstance().ExecContext(ctx, qry, userID); err != nil {
+			logger.Errorf("%v:TOTP:Delete() Couldn't delete user(%s) mfa: %s", reqID, userID, err.Error())
+			dberr = db.FormError(err, qry, "user_totp")
+			return
+		}
+	}
+	return
+}
+
+// ReplaceRecoveryCodes replaces the user recovery codes by the given hashed codes
+func ReplaceRecoveryCodes(ctx context.Context, db database.Executor, userID string, codeHashes []string, reqID string) *database.Error {
+	return db.WithTx(ctx, func(tx *database.Tx) error {
+		return replaceRecoveryCodes(ctx, tx, userID, codeHashes, reqID)
+	})
+}
+
+// replaceRecoveryCodes runs the queries of ReplaceRecoveryCodes in a transaction
+func replaceRecoveryCodes(ctx context.Context, db database.Executor, userID string, codeHashes []string, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `DELETE FROM mfa_recovery_codes WHERE user_id = $1`
+	if _, err := db.GetInstance().ExecContext(ctx, qry, userID); err != nil {
+		logger.Errorf("%v:TOTP:ReplaceRecoveryCodes() Couldn't delete user(%s) recovery codes: %s", reqID, userID, err.Error())
+		dberr = db.FormError(err, qry, "mfa_recovery_codes")
+		return
+	}
+
+	qry = `INSERT INTO mfa_recovery_codes(id, user_id, code_hash) VALUES($1, $2, $3)`
+	for _, codeHash := range codeHashes {
+		id, err := uuid.New()
+		if err != nil {
+			logger.Errorf("%v:TOTP:ReplaceRecoveryCodes() Couldn't generate recovery code id: %s", reqID, err.Error())
+			dberr = db.FormError(err, qry, "mfa_recovery_codes")
+			return
+		}
+		if _, err = db.GetInstance().ExecContext(ctx, qry, id, userID, codeHash); err != nil {
+			logger.Errorf("%v:TOTP:ReplaceRecoveryCodes() Couldn't insert user(%s) recovery code: %s", reqID, userID, err.Error())
+			dberr = db.FormError(err, qry, "mfa_recovery_codes")
+			return
+		}
+	}
+	return
+}
+
+// UseRecoveryCode consumes a recovery code, it fails with database.ErrorNoRows
+// if the code doesn't exist or was already used
+func UseRecoveryCode(ctx context.Context, db database.Executor, userID, codeHash, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `UPDATE mfa_recovery_codes SET used_at = current_timestamp
+			WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL RETURNING id`
+
+	var id string
+	if err := db.GetInstance().QueryRowContext(ctx, qry, userID, codeHash).Scan(&id); err != nil {
+		logger.Errorf("%v:TOTP:UseRecoveryCode() Couldn't use user(%s) recovery code: %s", reqID, userID, err.Error())
+		dberr = db.FormError(err, qry, "mfa_recovery_codes")
+		return
+	}
+	return
+}
+
+// CountChallengeFailure adds a wrong code to the mfa_required challenge (the mfa_token jti),
+// it returns how many the challenge got so far
+func CountChallengeFailure(ctx context.Context, db database.Executor, challengeID, userID string, expiresAt int64, reqID string) (failures int, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `INSERT INTO mfa_challenge_failures(id, user_id, failures, expires_at) VALUES($1, $2, 1, $3)
+			ON CONFLICT (id) DO UPDATE SET failures = mfa_challenge_failures.failures + 1
+			RETURNING failures`
+
+	err := db.GetInstance().QueryRowContext(ctx, qry, challengeID, userID, time.Unix(expiresAt, 0)).Scan(&failures)
+	if err != nil {
+		logger.Errorf("%v:TOTP:CountChallengeFailure() Couldn't count challenge(%s) failure: %s", reqID, challengeID, err.Error())
+		dberr = db.FormError(err, qry, "mfa_challenge_failures")
+		return
+	}
+	return
+}
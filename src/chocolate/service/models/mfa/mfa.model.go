@@ -0,0 +1,111 @@
+package mfa
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// TOTP is the user TOTP (RFC 6238) second factor
+type TOTP struct {
+	UserID  string `json:"user_id"`
+	Secret  string `json:"-"`
+	Enabled bool   `json:"enabled"`
+	// LastCounter is the last time step used, codes of older steps are rejected to avoid replays
+	LastCounter int64 `json:"-"`
+	EnabledAt   int64 `json:"enabled_at,omitempty"`
+	CreatedAt   int64 `json:"created_at"`
+}
+
+// Enrollment is the response of a TOTP enrollment, recovery codes are only shown once
+type Enrollment struct {
+	Secret        string   `json:"secret"`
+	URI           string   `json:"uri"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// JSON returns the json bytes of the object
+func (e Enrollment) JSON() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Verification is the body to verify a TOTP code
+type Verification struct {
+	Code string `json:"code"`
+}
+
+// JSON returns the json bytes of the object
+func (v Verification) JSON() ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Valid validates that Verification fields are correct
+func (v Verification) Valid() error {
+	if len(v.Code) == 0 {
+		return errors.New("Missing 'code'")
+	}
+	return nil
+}
+
+// Decode takes data and Unmarshals it into itself
+func (v *Verification) Decode(data []byte) error {
+	return json.Unmarshal(data, v)
+}
+
+// Proof is the body of the actions that require a current TOTP code or a recovery code, i.e. to disable TOTP
+type Proof struct {
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+// JSON returns the json bytes of the object
+func (p Proof) JSON() ([]byte, error) {
+	return json.Marshal(p)
+}
+
+// Valid validates that Proof fields are correct
+func (p Proof) Valid() error {
+	if len(p.Code) == 0 && len(p.RecoveryCode) == 0 {
+		return errors.New("Missing 'code' or 'recovery_code'")
+	}
+	return nil
+}
+
+// Decode takes data and Unmarshals it into itself
+func (p *Proof) Decode(data []byte) error {
+	return json.Unmarshal(data, p)
+}
+
+// Challenge is the body to answer the mfa_required challenge returned on login
+type Challenge struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+// JSON returns the json bytes of the object
+func (c Challenge) JSON() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+// Valid validates that Challenge fields are correct
+func (c Challenge) Valid() error {
+	if len(c.MFAToken) == 0 {
+		return errors.New("Missing 'mfa_token'")
+	}
+	if len(c.Code) == 0 && len(c.RecoveryCode) == 0 {
+		return errors.New("Missing 'code' or 'recovery_code'")
+	}
+	return nil
+}
+
+// Decode takes data and Unmarshals it into itself
+func (c *Challenge) Decode(data []byte) error {
+	return json.Unmarshal(data, c)
+}
+
+// NormalizeRecoveryCode removes the formatting of a recovery code (case, dashes and spaces)
+func NormalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
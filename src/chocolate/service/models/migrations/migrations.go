@@ -0,0 +1,13 @@
+// Package migrations has the versioned SQL schema migrations of the Models, one directory
+// per database dialect, add new ones as <version>_<description>.up.sql and
+// <version>_<description>.down.sql to every dialect with the same version
+package migrations
+
+import (
+	"embed"
+)
+
+// FS holds the migration files
+//
+//go:embed postgres/*.sql sqlite/*.sql
+var FS embed.FS
@@ -0,0 +1,9 @@
+-- The users queries use confirmed_at but the table was created with confirmation_date
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = 'users' AND column_name = 'confirmation_date') THEN
+		ALTER TABLE users RENAME COLUMN confirmation_date TO confirmed_at;
+	END IF;
+END
+$$;
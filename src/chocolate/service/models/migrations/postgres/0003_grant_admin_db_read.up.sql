@@ -0,0 +1,4 @@
+-- The admin role can read the DB connection pool stats
+INSERT INTO role_permissions(role, permission, scope)
+	SELECT 'admin', 'db:read', 'any' WHERE EXISTS (SELECT 1 FROM roles WHERE name = 'admin')
+	ON CONFLICT (role, permission) DO NOTHING;
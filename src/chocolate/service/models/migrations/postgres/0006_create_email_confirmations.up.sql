@@ -0,0 +1,8 @@
+-- Every confirmation email issued to a user, its ID is the ID (jti) of the confirm JWT.
+-- The resend endpoint counts them to enforce its cooldown and daily cap
+CREATE TABLE IF NOT EXISTS email_confirmations (
+	id uuid PRIMARY KEY NOT NULL,
+	user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	created_at timestamp with time zone DEFAULT current_timestamp
+);
+CREATE INDEX IF NOT EXISTS email_confirmations_user_id_created_at_idx on email_confirmations(user_id, created_at);
@@ -0,0 +1,2 @@
+ALTER TABLE email_confirmations DROP COLUMN IF EXISTS used_at;
+ALTER TABLE email_confirmations DROP COLUMN IF EXISTS expires_at;
@@ -0,0 +1,4 @@
+-- Confirmation tokens expire and can only be used once, the ones issued before
+-- don't have an expiration and are rejected
+ALTER TABLE email_confirmations ADD COLUMN IF NOT EXISTS expires_at timestamp with time zone;
+ALTER TABLE email_confirmations ADD COLUMN IF NOT EXISTS used_at timestamp with time zone;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS mfa_challenge_failures;
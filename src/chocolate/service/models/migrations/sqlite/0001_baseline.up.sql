@@ -0,0 +1,100 @@
+-- Same schema as the postgres baseline, ids are uuids generated by the service stored as text
+-- and timestamps are declared as timestamp so the driver converts them, always stored in UTC
+CREATE TABLE IF NOT EXISTS users (
+	id text PRIMARY KEY NOT NULL,
+	username text NOT NULL UNIQUE,
+	password text NOT NULL,
+	salt text NOT NULL,
+	confirmed boolean NOT NULL DEFAULT FALSE,
+	confirmation_date timestamp,
+	created_at timestamp DEFAULT current_timestamp,
+	tokens_revoked_at timestamp
+);
+CREATE UNIQUE INDEX IF NOT EXISTS users_unique_username_idx on users(lower(username));
+
+CREATE TABLE IF NOT EXISTS password_resets (
+	id text PRIMARY KEY NOT NULL,
+	user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	expires_at timestamp NOT NULL,
+	used_at timestamp,
+	created_at timestamp DEFAULT current_timestamp
+);
+
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+	id text PRIMARY KEY NOT NULL,
+	user_id text NOT NULL,
+	expires_at timestamp NOT NULL,
+	created_at timestamp DEFAULT current_timestamp
+);
+CREATE INDEX IF NOT EXISTS revoked_tokens_expires_at_idx on revoked_tokens(expires_at);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	id text PRIMARY KEY NOT NULL,
+	family_id text NOT NULL,
+	user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	access_id text NOT NULL,
+	expires_at timestamp NOT NULL,
+	used_at timestamp,
+	revoked_at timestamp,
+	created_at timestamp DEFAULT current_timestamp
+);
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_id_idx on refresh_tokens(family_id);
+CREATE INDEX IF NOT EXISTS refresh_tokens_user_id_idx on refresh_tokens(user_id);
+
+CREATE TABLE IF NOT EXISTS user_totp (
+	user_id text PRIMARY KEY NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	secret text NOT NULL,
+	enabled boolean NOT NULL DEFAULT FALSE,
+	last_counter bigint NOT NULL DEFAULT 0,
+	enabled_at timestamp,
+	created_at timestamp DEFAULT current_timestamp
+);
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+	id text PRIMARY KEY NOT NULL,
+	user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	code_hash text NOT NULL,
+	used_at timestamp,
+	created_at timestamp DEFAULT current_timestamp
+);
+CREATE INDEX IF NOT EXISTS mfa_recovery_codes_user_id_idx on mfa_recovery_codes(user_id);
+
+CREATE TABLE IF NOT EXISTS roles (
+	name text PRIMARY KEY NOT NULL,
+	description text NOT NULL DEFAULT '',
+	created_at timestamp DEFAULT current_timestamp
+);
+CREATE TABLE IF NOT EXISTS role_permissions (
+	role text NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+	permission text NOT NULL,
+	scope text NOT NULL DEFAULT 'any' CHECK (scope IN ('any', 'own')),
+	PRIMARY KEY (role, permission)
+);
+CREATE TABLE IF NOT EXISTS user_roles (
+	user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	role text NOT NULL,
+	created_at timestamp DEFAULT current_timestamp,
+	PRIMARY KEY (user_id, role)
+);
+
+-- Default roles, after that they are managed thru the API
+INSERT INTO roles(name, description) VALUES
+	('user', 'Every registered user'),
+	('business', 'Business accounts'),
+	('admin', 'Administrators');
+INSERT INTO role_permissions(role, permission, scope) VALUES
+	('user', 'users:read', 'own'), ('user', 'users:update', 'own'),
+	('user', 'tokens:refresh', 'own'), ('user', 'tokens:delete', 'own'),
+	('user', 'sessions:read', 'own'), ('user', 'sessions:delete', 'own'),
+	('user', 'mfa:update', 'own'), ('user', 'mfa:delete', 'own'),
+	('user', 'roles:read', 'own'),
+	('business', 'users:read', 'own'), ('business', 'users:update', 'own'),
+	('business', 'tokens:refresh', 'own'), ('business', 'tokens:delete', 'own'),
+	('business', 'sessions:read', 'own'), ('business', 'sessions:delete', 'own'),
+	('business', 'mfa:update', 'own'),
+	('business', 'roles:read', 'own'),
+	('admin', 'users:list', 'any'), ('admin', 'users:read', 'any'),
+	('admin', 'users:update', 'any'), ('admin', 'users:delete', 'any'),
+	('admin', 'tokens:refresh', 'any'), ('admin', 'tokens:delete', 'any'),
+	('admin', 'sessions:read', 'any'), ('admin', 'sessions:delete', 'any'),
+	('admin', 'mfa:update', 'any'), ('admin', 'mfa:delete', 'any'),
+	('admin', 'roles:read', 'any'), ('admin', 'roles:grant', 'any'), ('admin', 'roles:manage', 'any');
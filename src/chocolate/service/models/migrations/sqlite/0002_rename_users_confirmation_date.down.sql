@@ -0,0 +1 @@
+ALTER TABLE users RENAME COLUMN confirmed_at TO confirmation_date;
@@ -0,0 +1 @@
+ALTER TABLE users RENAME COLUMN confirmation_date TO confirmed_at;
@@ -0,0 +1,2 @@
+DELETE FROM role_permissions WHERE permission = 'emails:read';
+DROP TABLE IF EXISTS email_outbox;
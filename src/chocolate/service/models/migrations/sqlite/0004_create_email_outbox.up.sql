@@ -0,0 +1,22 @@
+-- Emails are written here in the same transaction as the change that triggers them
+-- and delivered by the outbox dispatcher
+CREATE TABLE IF NOT EXISTS email_outbox (
+	id text PRIMARY KEY NOT NULL,
+	recipient text NOT NULL,
+	sender text NOT NULL,
+	subject text NOT NULL,
+	content_type text NOT NULL,
+	body text NOT NULL,
+	status text NOT NULL DEFAULT 'pending',
+	attempts integer NOT NULL DEFAULT 0,
+	next_attempt_at timestamp NOT NULL,
+	last_error text,
+	sent_at timestamp,
+	created_at timestamp DEFAULT current_timestamp
+);
+CREATE INDEX IF NOT EXISTS email_outbox_status_next_attempt_at_idx on email_outbox(status, next_attempt_at);
+
+-- The admin role can read the emails that failed to be delivered
+INSERT INTO role_permissions(role, permission, scope)
+	SELECT 'admin', 'emails:read', 'any' WHERE EXISTS (SELECT 1 FROM roles WHERE name = 'admin')
+	ON CONFLICT (role, permission) DO NOTHING;
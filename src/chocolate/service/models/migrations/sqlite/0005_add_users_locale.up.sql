@@ -0,0 +1,2 @@
+-- The locale the emails and pages are shown to the user in, empty for the default one
+ALTER TABLE users ADD COLUMN locale text NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+ALTER TABLE email_confirmations DROP COLUMN used_at;
+ALTER TABLE email_confirmations DROP COLUMN expires_at;
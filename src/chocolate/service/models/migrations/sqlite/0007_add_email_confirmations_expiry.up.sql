@@ -0,0 +1,4 @@
+-- Confirmation tokens expire and can only be used once, the ones issued before
+-- don't have an expiration and are rejected
+ALTER TABLE email_confirmations ADD COLUMN expires_at timestamp;
+ALTER TABLE email_confirmations ADD COLUMN used_at timestamp;
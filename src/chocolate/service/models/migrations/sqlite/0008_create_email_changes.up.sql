@@ -0,0 +1,13 @@
+-- Pending and past email (username) changes, its ID is the ID (jti) of the verification
+-- and undo JWTs. undone_at is set when the old address undoes it or a newer change replaces it
+CREATE TABLE IF NOT EXISTS email_changes (
+	id text PRIMARY KEY NOT NULL,
+	user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	old_email text NOT NULL,
+	new_email text NOT NULL,
+	expires_at timestamp NOT NULL,
+	confirmed_at timestamp,
+	undone_at timestamp,
+	created_at timestamp NOT NULL
+);
+CREATE INDEX IF NOT EXISTS email_changes_user_id_idx on email_changes(user_id);
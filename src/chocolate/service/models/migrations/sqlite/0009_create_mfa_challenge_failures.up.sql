@@ -0,0 +1,10 @@
+-- Wrong codes answered to each mfa_required challenge, its ID is the ID (jti) of the
+-- mfa_token. The challenge is revoked once it reaches the limit of failures
+CREATE TABLE IF NOT EXISTS mfa_challenge_failures (
+	id text PRIMARY KEY NOT NULL,
+	user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	failures integer NOT NULL DEFAULT 0,
+	expires_at timestamp NOT NULL,
+	created_at timestamp DEFAULT current_timestamp
+);
+CREATE INDEX IF NOT EXISTS mfa_challenge_failures_expires_at_idx on mfa_challenge_failures(expires_at);
@@ -1,10 +1,18 @@
 package models
 
 import (
+	"fmt"
+
 	"chocolate/service/database"
-	"chocolate/service/models/users"
+	"chocolate/service/models/migrations"
 )
 
+// migrationDirs are the directories in migrations.FS with the migrations of each dialect
+var migrationDirs = map[database.Dialect]string{
+	database.DialectPostgres: "postgres",
+	database.DialectSQLite:   "sqlite",
+}
+
 // APIObject Interface all the service Models should implement
 type APIObject interface {
 	JSON() ([]byte, error)
@@ -12,11 +20,13 @@ type APIObject interface {
 	Decode(data []byte) (err error)
 }
 
-// GetDBTables returns the tables needed to support the Models
+// GetMigrations returns the versioned schema migrations needed to support the Models in the dialect
 // This is where the DB and Models are connected (the dependency is created)
 // NOT EVERY model needs to have a table, only whatever needs to be persisted
-func GetDBTables() []database.Table {
-	return []database.Table{
-		users.GetTable(),
+func GetMigrations(dialect database.Dialect) ([]database.Migration, error) {
+	dir, ok := migrationDirs[dialect]
+	if !ok {
+		return nil, fmt.Errorf("There are no migrations for the %s dialect", dialect)
 	}
+	return database.LoadMigrations(migrations.FS, dir)
 }
@@ -0,0 +1,142 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"chocolate/service/database"
+	"chocolate/service/shared/config"
+	"chocolate/service/shared/email"
+	"chocolate/service/shared/logger"
+)
+
+const (
+	defaultInterval    = 10 * time.Second
+	defaultBatchSize   = 20
+	defaultMaxAttempts = 8
+	defaultBackoff     = 30 * time.Second
+	// maxBackoff caps the wait between attempts
+	maxBackoff = time.Hour
+	// claimLease is how long a claimed Message waits before another dispatcher can take it
+	claimLease = 5 * time.Minute
+)
+
+// Dispatcher delivers the due outbox Messages with the configured email.Sender
+type Dispatcher struct {
+	db          database.Executor
+	interval    time.Duration
+	batchSize   int
+	maxAttempts int
+	backoff     time.Duration
+}
+
+// NewDispatcher creates a Dispatcher of the db outbox with conf, the unset fields get their default
+func NewDispatcher(db database.Executor, conf config.OutboxConfig) *Dispatcher {
+	d := &Dispatcher{
+		db:          db,
+		interval:    defaultInterval,
+		batchSize:   defaultBatchSize,
+		maxAttempts: defaultMaxAttempts,
+		backoff:     defaultBackoff,
+	}
+	if conf.Interval > 0 {
+		d.interval = time.Duration(conf.Interval) * time.Second
+	}
+	if conf.BatchSize > 0 {
+		d.batchSize = conf.BatchSize
+	}
+	if conf.MaxAttempts > 0 {
+		d.maxAttempts = conf.MaxAttempts
+	}
+	if conf.Backoff > 0 {
+		d.backoff = time.Duration(conf.Backoff) * time.Second
+	}
+	return d
+}
+
+// Run dispatches every interval until done is closed
+func (d *Dispatcher) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if sent, dberr := d.Dispatch(context.Background()); dberr == nil && sent > 0 {
+				logger.Debugf("Outbox:Run() sent %d emails", sent)
+			}
+		}
+	}
+}
+
+// Dispatch delivers a batch of the due Messages, a failed one is retried after the backoff
+// (doubled on every attempt) until it fails maxAttempts times, or with an error that
+// isn't retryable, and is dead-lettered
+func (d *Dispatcher) Dispatch(ctx context.Context) (sent int, dberr *database.Error) {
+	now := time.Now()
+	messages, dberr := GetDue(ctx, d.db, now, d.batchSize)
+	if dberr != nil || len(messages) == 0 {
+		return
+	}
+
+	// The messages stay pending, without counting an attempt, until the sender can be created
+	sender, emailErr := email.NewSender()
+	if emailErr != nil {
+		logger.Errorf("Outbox:Dispatch() Couldn't create email sender: %s", emailErr.Error())
+		return
+	}
+	if closer, ok := sender.(email.Closer); ok {
+		defer closer.Close()
+	}
+
+	for _, m := range messages {
+		var claimed bool
+		claimed, dberr = Claim(ctx, d.db, m.ID, now, now.Add(claimLease))
+		if dberr != nil {
+			return
+		}
+		if !claimed {
+			continue
+		}
+
+		mail := &email.Email{
+			Type:    email.Type(m.Type),
+			Subject: m.Subject,
+			Body:    m.Body,
+			From:    m.From,
+			To:      m.To,
+		}
+		if emailErr = sender.Send(mail); emailErr != nil {
+			attempts := m.Attempts + 1
+			// The emails the provider rejected for good aren't retried
+			dead := !emailErr.Retryable || attempts >= d.maxAttempts
+			if dead {
+				logger.Errorf("Outbox:Dispatch() Email(%s) dead-lettered after %d attempts: %s", m.ID, attempts, emailErr.Error())
+			} else {
+				logger.Warnf("Outbox:Dispatch() Couldn't send email(%s), attempt %d: %s", m.ID, attempts, emailErr.Error())
+			}
+			if dberr = MarkFailed(ctx, d.db, m.ID, emailErr.Error(), time.Now().Add(d.retryAfter(attempts)), dead); dberr != nil {
+				return
+			}
+			continue
+		}
+		if dberr = MarkSent(ctx, d.db, m.ID); dberr != nil {
+			return
+		}
+		sent++
+	}
+	return
+}
+
+// retryAfter is how long to wait after the failed attempt number attempts
+func (d *Dispatcher) retryAfter(attempts int) time.Duration {
+	wait := d.backoff
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	return wait
+}
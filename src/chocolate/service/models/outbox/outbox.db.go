@@ -0,0 +1,166 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"chocolate/service/database"
+	"chocolate/service/shared/logger"
+	"chocolate/service/shared/utils/uuid"
+)
+
+const qryAll = `id, recipient, sender, subject, content_type, body, status, attempts,
+		next_attempt_at, last_error, sent_at, created_at`
+
+// Insert writes a pending Message to the outbox, it is due right away
+func (m *Message) Insert(ctx context.Context, db database.Executor, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `INSERT INTO email_outbox(id, recipient, sender, subject, content_type, body, status, next_attempt_at)
+			VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING created_at`
+
+	id, err := uuid.New()
+	if err != nil {
+		logger.Errorf("%v:Message:Insert() Couldn't generate id: %s", reqID, err.Error())
+		dberr = database.NewError(database.ErrorGeneric, "", qry, "email_outbox", err)
+		return
+	}
+
+	now := time.Now()
+	var createdAt time.Time
+	err = db.GetInstance().QueryRowContext(ctx, qry, id, m.To, m.From, m.Subject, m.Type, m.Body,
+		StatusPending, now).Scan(&createdAt)
+	if err != nil {
+		logger.Errorf("%v:Message:Insert() Couldn't insert email: %s", reqID, err.Error())
+		dberr = db.FormError(err, qry, "email_outbox")
+		return
+	}
+
+	m.ID = id
+	m.Status = StatusPending
+	m.Attempts = 0
+	m.NextAttemptAt = now.Unix()
+	m.CreatedAt = createdAt.Unix()
+	return
+}
+
+// GetDue retrieves up to limit pending Messages whose next attempt is due at now, oldest first
+func GetDue(ctx context.Context, db database.Executor, now time.Time, limit int) (messages Messages, dberr *database.Error) {
+	qry := `SELECT ` + qryAll + ` FROM email_outbox
+			WHERE status = $1 AND next_attempt_at <= $2
+			ORDER BY next_attempt_at LIMIT $3`
+	return getList(ctx, db, qry, "", StatusPending, now, limit)
+}
+
+// GetFailed retrieves the Messages that failed at least once and weren't delivered, the dead ones
+// and the ones waiting to be retried, newest first
+func GetFailed(ctx context.Context, db database.Executor, reqID string) (messages Messages, dberr *database.Error) {
+	qry := `SELECT ` + qryAll + ` FROM email_outbox
+			WHERE status = $1 OR (status = $2 AND attempts > 0)
+			ORDER BY created_at DESC`
+	return getList(ctx, db, qry, reqID, StatusDead, StatusPending)
+}
+
+// Claim takes the pending Message by moving its next attempt to leaseUntil, only if it is still due at now.
+// Concurrent dispatchers can't claim it again until the lease is over, so if the one that claimed it
+// stops before marking it the Message is retried then. claimed is false if another one took it first
+func Claim(ctx context.Context, db database.Executor, messageID string, now, leaseUntil time.Time) (claimed bool, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `UPDATE email_outbox SET next_attempt_at = $4
+			WHERE id = $1 AND status = $2 AND next_attempt_at <= $3`
+
+	res, err := db.GetInstance().ExecContext(ctx, qry, messageID, StatusPending, now, leaseUntil)
+	if err != nil {
+		logger.Errorf("Message:Claim() Couldn't claim email(%s): %s", messageID, err.Error())
+		dberr = db.FormError(err, qry, "email_outbox")
+		return
+	}
+	affected, _ := res.RowsAffected()
+	claimed = affected == 1
+	return
+}
+
+// MarkSent sets the Message as delivered
+func MarkSent(ctx context.Context, db database.Executor, messageID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `UPDATE email_outbox SET status = $2, attempts = attempts + 1, last_error = NULL, sent_at = $3
+			WHERE id = $1`
+
+	if _, err := db.GetInstance().ExecContext(ctx, qry, messageID, StatusSent, time.Now()); err != nil {
+		logger.Errorf("Message:MarkSent() Couldn't mark email(%s) as sent: %s", messageID, err.Error())
+		dberr = db.FormError(err, qry, "email_outbox")
+		return
+	}
+	return
+}
+
+// MarkFailed records the failed attempt, the Message is retried at nextAttemptAt or,
+// if dead, it is dead-lettered and not retried anymore
+func MarkFailed(ctx context.Context, db database.Executor, messageID, lastError string, nextAttemptAt time.Time, dead bool) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	status := StatusPending
+	if dead {
+		status = StatusDead
+	}
+	qry := `UPDATE email_outbox SET status = $2, attempts = attempts + 1, last_error = $3, next_attempt_at = $4
+			WHERE id = $1`
+
+	if _, err := db.GetInstance().ExecContext(ctx, qry, messageID, status, lastError, nextAttemptAt); err != nil {
+		logger.Errorf("Message:MarkFailed() Couldn't mark email(%s) as failed: %s", messageID, err.Error())
+		dberr = db.FormError(err, qry, "email_outbox")
+		return
+	}
+	return
+}
+
+// getList runs the Messages SELECT qry
+func getList(ctx context.Context, db database.Executor, qry, reqID string, args ...interface{}) (messages Messages, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.GetInstance().QueryContext(ctx, qry, args...)
+	if err != nil {
+		logger.Errorf("%s:Error Getting list of outbox emails: %v", reqID, err)
+		dberr = db.FormError(err, qry, "email_outbox")
+		return
+	}
+
+	defer rows.Close()
+	messages = Messages{}
+	for rows.Next() {
+		var (
+			m             Message
+			nextAttemptAt time.Time
+			createdAt     time.Time
+			lastError     sql.NullString
+			sentAt        sql.NullTime
+		)
+		if err = rows.Scan(&m.ID, &m.To, &m.From, &m.Subject, &m.Type, &m.Body, &m.Status, &m.Attempts,
+			&nextAttemptAt, &lastError, &sentAt, &createdAt); err != nil {
+			logger.Errorf("%s:Error Scanning Row of outbox emails: %v", reqID, err)
+			dberr = db.FormError(err, qry, "email_outbox")
+			return
+		}
+		m.NextAttemptAt = nextAttemptAt.Unix()
+		m.CreatedAt = createdAt.Unix()
+		m.LastError = lastError.String
+		if sentAt.Valid {
+			m.SentAt = sentAt.Time.Unix()
+		}
+		messages = append(messages, m)
+	}
+	if err = rows.Err(); err != nil {
+		logger.Errorf("%s:Error Scanning in Row of outbox emails: %v", reqID, err)
+		dberr = db.FormError(err, qry, "email_outbox")
+		return
+	}
+	return
+}
@@ -0,0 +1,48 @@
+package outbox
+
+import (
+	"encoding/json"
+)
+
+// Status of a Message delivery
+type Status string
+
+const (
+	// StatusPending messages are delivered by the dispatcher once their next attempt is due
+	StatusPending = Status("pending")
+	// StatusSent messages were delivered
+	StatusSent = Status("sent")
+	// StatusDead messages failed every attempt and won't be retried
+	StatusDead = Status("dead")
+)
+
+// Message is an email written to the outbox in the same transaction as the change that triggers it,
+// the dispatcher delivers it afterwards so the email is sent if and only if the change is committed.
+// Body is not returned in the json since it can hold tokens (i.e. the confirmation link)
+type Message struct {
+	ID            string `json:"id"`
+	To            string `json:"to"`
+	From          string `json:"from"`
+	Subject       string `json:"subject"`
+	Type          string `json:"type"`
+	Body          string `json:"-"`
+	Status        Status `json:"status"`
+	Attempts      int    `json:"attempts"`
+	NextAttemptAt int64  `json:"next_attempt_at"`
+	LastError     string `json:"last_error,omitempty"`
+	SentAt        int64  `json:"sent_at,omitempty"`
+	CreatedAt     int64  `json:"created_at"`
+}
+
+// Messages is a slice of Message
+type Messages []Message
+
+// JSON returns the json bytes of the object
+func (m Message) JSON() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// JSON returns the json bytes of the object
+func (m Messages) JSON() ([]byte, error) {
+	return json.Marshal(m)
+}
@@ -0,0 +1,62 @@
+package resets
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Reset is a password reset request, its ID is the ID (jti) of the reset JWT sent by email
+type Reset struct {
+	ID        string `json:"id,omitempty"`
+	UserID    string `json:"user_id,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	UsedAt    int64  `json:"used_at,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// Request is the body to ask for a password reset email
+type Request struct {
+	Username string `json:"username"`
+}
+
+// JSON returns the json bytes of the object
+func (r Request) JSON() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// Valid validates that Request fields are correct
+func (r Request) Valid() error {
+	if len(r.Username) == 0 {
+		return errors.New("Missing 'username'")
+	}
+	return nil
+}
+
+// Decode takes data and Unmarshals it into itself
+func (r *Request) Decode(data []byte) error {
+	return json.Unmarshal(data, r)
+}
+
+// Password is the body to set the new password with a reset token
+type Password struct {
+	Password        string `json:"password"`
+	PasswordConfirm string `json:"password_confirm"`
+}
+
+// JSON returns the json bytes of the object
+func (p Password) JSON() ([]byte, error) {
+	return json.Marshal(p)
+}
+
+// Valid validates that Password fields are correct
+func (p Password) Valid() error {
+	if len(p.Password) == 0 {
+		return errors.New("Missing 'password'")
+	}
+	return nil
+}
+
+// Decode takes data and Unmarshals it into itself
+func (p *Password) Decode(data []byte) error {
+	return json.Unmarshal(data, p)
+}
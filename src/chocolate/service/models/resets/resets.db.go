@@ -0,0 +1,62 @@
+package resets
+
+import (
+	"context"
+	"time"
+
+	"chocolate/service/database"
+	"chocolate/service/shared/logger"
+)
+
+// Insert creates a Reset record in DB
+func (r *Reset) Insert(ctx context.Context, db database.Executor, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `INSERT INTO password_resets(id, user_id, expires_at) VALUES($1, $2, $3) RETURNING created_at`
+
+	var createdAt time.Time
+	err := db.GetInstance().QueryRowContext(ctx, qry, r.ID, r.UserID, time.Unix(r.ExpiresAt, 0)).Scan(&createdAt)
+	if err != nil {
+		logger.Errorf("%v:Reset:Insert() Couldn't insert new password reset: %s", reqID, err.Error())
+		dberr = db.FormError(err, qry, "password_resets")
+		return
+	}
+
+	r.CreatedAt = createdAt.Unix()
+	return
+}
+
+// Use marks the reset as used, it fails with database.ErrorNoRows
+// if the reset doesn't exist, was already used or is expired
+func Use(ctx context.Context, db database.Executor, resetID, userID, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `UPDATE password_resets SET used_at = current_timestamp
+			WHERE id = $1 AND user_id = $2 AND used_at IS NULL AND expires_at > current_timestamp
+			RETURNING id`
+
+	var id string
+	if err := db.GetInstance().QueryRowContext(ctx, qry, resetID, userID).Scan(&id); err != nil {
+		logger.Errorf("%v:Reset:Use() Couldn't use password reset(%s): %s", reqID, resetID, err.Error())
+		dberr = db.FormError(err, qry, "password_resets")
+		return
+	}
+	return
+}
+
+// Invalidate marks every pending reset of the user as used
+func Invalidate(ctx context.Context, db database.Executor, userID, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `UPDATE password_resets SET used_at = current_timestamp WHERE user_id = $1 AND used_at IS NULL`
+
+	if _, err := db.GetInstance().ExecContext(ctx, qry, userID); err != nil {
+		logger.Errorf("%v:Reset:Invalidate() Couldn't invalidate password resets: %s", reqID, err.Error())
+		dberr = db.FormError(err, qry, "password_resets")
+		return
+	}
+	return
+}
@@ -0,0 +1,174 @@
+package roles
+
+import (
+	"context"
+	"time"
+
+	"chocolate/service/database"
+	"chocolate/service/shared/logger"
+)
+
+// Save creates or updates the role replacing all of its permissions
+func (r *Role) Save(ctx context.Context, db database.Executor, reqID string) *database.Error {
+	return db.WithTx(ctx, func(tx *database.Tx) error {
+		return r.save(ctx, tx, reqID)
+	})
+}
+
+// save runs the queries of Save in a transaction
+func (r *Role) save(ctx context.Context, db database.Executor, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `INSERT INTO roles(name, description) VALUES($1, $2)
+			ON CONFLICT (name) DO UPDATE SET description = EXCLUDED.description
+			RETURNING created_at`
+
+	var createdAt time.Time
+	if err := db.GetInstance().QueryRowContext(ctx, qry, r.Name, r.Description).Scan(&createdAt); err != nil {
+		logger.Errorf("%v:Role:Save() Couldn't save role %s: %s", reqID, r.Name, err.Error())
+		dberr = db.FormError(err, qry, "roles")
+		return
+	}
+	r.CreatedAt = createdAt.Unix()
+
+	qry = `DELETE FROM role_permissions WHERE role = $1`
+	if _, err := db.GetInstance().ExecContext(ctx, qry, r.Name); err != nil {
+		logger.Errorf("%v:Role:Save() Couldn't delete role %s permissions: %s", reqID, r.Name, err.Error())
+		dberr = db.FormError(err, qry, "role_permissions")
+		return
+	}
+
+	qry = `INSERT INTO role_permissions(role, permission, scope) VALUES($1, $2, $3)`
+	for _, p := range r.Permissions {
+		if _, err := db.GetInstance().ExecContext(ctx, qry, r.Name, p.Permission, p.Scope); err != nil {
+			logger.Errorf("%v:Role:Save() Couldn't insert role %s permission %s: %s", reqID, r.Name, p.Permission, err.Error())
+			dberr = db.FormError(err, qry, "role_permissions")
+			return
+		}
+	}
+	return
+}
+
+// DeleteRole deletes the role, its permissions and its grants to users, it fails with database.ErrorNoRows if it doesn't exist
+func DeleteRole(ctx context.Context, db database.Executor, name, reqID string) *database.Error {
+	return db.WithTx(ctx, func(tx *database.Tx) error {
+		return deleteRole(ctx, tx, name, reqID)
+	})
+}
+
+// deleteRole runs the queries of DeleteRole in a transaction
+func deleteRole(ctx context.Context, db database.Executor, name, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `DELETE FROM roles WHERE name = $1 RETURNING name`
+
+	var deleted string
+	if err := db.GetInstance().QueryRowContext(ctx, qry, name).Scan(&deleted); err != nil {
+		logger.Errorf("%v:Role:DeleteRole() Couldn't delete role %s: %s", reqID, name, err.Error())
+		dberr = db.FormError(err, qry, "roles")
+		return
+	}
+
+	qry = `DELETE FROM user_roles WHERE role = $1`
+	if _, err := db.GetInstance().ExecContext(ctx, qry, name); err != nil {
+		logger.Errorf("%v:Role:DeleteRole() Couldn't delete role %s grants: %s", reqID, name, err.Error())
+		dberr = db.FormError(err, qry, "user_roles")
+		return
+	}
+	return
+}
+
+// GetRoles retrieves every role with its permissions
+func GetRoles(ctx context.Context, db database.Executor, reqID string) (roles Roles, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `SELECT r.name, r.description, r.created_at, p.permission, p.scope
+			FROM roles r LEFT JOIN role_permissions p ON p.role = r.name
+			ORDER BY r.name, p.permission`
+
+	rows, err := db.GetInstance().QueryContext(ctx, qry)
+	if err != nil {
+		logger.Errorf("%s:Error Getting list of roles: %v", reqID, err)
+		dberr = db.FormError(err, qry, "roles")
+		return
+	}
+
+	defer rows.Close()
+	roles = Roles{}
+	for rows.Next() {
+		var (
+			name, description string
+			createdAt         time.Time
+			permission, scope *string
+		)
+		if err = rows.Scan(&name, &description, &createdAt, &permission, &scope); err != nil {
+			logger.Errorf("%s:Error Scanning Row of roles: %v", reqID, err)
+			dberr = db.FormError(err, qry, "roles")
+			return
+		}
+		if len(roles) == 0 || roles[len(roles)-1].Name != name {
+			roles = append(roles, Role{Name: name, Description: description, CreatedAt: createdAt.Unix(), Permissions: []Permission{}})
+		}
+		if permission != nil {
+			role := &roles[len(roles)-1]
+			role.Permissions = append(role.Permissions, Permission{*permission, *scope})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		logger.Errorf("%s:Error Scanning in Row of roles: %v", reqID, err)
+		dberr = db.FormError(err, qry, "roles")
+		return
+	}
+	return
+}
+
+// Exists checks if the role is defined
+func Exists(ctx context.Context, db database.Executor, name, reqID string) (exists bool, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `SELECT EXISTS(SELECT 1 FROM roles WHERE name = $1)`
+
+	if err := db.GetInstance().QueryRowContext(ctx, qry, name).Scan(&exists); err != nil {
+		logger.Errorf("%v:Role:Exists() Couldn't check role %s: %s", reqID, name, err.Error())
+		dberr = db.FormError(err, qry, "roles")
+		return
+	}
+	return
+}
+
+// GetPermissions retrieves the permissions of the role as a permission -> scope map
+func GetPermissions(ctx context.Context, db database.Executor, role, reqID string) (permissions map[string]string, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `SELECT permission, scope FROM role_permissions WHERE role = $1`
+
+	rows, err := db.GetInstance().QueryContext(ctx, qry, role)
+	if err != nil {
+		logger.Errorf("%s:Error Getting role %s permissions: %v", reqID, role, err)
+		dberr = db.FormError(err, qry, "role_permissions")
+		return
+	}
+
+	defer rows.Close()
+	permissions = make(map[string]string)
+	for rows.Next() {
+		var permission, scope string
+		if err = rows.Scan(&permission, &scope); err != nil {
+			logger.Errorf("%s:Error Scanning Row of role permissions: %v", reqID, err)
+			dberr = db.FormError(err, qry, "role_permissions")
+			return
+		}
+		permissions[permission] = scope
+	}
+	if err = rows.Err(); err != nil {
+		logger.Errorf("%s:Error Scanning in Row of role permissions: %v", reqID, err)
+		dberr = db.FormError(err, qry, "role_permissions")
+		return
+	}
+	return
+}
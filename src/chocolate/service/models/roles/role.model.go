@@ -0,0 +1,83 @@
+package roles
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// UserRole is a role granted to a user on top of the "user" role every user has
+type UserRole struct {
+	UserID    string `json:"user_id"`
+	Role      string `json:"role"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// UserRoles is a slice of UserRole
+type UserRoles []UserRole
+
+// JSON returns the json bytes of the object
+func (r UserRole) JSON() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// JSON returns the json bytes of the object
+func (r UserRoles) JSON() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+const (
+	// ScopeAny grants the permission over any resource
+	ScopeAny = "any"
+	// ScopeOwn grants the permission only over the resources owned by the user
+	ScopeOwn = "own"
+)
+
+// Permission is a "resource:action" permission granted to a role with a scope
+type Permission struct {
+	Permission string `json:"permission"`
+	Scope      string `json:"scope"`
+}
+
+// Role is a DB defined set of permissions
+type Role struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Permissions []Permission `json:"permissions"`
+	CreatedAt   int64        `json:"created_at"`
+}
+
+// Roles is a slice of Role
+type Roles []Role
+
+// JSON returns the json bytes of the object
+func (r Role) JSON() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// Valid checks that the role is safe for DB
+func (r Role) Valid() error {
+	if len(r.Name) == 0 {
+		return errors.New("Missing 'name'")
+	}
+	for _, p := range r.Permissions {
+		if len(strings.Split(p.Permission, ":")) != 2 {
+			return fmt.Errorf("Permission %q is not in the 'resource:action' form", p.Permission)
+		}
+		if p.Scope != ScopeAny && p.Scope != ScopeOwn {
+			return fmt.Errorf("Permission %q has an invalid scope %q", p.Permission, p.Scope)
+		}
+	}
+	return nil
+}
+
+// Decode takes data and Unmarshals it into itself
+func (r *Role) Decode(data []byte) error {
+	return json.Unmarshal(data, r)
+}
+
+// JSON returns the json bytes of the object
+func (r Roles) JSON() ([]byte, error) {
+	return json.Marshal(r)
+}
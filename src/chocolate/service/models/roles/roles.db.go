@@ -0,0 +1,94 @@
+package roles
+
+import (
+	"context"
+	"time"
+
+	"chocolate/service/database"
+	"chocolate/service/shared/logger"
+)
+
+// Grant grants the role to the user, granting an already granted role is a no-op
+func (r *UserRole) Grant(ctx context.Context, db database.Executor, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `INSERT INTO user_roles(user_id, role) VALUES($1, $2)
+			ON CONFLICT (user_id, role) DO UPDATE SET role = EXCLUDED.role
+			RETURNING created_at`
+
+	var createdAt time.Time
+	if err := db.GetInstance().QueryRowContext(ctx, qry, r.UserID, r.Role).Scan(&createdAt); err != nil {
+		logger.Errorf("%v:UserRole:Grant() Couldn't grant role %s to user(%s): %s", reqID, r.Role, r.UserID, err.Error())
+		dberr = db.FormError(err, qry, "user_roles")
+		return
+	}
+	r.CreatedAt = createdAt.Unix()
+	return
+}
+
+// Revoke revokes the role from the user, it fails with database.ErrorNoRows if the user didn't have it
+func Revoke(ctx context.Context, db database.Executor, userID, role, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `DELETE FROM user_roles WHERE user_id = $1 AND role = $2 RETURNING role`
+
+	var deleted string
+	if err := db.GetInstance().QueryRowContext(ctx, qry, userID, role).Scan(&deleted); err != nil {
+		logger.Errorf("%v:UserRole:Revoke() Couldn't revoke role %s from user(%s): %s", reqID, role, userID, err.Error())
+		dberr = db.FormError(err, qry, "user_roles")
+		return
+	}
+	return
+}
+
+// HasRole checks if the role was granted to the user
+func HasRole(ctx context.Context, db database.Executor, userID, role, reqID string) (granted bool, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `SELECT EXISTS(SELECT 1 FROM user_roles WHERE user_id = $1 AND role = $2)`
+
+	if err := db.GetInstance().QueryRowContext(ctx, qry, userID, role).Scan(&granted); err != nil {
+		logger.Errorf("%v:UserRole:HasRole() Couldn't check role %s of user(%s): %s", reqID, role, userID, err.Error())
+		dberr = db.FormError(err, qry, "user_roles")
+		return
+	}
+	return
+}
+
+// GetUserRoles retrieves the roles granted to the user
+func GetUserRoles(ctx context.Context, db database.Executor, userID, reqID string) (userRoles UserRoles, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `SELECT user_id, role, created_at FROM user_roles WHERE user_id = $1 ORDER BY role`
+
+	rows, err := db.GetInstance().QueryContext(ctx, qry, userID)
+	if err != nil {
+		logger.Errorf("%s:Error Getting list of user roles: %v", reqID, err)
+		dberr = db.FormError(err, qry, "user_roles")
+		return
+	}
+
+	defer rows.Close()
+	userRoles = UserRoles{}
+	for rows.Next() {
+		r := UserRole{}
+		var createdAt time.Time
+		if err = rows.Scan(&r.UserID, &r.Role, &createdAt); err != nil {
+			logger.Errorf("%s:Error Scanning Row of user roles: %v", reqID, err)
+			dberr = db.FormError(err, qry, "user_roles")
+			return
+		}
+		r.CreatedAt = createdAt.Unix()
+		userRoles = append(userRoles, r)
+	}
+	if err = rows.Err(); err != nil {
+		logger.Errorf("%s:Error Scanning in Row of user roles: %v", reqID, err)
+		dberr = db.FormError(err, qry, "user_roles")
+		return
+	}
+	return
+}
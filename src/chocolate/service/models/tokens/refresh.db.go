@@ -0,0 +1,187 @@
+package tokens
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"chocolate/service/database"
+	"chocolate/service/shared/logger"
+)
+
+// Insert creates a Refresh record in DB
+func (rt *Refresh) Insert(ctx context.Context, db database.Executor, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `INSERT INTO refresh_tokens(id, family_id, user_id, access_id, expires_at)
+			VALUES($1, $2, $3, $4, $5) RETURNING created_at`
+
+	var createdAt time.Time
+	err := db.GetInstance().QueryRowContext(ctx, qry, rt.ID, rt.FamilyID, rt.UserID, rt.AccessID,
+		time.Unix(rt.ExpiresAt, 0)).Scan(&createdAt)
+	if err != nil {
+		logger.Errorf("%v:Refresh:Insert() Couldn't insert refresh token: %s", reqID, err.Error())
+		dberr = db.FormError(err, qry, "refresh_tokens")
+		return
+	}
+
+	rt.CreatedAt = createdAt.Unix()
+	return
+}
+
+// GetRefresh gets a Refresh by ID
+func GetRefresh(ctx context.Context, db database.Executor, refreshID, reqID string) (rt Refresh, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `SELECT id, family_id, user_id, access_id, expires_at, used_at, revoked_at, created_at
+			FROM refresh_tokens WHERE id = $1`
+
+	var (
+		expiresAt, createdAt time.Time
+		usedAt, revokedAt    sql.NullTime
+	)
+	err := db.GetInstance().QueryRowContext(ctx, qry, refreshID).Scan(&rt.ID, &rt.FamilyID, &rt.UserID, &rt.AccessID,
+		&expiresAt, &usedAt, &revokedAt, &createdAt)
+	if err != nil {
+		logger.Errorf("%v:Refresh:GetRefresh() Couldn't get refresh token(%s): %s", reqID, refreshID, err.Error())
+		dberr = db.FormError(err, qry, "refresh_tokens")
+		return
+	}
+
+	rt.ExpiresAt = expiresAt.Unix()
+	rt.CreatedAt = createdAt.Unix()
+	if usedAt.Valid {
+		rt.UsedAt = usedAt.Time.Unix()
+	}
+	if revokedAt.Valid {
+		rt.RevokedAt = revokedAt.Time.Unix()
+	}
+	return
+}
+
+// UseRefresh marks the refresh token as used, it fails with database.ErrorNoRows
+// if the token doesn't exist, was already used or was revoked
+func UseRefresh(ctx context.Context, db database.Executor, refreshID, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `UPDATE refresh_tokens SET used_at = current_timestamp
+			WHERE id = $1 AND used_at IS NULL AND revoked_at IS NULL
+			RETURNING id`
+
+	var id string
+	if err := db.GetInstance().QueryRowContext(ctx, qry, refreshID).Scan(&id); err != nil {
+		logger.Errorf("%v:Refresh:UseRefresh() Couldn't use refresh token(%s): %s", reqID, refreshID, err.Error())
+		dberr = db.FormError(err, qry, "refresh_tokens")
+		return
+	}
+	return
+}
+
+// RevokeFamily revokes every refresh token of the user family, it returns how many were revoked
+// (none if the family doesn't exist, is another user's or was already revoked)
+func RevokeFamily(ctx context.Context, db database.Executor, familyID, userID, reqID string) (revoked int64, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	logger.Debugf("Refresh RevokeFamily ID: %s", familyID)
+
+	qry := `UPDATE refresh_tokens SET revoked_at = current_timestamp
+			WHERE family_id = $1 AND user_id = $2 AND revoked_at IS NULL`
+
+	res, err := db.GetInstance().ExecContext(ctx, qry, familyID, userID)
+	if err != nil {
+		logger.Errorf("%v:Refresh:RevokeFamily() Couldn't revoke family: %s", reqID, err.Error())
+		dberr = db.FormError(err, qry, "refresh_tokens")
+		return
+	}
+	revoked, _ = res.RowsAffected()
+	return
+}
+
+// RevokeOtherFamilies revokes every refresh token of the user but the ones of the familyID family,
+// with an empty familyID every family is revoked
+func RevokeOtherFamilies(ctx context.Context, db database.Executor, userID, familyID, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	logger.Debugf("Refresh RevokeOtherFamilies user ID: %s", userID)
+
+	qry := `UPDATE refresh_tokens SET revoked_at = current_timestamp
+			WHERE user_id = $1 AND family_id <> $2 AND revoked_at IS NULL`
+	args := []interface{}{userID, familyID}
+	// Tokens issued before the families existed have none, family_id is an uuid so '' can't be compared
+	if familyID == "" {
+		qry = `UPDATE refresh_tokens SET revoked_at = current_timestamp
+			WHERE user_id = $1 AND revoked_at IS NULL`
+		args = args[:1]
+	}
+
+	if _, err := db.GetInstance().ExecContext(ctx, qry, args...); err != nil {
+		logger.Errorf("%v:Refresh:RevokeOtherFamilies() Couldn't revoke families: %s", reqID, err.Error())
+		dberr = db.FormError(err, qry, "refresh_tokens")
+		return
+	}
+	return
+}
+
+// IsFamilyRevoked checks if the refresh token family was revoked
+func IsFamilyRevoked(ctx context.Context, db database.Executor, familyID, reqID string) (revoked bool, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `SELECT EXISTS(SELECT 1 FROM refresh_tokens WHERE family_id = $1 AND revoked_at IS NOT NULL)`
+
+	if err := db.GetInstance().QueryRowContext(ctx, qry, familyID).Scan(&revoked); err != nil {
+		logger.Errorf("%v:Refresh:IsFamilyRevoked() Couldn't check family(%s): %s", reqID, familyID, err.Error())
+		dberr = db.FormError(err, qry, "refresh_tokens")
+		return
+	}
+	return
+}
+
+// GetFamilies retrieves the refresh token families (sessions) of the user
+func GetFamilies(ctx context.Context, db database.Executor, userID, reqID string) (families Families, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `SELECT family_id, min(created_at), max(created_at), max(expires_at), max(revoked_at)
+			FROM refresh_tokens WHERE user_id = $1
+			GROUP BY family_id ORDER BY max(created_at) DESC`
+
+	rows, err := db.GetInstance().QueryContext(ctx, qry, userID)
+	if err != nil {
+		logger.Errorf("%s:Error Getting list of refresh families: %v", reqID, err)
+		dberr = db.FormError(err, qry, "refresh_tokens")
+		return
+	}
+
+	defer rows.Close()
+	families = Families{}
+	for rows.Next() {
+		f := Family{UserID: userID}
+		// Aggregated timestamps don't have a column type SQLite can convert them by
+		var createdAt, lastUsedAt, expiresAt, revokedAt database.NullTime
+		if err = rows.Scan(&f.ID, &createdAt, &lastUsedAt, &expiresAt, &revokedAt); err != nil {
+			logger.Errorf("%s:Error Scanning Row of refresh families: %v", reqID, err)
+			dberr = db.FormError(err, qry, "refresh_tokens")
+			return
+		}
+		f.CreatedAt = createdAt.Time.Unix()
+		f.LastUsedAt = lastUsedAt.Time.Unix()
+		f.ExpiresAt = expiresAt.Time.Unix()
+		if revokedAt.Valid {
+			f.RevokedAt = revokedAt.Time.Unix()
+		}
+		families = append(families, f)
+	}
+	if err = rows.Err(); err != nil {
+		logger.Errorf("%s:Error Scanning in Row of refresh families: %v", reqID, err)
+		dberr = db.FormError(err, qry, "refresh_tokens")
+		return
+	}
+
+	return
+}
@@ -0,0 +1,41 @@
+package tokens
+
+import (
+	"encoding/json"
+)
+
+// Refresh is an issued refresh token, every refresh token belongs to a family that starts
+// on login and is rotated on every refresh. Its ID is the ID (jti) of the refresh JWT
+type Refresh struct {
+	ID        string `json:"id"`
+	FamilyID  string `json:"family_id"`
+	UserID    string `json:"user_id"`
+	AccessID  string `json:"access_id"`
+	ExpiresAt int64  `json:"expires_at"`
+	UsedAt    int64  `json:"used_at,omitempty"`
+	RevokedAt int64  `json:"revoked_at,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// Family describes a refresh token family, i.e. a user session
+type Family struct {
+	ID         string `json:"id"`
+	UserID     string `json:"user_id"`
+	CreatedAt  int64  `json:"created_at"`
+	LastUsedAt int64  `json:"last_used_at"`
+	ExpiresAt  int64  `json:"expires_at"`
+	RevokedAt  int64  `json:"revoked_at,omitempty"`
+}
+
+// Families is a slice of Family
+type Families []Family
+
+// JSON returns the json bytes of the object
+func (f Family) JSON() ([]byte, error) {
+	return json.Marshal(f)
+}
+
+// JSON returns the json bytes of the object
+func (f Families) JSON() ([]byte, error) {
+	return json.Marshal(f)
+}
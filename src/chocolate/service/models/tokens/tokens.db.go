@@ -0,0 +1,79 @@
+package tokens
+
+import (
+	"context"
+	"time"
+
+	"chocolate/service/database"
+	"chocolate/service/shared/logger"
+)
+
+// Revoke blacklists the token ID (jti) until it expires
+func Revoke(ctx context.Context, db database.Executor, tokenID, userID string, expiresAt int64, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	logger.Debugf("Token Revoke ID: %s", tokenID)
+
+	qry := `INSERT INTO revoked_tokens(id, user_id, expires_at) VALUES($1, $2, $3) ON CONFLICT (id) DO NOTHING`
+
+	if _, err := db.GetInstance().ExecContext(ctx, qry, tokenID, userID, time.Unix(expiresAt, 0)); err != nil {
+		logger.Errorf("%v:Token:Revoke() Couldn't revoke token: %s", reqID, err.Error())
+		dberr = db.FormError(err, qry, "revoked_tokens")
+		return
+	}
+	return
+}
+
+// IsRevoked checks if the token ID (jti) was blacklisted
+func IsRevoked(ctx context.Context, db database.Executor, tokenID, reqID string) (revoked bool, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE id = $1)`
+
+	if err := db.GetInstance().QueryRowContext(ctx, qry, tokenID).Scan(&revoked); err != nil {
+		logger.Errorf("%v:Token:IsRevoked() Couldn't check token(%s): %s", reqID, tokenID, err.Error())
+		dberr = db.FormError(err, qry, "revoked_tokens")
+		return
+	}
+	return
+}
+
+// Prune deletes the revoked and refresh tokens that already expired, as they would be rejected anyway,
+// and the failures counted to the expired mfa challenges
+func Prune(ctx context.Context, db database.Executor) (pruned int64, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	tables := []string{"revoked_tokens", "refresh_tokens", "mfa_challenge_failures"}
+	for _, table := range tables {
+		qry := `DELETE FROM ` + table + ` WHERE expires_at < current_timestamp`
+
+		res, err := db.GetInstance().ExecContext(ctx, qry)
+		if err != nil {
+			logger.Errorf("Token:Prune() Couldn't prune %s: %s", table, err.Error())
+			dberr = db.FormError(err, qry, table)
+			return
+		}
+		affected, _ := res.RowsAffected()
+		pruned += affected
+	}
+	return
+}
+
+// PruneEvery runs Prune every interval until done is closed
+func PruneEvery(db database.Executor, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if pruned, dberr := Prune(context.Background(), db); dberr == nil {
+				logger.Debugf("Token:PruneEvery() pruned %d expired tokens", pruned)
+			}
+		}
+	}
+}
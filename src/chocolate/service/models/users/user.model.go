@@ -16,6 +16,8 @@ type User struct {
 	// Was Email confirmed?
 	Confirmed   bool  `json:"confirmed,omitempty"`
 	ConfirmedAt int64 `json:"confirmed_at,omitempty"`
+	// Locale the emails and pages are shown in (i.e. "es" or "en-US")
+	Locale string `json:"locale,omitempty"`
 	// Personal Info
 	// Names          string `json:"names,omitempty"`
 	// FirstLastName  string `json:"first_last_name,omitempty"`
@@ -77,3 +79,35 @@ func (c Users) Valid() (err error) {
 func (c *Users) Decode(data []byte) (err error) {
 	return json.Unmarshal(data, c)
 }
+
+/**
+ * PasswordChange Type Functions
+ */
+
+// PasswordChange is the body to change the password of a logged in user
+type PasswordChange struct {
+	CurrentPassword string `json:"current_password"`
+	Password        string `json:"password"`
+	PasswordConfirm string `json:"password_confirm"`
+}
+
+// JSON returns the json bytes of the object
+func (p PasswordChange) JSON() ([]byte, error) {
+	return json.Marshal(p)
+}
+
+// Valid validates that PasswordChange fields are correct
+func (p PasswordChange) Valid() error {
+	if len(p.CurrentPassword) == 0 {
+		return errors.New("Missing 'current_password'")
+	}
+	if len(p.Password) == 0 {
+		return errors.New("Missing 'password'")
+	}
+	return nil
+}
+
+// Decode takes data and Unmarshals it into itself
+func (p *PasswordChange) Decode(data []byte) error {
+	return json.Unmarshal(data, p)
+}
@@ -1,62 +1,25 @@
 package users
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"time"
 
 	"chocolate/service/database"
 	"chocolate/service/shared/logger"
+	"chocolate/service/shared/utils/uuid"
 )
 
 const (
-	qryAll     = `id, username, password, salt, confirmed, confirmed_at, created_at`
-	qryAllSafe = `id, username, confirmed, confirmed_at, created_at`
-
-	qryCreateTable = `CREATE TABLE IF NOT EXISTS users (
-		id uuid PRIMARY KEY NOT NULL DEFAULT uuid_generate_v4(),
-		username text NOT NULL UNIQUE,
-		password text NOT NULL, 
-		salt text NOT NULL, 
-		confirmed boolean NOT NULL DEFAULT FALSE,
-		confirmation_date timestamp with time zone,
-		created_at timestamp with time zone DEFAULT current_timestamp
-	)`
+	qryAll     = `id, username, password, salt, confirmed, confirmed_at, locale, created_at`
+	qryAllSafe = `id, username, confirmed, confirmed_at, locale, created_at`
 )
 
-type userTable struct{}
-
-func (t userTable) Create(db *database.DB) *database.Error {
-	logger.Debug("models/userTable:Create() exec qry")
-	// Exec executes a query without returning any rows.
-	if _, err := db.GetInstance().Exec(qryCreateTable); err != nil {
-		logger.Errorf("models/users:createTable() Users table creation query failed %s", err.Error())
-		return db.FormError(err, qryCreateTable, "users")
-	}
-	// Add Unique Email Index create unique index users_unique_lower_email_idx on users (lower(email));
-	const indexQry = `CREATE UNIQUE INDEX IF NOT EXISTS users_unique_username_idx on users(lower(username))`
-	logger.Debug("models/userTable:Create() exec index qry")
-	// Exec executes a query without returning any rows.
-	if _, err := db.GetInstance().Exec(indexQry); err != nil {
-		logger.Errorf("models/users:createTable() Users table unique index creation failed %s", err.Error())
-		// should we delete the table?
-		return db.FormError(err, indexQry, "users")
-	}
-
-	return nil
-}
-
-func (t userTable) Name() string {
-	return "users"
-}
-
-// GetTable returns the Model Table struct which is used to create the necessary db tables for the Model
-func GetTable() database.Table {
-	return userTable{}
-}
-
 // GetBy gets a User by field and value
-func GetBy(db *database.DB, field string, value interface{}, reqID string) (u User, dberr *database.Error) {
+func GetBy(ctx context.Context, db database.Executor, field string, value interface{}, reqID string) (u User, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
 
 	qry := fmt.Sprintf(`SELECT %s FROM users WHERE %s = $1`, qryAll, field)
 
@@ -68,7 +31,7 @@ func GetBy(db *database.DB, field string, value interface{}, reqID string) (u Us
 	// was successfull but returned 0 rows with `if err == sql.ErrNoRows`.
 	var createdAt time.Time
 	u = User{}
-	row := db.GetInstance().QueryRow(qry, value)
+	row := db.GetInstance().QueryRowContext(ctx, qry, value)
 	err := scanAll(row, &u)
 
 	if err != nil {
@@ -82,7 +45,9 @@ func GetBy(db *database.DB, field string, value interface{}, reqID string) (u Us
 }
 
 // GetByID gets a User by ID
-func GetByID(db *database.DB, userID, reqID string) (u User, dberr *database.Error) {
+func GetByID(ctx context.Context, db database.Executor, userID, reqID string) (u User, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
 
 	qry := fmt.Sprintf(`SELECT %s FROM users WHERE id = $1`, qryAllSafe)
 
@@ -94,7 +59,7 @@ func GetByID(db *database.DB, userID, reqID string) (u User, dberr *database.Err
 	// was successfull but returned 0 rows with `if err == sql.ErrNoRows`.
 	var createdAt time.Time
 	u = User{}
-	row := db.GetInstance().QueryRow(qry, userID)
+	row := db.GetInstance().QueryRowContext(ctx, qry, userID)
 	err := scanAllSafe(row, &u)
 
 	if err != nil {
@@ -108,11 +73,13 @@ func GetByID(db *database.DB, userID, reqID string) (u User, dberr *database.Err
 }
 
 // GetList retrieves the list of Users
-func GetList(db *database.DB, reqID string) (users Users, dberr *database.Error) {
+func GetList(ctx context.Context, db database.Executor, reqID string) (users Users, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
 
 	qry := fmt.Sprintf(`SELECT %s FROM users`, qryAllSafe)
 
-	rows, err := db.GetInstance().Query(qry)
+	rows, err := db.GetInstance().QueryContext(ctx, qry)
 	if err != nil {
 		logger.Errorf("%s:Error Getting list of users: %v", reqID, err)
 		dberr = db.FormError(err, qry, "users")
@@ -123,7 +90,7 @@ func GetList(db *database.DB, reqID string) (users Users, dberr *database.Error)
 	for rows.Next() {
 		u := User{}
 		var createdAt, confirmedAt time.Time
-		if err = rows.Scan(&u.ID, &u.Username, &u.Confirmed, &confirmedAt, &createdAt); err != nil {
+		if err = rows.Scan(&u.ID, &u.Username, &u.Confirmed, &confirmedAt, &u.Locale, &createdAt); err != nil {
 			logger.Errorf("%s:Error Scanning Row of users: %v", reqID, err)
 			dberr = db.FormError(err, qry, "users")
 			return
@@ -144,10 +111,20 @@ func GetList(db *database.DB, reqID string) (users Users, dberr *database.Error)
 }
 
 // Insert creates a User record in DB
-func (u *User) Insert(db *database.DB, reqID string) (dberr *database.Error) {
+func (u *User) Insert(ctx context.Context, db database.Executor, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
 
-	qry := `INSERT INTO users(username, password, salt, confirmed, confirmed_at) 
-			VALUES($1, $2, $3, $4, $5) RETURNING id, created_at`
+	qry := `INSERT INTO users(id, username, password, salt, confirmed, confirmed_at, locale) 
+			VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING created_at`
+
+	// The ID is generated here and not by the DB so it doesn't depend on postgres uuid-ossp
+	id, err := uuid.New()
+	if err != nil {
+		logger.Errorf("%v:User:Insert() Couldn't generate user id: %s", reqID, err.Error())
+		dberr = db.FormError(err, qry, "users")
+		return
+	}
 
 	// `QueryRow` is a single-row query that, unlike `Query()`, doesn't hold a connection.
 	// Errors from `QueryRow` are forwarded to `Scan` where we can get errors from both.
@@ -159,7 +136,7 @@ func (u *User) Insert(db *database.DB, reqID string) (dberr *database.Error) {
 	if u.ConfirmedAt > 0 {
 		confirmedAt = time.Unix(u.ConfirmedAt, 0)
 	}
-	err := db.GetInstance().QueryRow(qry, u.Username, u.Password, u.Salt, u.Confirmed, confirmedAt).Scan(&u.ID, &createdAt)
+	err = db.GetInstance().QueryRowContext(ctx, qry, id, u.Username, u.Password, u.Salt, u.Confirmed, confirmedAt, u.Locale).Scan(&createdAt)
 
 	if err != nil {
 		logger.Errorf("%v:User:Insert() Couldn't insert new user: %s", reqID, err.Error())
@@ -167,6 +144,7 @@ func (u *User) Insert(db *database.DB, reqID string) (dberr *database.Error) {
 		return
 	}
 
+	u.ID = id
 	u.CreatedAt = createdAt.Unix()
 	u.Password = ""
 	u.PasswordConfirm = ""
@@ -175,10 +153,12 @@ func (u *User) Insert(db *database.DB, reqID string) (dberr *database.Error) {
 }
 
 // Update updates current user fields
-func (u *User) Update(db *database.DB, reqID string) (dberr *database.Error) {
+func (u *User) Update(ctx context.Context, db database.Executor, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
 
 	qry := `UPDATE users SET confirmed = $2,  confirmed_at = $3 WHERE id = $1 
-			RETURNING id, username, confirmed, confirmed_at, created_at`
+			RETURNING id, username, confirmed, confirmed_at, locale, created_at`
 	if u.ID == "" {
 		dberr = database.NewError(database.ErrorModelInvalid, "Missing ID value", qry, "users", nil)
 		return
@@ -195,7 +175,7 @@ func (u *User) Update(db *database.DB, reqID string) (dberr *database.Error) {
 	} else {
 		confirmedAt = time.Now()
 	}
-	err := db.GetInstance().QueryRow(qry, u.ID, u.Confirmed, confirmedAt).Scan(&u.ID, &u.Username, &u.Confirmed, &confirmedAt, &createdAt)
+	err := db.GetInstance().QueryRowContext(ctx, qry, u.ID, u.Confirmed, confirmedAt).Scan(&u.ID, &u.Username, &u.Confirmed, &confirmedAt, &u.Locale, &createdAt)
 
 	if err != nil {
 		logger.Errorf("%v:User:Update() Couldn't update user: %s", reqID, err.Error())
@@ -214,13 +194,16 @@ func (u *User) Update(db *database.DB, reqID string) (dberr *database.Error) {
 }
 
 // Delete deletes a user by ID
-func Delete(db *database.DB, userID, reqID string) (dberr *database.Error) {
+func Delete(ctx context.Context, db database.Executor, userID, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
 	logger.Debugf("User Delete ID: %s", userID)
 
 	// id should always be first($1)!!!
 	qry := `DELETE FROM users  WHERE id = $1`
 
-	if _, err := db.GetInstance().Exec(qry, userID); err != nil {
+	if _, err := db.GetInstance().ExecContext(ctx, qry, userID); err != nil {
 		logger.Errorf("%v:User:Delete() Couldn't delete user: %s", reqID, err.Error())
 		dberr = db.FormError(err, qry, "users")
 		return
@@ -229,10 +212,86 @@ func Delete(db *database.DB, userID, reqID string) (dberr *database.Error) {
 	return
 }
 
+// UpdatePassword replaces the user password hash and salt
+func UpdatePassword(ctx context.Context, db database.Executor, userID, hash, salt, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	logger.Debugf("User UpdatePassword ID: %s", userID)
+
+	qry := `UPDATE users SET password = $2, salt = $3 WHERE id = $1 RETURNING id`
+
+	var id string
+	if err := db.GetInstance().QueryRowContext(ctx, qry, userID, hash, salt).Scan(&id); err != nil {
+		logger.Errorf("%v:User:UpdatePassword() Couldn't update user password: %s", reqID, err.Error())
+		dberr = db.FormError(err, qry, "users")
+		return
+	}
+
+	return
+}
+
+// UpdateUsername replaces the user username (email) with one the user proved to own, so it is confirmed
+func UpdateUsername(ctx context.Context, db database.Executor, userID, username, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	logger.Debugf("User UpdateUsername ID: %s", userID)
+
+	qry := `UPDATE users SET username = $2, confirmed = $3, confirmed_at = $4 WHERE id = $1 RETURNING id`
+
+	var id string
+	if err := db.GetInstance().QueryRowContext(ctx, qry, userID, username, true, time.Now()).Scan(&id); err != nil {
+		logger.Errorf("%v:User:UpdateUsername() Couldn't update user username: %s", reqID, err.Error())
+		dberr = db.FormError(err, qry, "users")
+		return
+	}
+
+	return
+}
+
+// RevokeTokens invalidates every token issued to the user up until now
+func RevokeTokens(ctx context.Context, db database.Executor, userID, reqID string) (dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	logger.Debugf("User RevokeTokens ID: %s", userID)
+
+	// The time is taken here as SQLite current_timestamp has no fractional seconds
+	qry := `UPDATE users SET tokens_revoked_at = $2 WHERE id = $1`
+
+	if _, err := db.GetInstance().ExecContext(ctx, qry, userID, time.Now()); err != nil {
+		logger.Errorf("%v:User:RevokeTokens() Couldn't revoke user tokens: %s", reqID, err.Error())
+		dberr = db.FormError(err, qry, "users")
+		return
+	}
+
+	return
+}
+
+// TokensRevokedAt returns the epoch in milliseconds since which the user tokens are no longer valid, 0 if never revoked
+func TokensRevokedAt(ctx context.Context, db database.Executor, userID, reqID string) (revokedAt int64, dberr *database.Error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+
+	qry := `SELECT tokens_revoked_at FROM users WHERE id = $1`
+
+	var t sql.NullTime
+	if err := db.GetInstance().QueryRowContext(ctx, qry, userID).Scan(&t); err != nil {
+		logger.Errorf("%v:User:TokensRevokedAt() Couldn't get user(%s): %s", reqID, userID, err.Error())
+		dberr = db.FormError(err, qry, "users")
+		return
+	}
+	if t.Valid {
+		revokedAt = t.Time.UnixNano() / int64(time.Millisecond)
+	}
+	return
+}
+
 // scanAll scans a full row with all its columns into a user
 func scanAll(row *sql.Row, u *User) error {
 	var createdAt, confirmedAt time.Time
-	err := row.Scan(&u.ID, &u.Username, &u.Password, &u.Salt, &u.Confirmed, &confirmedAt, &createdAt)
+	err := row.Scan(&u.ID, &u.Username, &u.Password, &u.Salt, &u.Confirmed, &confirmedAt, &u.Locale, &createdAt)
 	if err != nil {
 		return err
 	}
@@ -246,7 +305,7 @@ func scanAll(row *sql.Row, u *User) error {
 // scanAllSafe scans a full row with all its columns into a user (except password related stuff)
 func scanAllSafe(row *sql.Row, u *User) error {
 	var createdAt, confirmedAt time.Time
-	err := row.Scan(&u.ID, &u.Username, &u.Confirmed, &confirmedAt, &createdAt)
+	err := row.Scan(&u.ID, &u.Username, &u.Confirmed, &confirmedAt, &u.Locale, &createdAt)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,378 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chocolate/service/database"
+	"chocolate/service/shared/logger"
+	"chocolate/service/shared/utils/uuid"
+
+	gouuid "github.com/satori/go.uuid"
+)
+
+// UserRepository persists the Users, implementations return the same *database.Error
+// codes DB.FormError does so handlers don't depend on the storage
+type UserRepository interface {
+	// GetBy gets a User with all its fields (password and salt included) by field and value
+	GetBy(ctx context.Context, field string, value interface{}, reqID string) (User, *database.Error)
+	// GetByID gets a User by ID without password related fields
+	GetByID(ctx context.Context, userID, reqID string) (User, *database.Error)
+	// GetList retrieves the list of Users without password related fields
+	GetList(ctx context.Context, reqID string) (Users, *database.Error)
+	// Insert creates the User setting its ID and CreatedAt
+	Insert(ctx context.Context, u *User, reqID string) *database.Error
+	// Update updates the User confirmation fields, database.ErrorNoRows if it doesn't exist
+	Update(ctx context.Context, u *User, reqID string) *database.Error
+	// UpdatePassword replaces the User password hash and salt, database.ErrorNoRows if it doesn't exist
+	UpdatePassword(ctx context.Context, userID, hash, salt, reqID string) *database.Error
+	// UpdateUsername replaces the User username with a confirmed one, database.ErrorNoRows if it doesn't exist
+	// and database.ErrorAlreadyExists if another user has it
+	UpdateUsername(ctx context.Context, userID, username, reqID string) *database.Error
+	// Delete deletes a User by ID, deleting a user that doesn't exist is not an error
+	Delete(ctx context.Context, userID, reqID string) *database.Error
+	// WithExecutor returns the repository running its queries in db, i.e. a transaction,
+	// the repositories that aren't backed by the DB return themselves
+	WithExecutor(db database.Executor) UserRepository
+}
+
+// PostgresRepository is the UserRepository backed by the service DB
+type PostgresRepository struct {
+	db database.Executor
+}
+
+// NewPostgresRepository creates a UserRepository using db
+func NewPostgresRepository(db database.Executor) *PostgresRepository {
+	return &PostgresRepository{db: db}
+}
+
+// GetBy gets a User by field and value
+func (p *PostgresRepository) GetBy(ctx context.Context, field string, value interface{}, reqID string) (User, *database.Error) {
+	return GetBy(ctx, p.db, field, value, reqID)
+}
+
+// GetByID gets a User by ID
+func (p *PostgresRepository) GetByID(ctx context.Context, userID, reqID string) (User, *database.Error) {
+	return GetByID(ctx, p.db, userID, reqID)
+}
+
+// GetList retrieves the list of Users
+func (p *PostgresRepository) GetList(ctx context.Context, reqID string) (Users, *database.Error) {
+	return GetList(ctx, p.db, reqID)
+}
+
+// Insert creates a User record in DB
+func (p *PostgresRepository) Insert(ctx context.Context, u *User, reqID string) *database.Error {
+	return u.Insert(ctx, p.db, reqID)
+}
+
+// Update updates current user fields
+func (p *PostgresRepository) Update(ctx context.Context, u *User, reqID string) *database.Error {
+	return u.Update(ctx, p.db, reqID)
+}
+
+// UpdatePassword replaces the user password
+func (p *PostgresRepository) UpdatePassword(ctx context.Context, userID, hash, salt, reqID string) *database.Error {
+	return UpdatePassword(ctx, p.db, userID, hash, salt, reqID)
+}
+
+// UpdateUsername replaces the user username
+func (p *PostgresRepository) UpdateUsername(ctx context.Context, userID, username, reqID string) *database.Error {
+	return UpdateUsername(ctx, p.db, userID, username, reqID)
+}
+
+// Delete deletes a user by ID
+func (p *PostgresRepository) Delete(ctx context.Context, userID, reqID string) *database.Error {
+	return Delete(ctx, p.db, userID, reqID)
+}
+
+// WithExecutor returns a PostgresRepository running its queries in db
+func (p *PostgresRepository) WithExecutor(db database.Executor) UserRepository {
+	return NewPostgresRepository(db)
+}
+
+// MemoryRepository is a UserRepository kept in memory, meant for tests and local development.
+// In a transaction the writes are kept in a view of the repository and applied when it commits,
+// so they are lost if it rolls back. Like with the rows a transaction doesn't lock, the last commit wins
+type MemoryRepository struct {
+	mu    sync.RWMutex
+	users map[string]User
+	// txs are the views of the open transactions
+	txs map[*database.Tx]*MemoryRepository
+	// dirty has the IDs of the users written in a transaction view, it is nil out of one
+	dirty map[string]bool
+}
+
+// NewMemoryRepository creates an empty in memory UserRepository
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{users: make(map[string]User), txs: make(map[*database.Tx]*MemoryRepository)}
+}
+
+// GetBy gets a User by field and value, only the users table columns are valid fields
+func (m *MemoryRepository) GetBy(ctx context.Context, field string, value interface{}, reqID string) (u User, dberr *database.Error) {
+	qry := fmt.Sprintf(`SELECT %s FROM users WHERE %s = $1`, qryAll, field)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var match func(User) bool
+	switch field {
+	case "id":
+		id := fmt.Sprint(value)
+		if dberr = validUUID(id, qry); dberr != nil {
+			return
+		}
+		match = func(u User) bool { return u.ID == id }
+	case "username":
+		match = func(u User) bool { return u.Username == fmt.Sprint(value) }
+	case "confirmed":
+		match = func(u User) bool { return fmt.Sprint(u.Confirmed) == fmt.Sprint(value) }
+	default:
+		logger.Errorf("%v:MemoryRepository:GetBy() Unknown field = '%s'", reqID, field)
+		dberr = database.NewError(database.ErrorExecute, "Error executing query", qry, "users", fmt.Errorf("column %q does not exist", field))
+		return
+	}
+	// Rows have no order, return the oldest to be deterministic
+	found := false
+	for _, stored := range m.users {
+		if match(stored) && (!found || stored.CreatedAt < u.CreatedAt) {
+			u, found = stored, true
+		}
+	}
+	if !found {
+		dberr = database.NewError(database.ErrorNoRows, "No rows found", qry, "users", sql.ErrNoRows)
+	}
+	return
+}
+
+// GetByID gets a User by ID
+func (m *MemoryRepository) GetByID(ctx context.Context, userID, reqID string) (u User, dberr *database.Error) {
+	qry := fmt.Sprintf(`SELECT %s FROM users WHERE id = $1`, qryAllSafe)
+	if dberr = validUUID(userID, qry); dberr != nil {
+		return
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stored, ok := m.users[userID]
+	if !ok {
+		dberr = database.NewError(database.ErrorNoRows, "No rows found", qry, "users", sql.ErrNoRows)
+		return
+	}
+	u = safe(stored)
+	return
+}
+
+// GetList retrieves the list of Users
+func (m *MemoryRepository) GetList(ctx context.Context, reqID string) (users Users, dberr *database.Error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, stored := range m.users {
+		users = append(users, safe(stored))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].CreatedAt < users[j].CreatedAt })
+	return
+}
+
+// Insert creates a User, usernames are unique ignoring case
+func (m *MemoryRepository) Insert(ctx context.Context, u *User, reqID string) (dberr *database.Error) {
+	qry := `INSERT INTO users(id, username, password, salt, confirmed, confirmed_at, locale)
+			VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING created_at`
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, stored := range m.users {
+		if strings.EqualFold(stored.Username, u.Username) {
+			logger.Errorf("%v:MemoryRepository:Insert() Couldn't insert new user: duplicated username", reqID)
+			dberr = database.NewError(database.ErrorAlreadyExists, "Already Exists, unique constrain violation", qry, "users",
+				fmt.Errorf("duplicate key value violates unique constraint \"users_unique_username_idx\""))
+			return
+		}
+	}
+	id, err := uuid.New()
+	if err != nil {
+		dberr = database.NewError(database.ErrorGeneric, "", qry, "users", err)
+		return
+	}
+
+	u.ID = id
+	u.CreatedAt = time.Now().Unix()
+	stored := *u
+	stored.PasswordConfirm = ""
+	m.users[id] = stored
+	m.touch(id)
+
+	u.Password = ""
+	u.PasswordConfirm = ""
+	u.Salt = ""
+	return
+}
+
+// Update updates current user fields
+func (m *MemoryRepository) Update(ctx context.Context, u *User, reqID string) (dberr *database.Error) {
+	qry := `UPDATE users SET confirmed = $2,  confirmed_at = $3 WHERE id = $1
+			RETURNING id, username, confirmed, confirmed_at, locale, created_at`
+	if u.ID == "" {
+		dberr = database.NewError(database.ErrorModelInvalid, "Missing ID value", qry, "users", nil)
+		return
+	}
+	if dberr = validUUID(u.ID, qry); dberr != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.users[u.ID]
+	if !ok {
+		logger.Errorf("%v:MemoryRepository:Update() Couldn't update user: not found", reqID)
+		dberr = database.NewError(database.ErrorNoRows, "No rows found", qry, "users", sql.ErrNoRows)
+		return
+	}
+	stored.Confirmed = u.Confirmed
+	if u.ConfirmedAt > 0 {
+		stored.ConfirmedAt = u.ConfirmedAt
+	} else {
+		stored.ConfirmedAt = time.Now().Unix()
+	}
+	m.users[u.ID] = stored
+	m.touch(u.ID)
+
+	*u = safe(stored)
+	return
+}
+
+// UpdatePassword replaces the user password
+func (m *MemoryRepository) UpdatePassword(ctx context.Context, userID, hash, salt, reqID string) (dberr *database.Error) {
+	qry := `UPDATE users SET password = $2, salt = $3 WHERE id = $1 RETURNING id`
+	if dberr = validUUID(userID, qry); dberr != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.users[userID]
+	if !ok {
+		logger.Errorf("%v:MemoryRepository:UpdatePassword() Couldn't update user password: not found", reqID)
+		dberr = database.NewError(database.ErrorNoRows, "No rows found", qry, "users", sql.ErrNoRows)
+		return
+	}
+	stored.Password = hash
+	stored.Salt = salt
+	m.users[userID] = stored
+	m.touch(userID)
+	return
+}
+
+// UpdateUsername replaces the user username, usernames are unique ignoring case
+func (m *MemoryRepository) UpdateUsername(ctx context.Context, userID, username, reqID string) (dberr *database.Error) {
+	qry := `UPDATE users SET username = $2, confirmed = $3, confirmed_at = $4 WHERE id = $1 RETURNING id`
+	if dberr = validUUID(userID, qry); dberr != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.users[userID]
+	if !ok {
+		logger.Errorf("%v:MemoryRepository:UpdateUsername() Couldn't update user username: not found", reqID)
+		dberr = database.NewError(database.ErrorNoRows, "No rows found", qry, "users", sql.ErrNoRows)
+		return
+	}
+	for id, other := range m.users {
+		if id != userID && strings.EqualFold(other.Username, username) {
+			logger.Errorf("%v:MemoryRepository:UpdateUsername() Couldn't update user username: duplicated username", reqID)
+			dberr = database.NewError(database.ErrorAlreadyExists, "Already Exists, unique constrain violation", qry, "users",
+				fmt.Errorf("duplicate key value violates unique constraint \"users_unique_username_idx\""))
+			return
+		}
+	}
+	stored.Username = username
+	stored.Confirmed = true
+	stored.ConfirmedAt = time.Now().Unix()
+	m.users[userID] = stored
+	m.touch(userID)
+	return
+}
+
+// Delete deletes a user by ID
+func (m *MemoryRepository) Delete(ctx context.Context, userID, reqID string) (dberr *database.Error) {
+	qry := `DELETE FROM users  WHERE id = $1`
+	if dberr = validUUID(userID, qry); dberr != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.users, userID)
+	m.touch(userID)
+	return
+}
+
+// WithExecutor returns the view of the transaction when db is one, every call in the same transaction
+// gets the same view. Out of a transaction, or in a view, it returns the same MemoryRepository
+func (m *MemoryRepository) WithExecutor(db database.Executor) UserRepository {
+	tx, ok := db.(*database.Tx)
+	if !ok || m.dirty != nil {
+		return m
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if view, ok := m.txs[tx]; ok {
+		return view
+	}
+	view := &MemoryRepository{users: make(map[string]User, len(m.users)), dirty: make(map[string]bool)}
+	for id, stored := range m.users {
+		view.users[id] = stored
+	}
+	m.txs[tx] = view
+	tx.OnCommit(func() { m.commit(tx, view) })
+	tx.OnRollback(func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.txs, tx)
+	})
+	return view
+}
+
+// commit applies the writes of the transaction view
+func (m *MemoryRepository) commit(tx *database.Tx, view *MemoryRepository) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.txs, tx)
+	for id := range view.dirty {
+		if stored, ok := view.users[id]; ok {
+			m.users[id] = stored
+		} else {
+			delete(m.users, id)
+		}
+	}
+}
+
+// touch marks the user as written in the transaction view, it must be called with the lock held
+func (m *MemoryRepository) touch(userID string) {
+	if m.dirty != nil {
+		m.dirty[userID] = true
+	}
+}
+
+// validUUID fails like postgres does when a non uuid value is compared against an uuid column
+func validUUID(id, qry string) *database.Error {
+	if _, err := gouuid.FromString(id); err != nil {
+		return database.NewError(database.ErrorExecute, "Error executing query", qry, "users",
+			fmt.Errorf("invalid input syntax for type uuid: %q", id))
+	}
+	return nil
+}
+
+// safe removes the password related fields
+func safe(u User) User {
+	u.Password = ""
+	u.PasswordConfirm = ""
+	u.Salt = ""
+	return u
+}
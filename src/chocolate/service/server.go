@@ -1,20 +1,39 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"chocolate/service/database"
 
 	"chocolate/service/api"
+	"chocolate/service/api/middleware"
+	"chocolate/service/models/users"
+	"chocolate/service/shared/auth/services"
 	"chocolate/service/shared/config"
+	"chocolate/service/shared/logger"
 )
 
+// maxBodySize is the biggest request body accepted by the API
+const maxBodySize = 1 << 20
+
 // NewServer creates a new serverd depending on configurations
-func NewServer(conf *config.Configuration, serviceDB *database.DB) *http.Server {
+func NewServer(conf *config.Configuration, serviceDB *database.DB) (*http.Server, error) {
+	clientIP, err := middleware.ClientIP(conf.Server.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	// Middleware for every route
+	api.Use(clientIP, middleware.BodyLimit(maxBodySize))
 	// Get Router
-	r := api.NewRouter(conf, serviceDB)
+	r := api.NewRouter(conf, serviceDB, users.NewPostgresRepository(serviceDB))
 
 	addr := fmt.Sprintf("%s:%s", conf.Server.Host, conf.Server.Port)
 
@@ -27,9 +46,161 @@ func NewServer(conf *config.Configuration, serviceDB *database.DB) *http.Server
 		Handler:      r, // Pass our instance of gorilla/mux in.
 	}
 
-	return srv
+	return srv, nil
+}
+
+// NewSecureServer creates the HTTPS server, the certificate is served thru the returned CertReloader
+// so it can be replaced without restarting. Start it with ListenAndServeTLS("", "")
+func NewSecureServer(conf *config.Configuration, serviceDB *database.DB) (*http.Server, *CertReloader, error) {
+	tlsConf := conf.Server.TLS
+
+	reloader, err := NewCertReloader(tlsConf.CertFile, tlsConf.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	minVersion, err := tlsVersion(tlsConf.MinVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	ciphers, err := cipherSuites(tlsConf.Ciphers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	srv, err := NewServer(conf, serviceDB)
+	if err != nil {
+		return nil, nil, err
+	}
+	srv.TLSConfig = &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   ciphers,
+		GetCertificate: reloader.GetCertificate,
+		// HTTP/2 is negotiated thru ALPN
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	// Internal services can authenticate with client certificates signed by the client CA,
+	// the certificate is optional so users keep using JWTs
+	if tlsConf.ClientCAFile != "" {
+		pool, err := clientCAPool(tlsConf.ClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		srv.TLSConfig.ClientCAs = pool
+		srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		services.Init(tlsConf.Services)
+	}
+
+	return srv, reloader, nil
+}
+
+// NewRedirectServer creates an HTTP server that redirects every request to the HTTPS server
+func NewRedirectServer(conf *config.Configuration) *http.Server {
+	httpsPort := conf.Server.Port
+
+	return &http.Server{
+		Addr:         fmt.Sprintf("%s:%s", conf.Server.Host, conf.Server.TLS.RedirectPort),
+		WriteTimeout: time.Second * 5,
+		ReadTimeout:  time.Second * 5,
+		IdleTimeout:  time.Second * 30,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(r.Host); err == nil {
+				host = h
+			}
+			if httpsPort != "443" {
+				host = net.JoinHostPort(host, httpsPort)
+			}
+			http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+		}),
+	}
+}
+
+// CertReloader holds the server certificate and reloads it from its files on demand
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+}
+
+// NewCertReloader loads the certificate and key files
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	reloader := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Reload reads the certificate and key files again, the current certificate
+// is kept if the new one can't be loaded
+func (c *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("Couldn't load certificate %s: %s", c.certFile, err.Error())
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	logger.Infof("Loaded TLS certificate %s", c.certFile)
+	return nil
+}
+
+// GetCertificate is the tls.Config GetCertificate callback
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
 }
 
-// TODO: implement an HTTPS Server
-func NewSecureServer() {
+func clientCAPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read client CA %s: %s", caFile, err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in client CA %s", caFile)
+	}
+	return pool, nil
+}
+
+func tlsVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("Unsupported TLS min_version %q, use \"1.2\" or \"1.3\"", version)
+}
+
+func cipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	// Only the secure suites can be configured
+	available := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		available[suite.Name] = suite.ID
+	}
+	var (
+		ids     []uint16
+		http2OK bool
+	)
+	for _, name := range names {
+		id, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported TLS cipher %q", name)
+		}
+		// HTTP/2 requires TLS_ECDHE_(RSA|ECDSA)_WITH_AES_128_GCM_SHA256 when using TLS 1.2
+		if strings.HasPrefix(name, "TLS_ECDHE_") && strings.HasSuffix(name, "_WITH_AES_128_GCM_SHA256") {
+			http2OK = true
+		}
+		ids = append(ids, id)
+	}
+	if !http2OK {
+		return nil, fmt.Errorf("TLS ciphers must include an ECDHE AES_128_GCM_SHA256 suite for HTTP/2")
+	}
+	return ids, nil
 }
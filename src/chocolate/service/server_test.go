@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"chocolate/service/shared/config"
+	"chocolate/service/shared/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.Init("", false)
+	os.Exit(m.Run())
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 with the serial number
+// to the cert and key files, it returns the pool that trusts it
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) *x509.CertPool {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return pool
+}
+
+// startSecureServer starts the HTTPS server with a new certificate, it returns its address
+func startSecureServer(t *testing.T, tlsConf config.TLSConfig) (addr string, pool *x509.CertPool) {
+	t.Helper()
+	dir := t.TempDir()
+	tlsConf.CertFile, tlsConf.KeyFile = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	pool = writeTestCert(t, tlsConf.CertFile, tlsConf.KeyFile, 1)
+
+	conf := &config.Configuration{Server: config.ServerConfig{Host: "127.0.0.1", TLS: tlsConf}}
+	srv, _, err := NewSecureServer(conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(ln, "", "")
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String(), pool
+}
+
+func TestSecureServerMinVersion(t *testing.T) {
+	tests := []struct {
+		minVersion string
+		client     uint16
+		ok         bool
+	}{
+		{"", tls.VersionTLS12, true},
+		{"", tls.VersionTLS11, false},
+		{"1.2", tls.VersionTLS12, true},
+		{"1.3", tls.VersionTLS12, false},
+		{"1.3", tls.VersionTLS13, true},
+	}
+	for _, tt := range tests {
+		name := tt.minVersion
+		if name == "" {
+			name = "default"
+		}
+		t.Run(name+"/"+tls.VersionName(tt.client), func(t *testing.T) {
+			addr, pool := startSecureServer(t, config.TLSConfig{MinVersion: tt.minVersion})
+			conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS10, MaxVersion: tt.client})
+			if err == nil {
+				conn.Close()
+			}
+			if (err == nil) != tt.ok {
+				t.Errorf("handshake with max version %s got error %v, want success %v", tls.VersionName(tt.client), err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSecureServerUnsupportedMinVersion(t *testing.T) {
+	dir := t.TempDir()
+	tlsConf := config.TLSConfig{CertFile: filepath.Join(dir, "server.crt"), KeyFile: filepath.Join(dir, "server.key"), MinVersion: "1.1"}
+	writeTestCert(t, tlsConf.CertFile, tlsConf.KeyFile, 1)
+	if _, _, err := NewSecureServer(&config.Configuration{Server: config.ServerConfig{TLS: tlsConf}}, nil); err == nil {
+		t.Error("NewSecureServer() got no error for min_version 1.1")
+	}
+}
+
+func TestSecureServerHTTP2(t *testing.T) {
+	addr, pool := startSecureServer(t, config.TLSConfig{})
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+		t.Errorf("ALPN negotiated %q, want h2", proto)
+	}
+	conn.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, ForceAttemptHTTP2: true}}
+	res, err := client.Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.ProtoMajor != 2 {
+		t.Errorf("response protocol = %s, want HTTP/2", res.Proto)
+	}
+}
+
+func TestCertReloaderReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeTestCert(t, certFile, keyFile, 1)
+	conf := &config.Configuration{Server: config.ServerConfig{TLS: config.TLSConfig{CertFile: certFile, KeyFile: keyFile}}}
+	srv, reloader, err := NewSecureServer(conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	serial := func() int64 {
+		t.Helper()
+		// The test certificates are self-signed, only their serial number is checked
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	if got := serial(); got != 1 {
+		t.Fatalf("served certificate serial = %d, want 1", got)
+	}
+
+	writeTestCert(t, certFile, keyFile, 2)
+	if got := serial(); got != 1 {
+		t.Errorf("served certificate serial before Reload = %d, want 1", got)
+	}
+	if err = reloader.Reload(); err != nil {
+		t.Fatalf("Reload() got error %v", err)
+	}
+	if got := serial(); got != 2 {
+		t.Errorf("served certificate serial after Reload = %d, want 2", got)
+	}
+
+	// A broken certificate keeps the current one
+	if err = ioutil.WriteFile(certFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = reloader.Reload(); err == nil {
+		t.Error("Reload() got no error for a broken certificate")
+	}
+	if got := serial(); got != 2 {
+		t.Errorf("served certificate serial after a failed Reload = %d, want 2", got)
+	}
+}
+
+func TestRedirectServer(t *testing.T) {
+	tests := []struct {
+		port   string
+		target string
+		want   string
+	}{
+		{"8443", "http://example.com:8080/v1/users?page=2", "https://example.com:8443/v1/users?page=2"},
+		{"443", "http://example.com/v1/users", "https://example.com/v1/users"},
+		{"443", "http://example.com:80/", "https://example.com/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			conf := &config.Configuration{Server: config.ServerConfig{Port: tt.port, TLS: config.TLSConfig{RedirectPort: "8080"}}}
+			srv := NewRedirectServer(conf)
+			w := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(w, httptest.NewRequest("GET", tt.target, nil))
+			if w.Code != http.StatusMovedPermanently {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusMovedPermanently)
+			}
+			if got := w.Header().Get("Location"); got != tt.want {
+				t.Errorf("Location = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
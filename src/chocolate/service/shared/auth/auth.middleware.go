@@ -7,13 +7,20 @@ import (
 
 	"chocolate/service/api/shared/apierror"
 	"chocolate/service/api/shared/responses"
+	"chocolate/service/database"
 	"chocolate/service/shared/auth/jwt"
+	"chocolate/service/shared/auth/permissions"
+	"chocolate/service/shared/auth/services"
+	"chocolate/service/shared/auth/utils"
 	"chocolate/service/shared/logger"
 	"chocolate/service/shared/reqcontext"
 )
 
 // Validate is the Validation Middleware that checks the request for Authorization Header
-func Validate(next http.Handler, audience string, roles map[string]struct{}, checkEmail bool) http.HandlerFunc {
+// and that the user role was granted the permission required by the route.
+// If allowServices is set, requests without Authorization Header can authenticate with
+// a client certificate mapped to a service principal, its role must have the permission too
+func Validate(next http.Handler, audience, permission string, allowServices bool) http.HandlerFunc {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		logger.Debug("Validate:Checking Validations")
 
@@ -22,7 +29,21 @@ func Validate(next http.Handler, audience string, roles map[string]struct{}, che
 			err       *apierror.Error
 			claims    *jwt.Claims
 			ok        bool
+			scope     string
 		)
+		reqID := reqcontext.GetReqID(r)
+		db := reqcontext.GetDB(r)
+		if db == nil {
+			err = apierror.New(http.StatusInternalServerError, "Couldnt reach DB", apierror.CodeInternalDB)
+			responses.Error(r, rw, err)
+			return
+		}
+		if allowServices && r.Header.Get("Authorization") == "" {
+			if principal, isService := services.FromRequest(r); isService {
+				validateService(next, rw, r, db, principal, permission)
+				return
+			}
+		}
 		// Get Token
 		if authToken, err = extractAuthFromHeader(r); err != nil {
 			responses.Error(r, rw, err)
@@ -40,33 +61,84 @@ func Validate(next http.Handler, audience string, roles map[string]struct{}, che
 			responses.Error(r, rw, err)
 			return
 		}
-		if _, ok = roles[claims.Role]; !ok {
+		// Refresh, confirm, reset and mfa tokens can't be used to authorize requests
+		if claims.TokenType != jwt.TokenTypeAccess {
+			err = apierror.New(http.StatusUnauthorized, "This is not an access token", apierror.CodeUnauth)
+			responses.Error(r, rw, err)
+			return
+		}
+		scope, ok, dberr := permissions.Scope(r.Context(), db, claims.Role, permission, reqID)
+		if dberr != nil {
+			logger.Errorf("%s:Validate: Got error from permissions Scope: err: %v", reqID, dberr)
+			err = apierror.FromDB(dberr)
+			responses.Error(r, rw, err)
+			return
+		}
+		if !ok {
 			err = apierror.New(http.StatusForbidden, "User not allowed to reach this endpoint", apierror.CodeForbidden)
 			responses.Error(r, rw, err)
 			return
 		}
 
-		// TODO: Move this claim verification to the respective /users route
-		// We should add into the Route object a Middleware property, to allow
-		// each route to define it respective middleware if necessary
-		if claims.Role != jwt.RoleAdmin {
-			if checkEmail && !claims.EmailOK {
-				err = apierror.New(http.StatusForbidden, "Email not confirmed", apierror.CodeForbiddenNotConfirmed)
-				// TODO: Add url for endpoint to resend confirmation email
-				responses.Error(r, rw, err)
-				return
-			}
+		// Verify Token was not blacklisted (when user logsout)
+		if err = utils.CheckRevoked(r.Context(), db, claims, reqID); err != nil {
+			responses.Error(r, rw, err)
+			return
 		}
 
-		// TODO: Verify Token was not blacklisted (when user logsout)
-
 		ctx := context.WithValue(r.Context(), reqcontext.AuthJWTKey, *claims)
+		ctx = context.WithValue(ctx, reqcontext.ScopeKey, scope)
 		// NOTE: should we add the userID in the context? we can get it from the claims
 
 		next.ServeHTTP(rw, r.WithContext(ctx))
 	})
 }
 
+// validateService authorizes the request of a service principal with the permissions of its role
+func validateService(next http.Handler, rw http.ResponseWriter, r *http.Request, db *database.DB, principal services.Principal, permission string) {
+	reqID := reqcontext.GetReqID(r)
+	logger.Debugf("%s:Validate: Service %s authenticated with client certificate", reqID, principal.Name)
+
+	scope, ok, dberr := permissions.Scope(r.Context(), db, principal.Role, permission, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:Validate: Got error from permissions Scope: err: %v", reqID, dberr)
+		err := apierror.FromDB(dberr)
+		responses.Error(r, rw, err)
+		return
+	}
+	if !ok {
+		err := apierror.New(http.StatusForbidden, "Service not allowed to reach this endpoint", apierror.CodeForbidden)
+		responses.Error(r, rw, err)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), reqcontext.ServiceKey, principal)
+	ctx = context.WithValue(ctx, reqcontext.ScopeKey, scope)
+
+	next.ServeHTTP(rw, r.WithContext(ctx))
+}
+
+// RequireConfirmedEmail is the route Middleware that rejects users that haven't confirmed their email,
+// it must run after Validate as it reads the JWT claims from the request context
+func RequireConfirmedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// Services don't have an email
+		if _, isService := reqcontext.GetService(r); isService {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		claims := reqcontext.GetAuthJWT(r)
+		if claims.Role != jwt.RoleAdmin && !claims.EmailOK {
+			resendURL := reqcontext.GetBaseURL(r) + "/users/" + claims.UserID + "/confirmation"
+			err := apierror.New(http.StatusForbidden, "Email not confirmed", apierror.CodeForbiddenNotConfirmed).
+				WithLink("resend_confirmation", http.MethodPost, resendURL)
+			responses.Error(r, rw, err)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
 func extractAuthFromHeader(r *http.Request) (string, *apierror.Error) {
 	var err *apierror.Error
 
@@ -14,6 +14,11 @@ const (
 	TokenTypeAccess  = "access_token"
 	TokenTypeRefresh = "refresh_token"
 	TokenTypeConfirm = "confirm_token"
+	TokenTypeReset   = "reset_token"
+	TokenTypeMFA     = "mfa_token"
+	// TokenTypeEmailChange verifies the new address of an email change, TokenTypeEmailUndo undoes it
+	TokenTypeEmailChange = "email_change_token"
+	TokenTypeEmailUndo   = "email_undo_token"
 	// AuthType
 	AuthTypeBearer = "bearer"
 	// Roles
@@ -31,10 +36,18 @@ type Claims struct {
 	EmailOK bool `json:"eok"`
 	// Role user role "admin"|"user"|"business"
 	Role string `json:"rol"`
-	// TokenType is either an access_token, refresh_token, confirm_token
+	// TokenType is either an access_token, refresh_token, confirm_token, reset_token, mfa_token,
+	// email_change_token or email_undo_token
 	TokenType string `json:"ttp"`
 	// AuthType is the type of auth for the JWT (for now always "bearer")
 	AuthType string `json:"ath"`
+	// Family is the refresh token family (session) the access and refresh tokens belong to
+	Family string `json:"fam,omitempty"`
+	// Remember is carried by the mfa_token so the second step knows which refresh expiration to use
+	Remember bool `json:"rem,omitempty"`
+	// IssuedAtMs is IssuedAt in milliseconds, so a token issued right after the user revoked its tokens
+	// (in the same second) is told apart from the revoked ones
+	IssuedAtMs int64 `json:"ims,omitempty"`
 }
 
 // New Creates New set of JWT Claims
@@ -47,6 +60,15 @@ func New() Claims {
 	return c
 }
 
+// IssuedAtMillis returns the epoch in milliseconds the token was issued at,
+// the tokens issued without the ims claim are taken as issued at the start of their second
+func (c Claims) IssuedAtMillis() int64 {
+	if c.IssuedAtMs > 0 {
+		return c.IssuedAtMs
+	}
+	return c.IssuedAt * 1000
+}
+
 // Valid is called by JWT Parser method
 func (c Claims) Valid() error {
 
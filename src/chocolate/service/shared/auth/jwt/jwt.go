@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"chocolate/service/api/shared/apierror"
 	"chocolate/service/shared/config"
@@ -13,10 +14,14 @@ import (
 	_jwt "github.com/dgrijalva/jwt-go"
 )
 
+// defaultConfirmExpiration is used when jwt.confirm_expiration isn't set
+const defaultConfirmExpiration = 48 * time.Hour
+
 var (
-	verifyKey *rsa.PublicKey
-	signKey   *rsa.PrivateKey
-	audience  string
+	verifyKey         *rsa.PublicKey
+	signKey           *rsa.PrivateKey
+	audience          string
+	confirmExpiration = defaultConfirmExpiration
 )
 
 // Init initializes jwt, loads public and private key
@@ -26,6 +31,9 @@ func Init(conf *config.Configuration) (err error) {
 	logger.Debugf("jwt:Init() Audience: %s, PrivKey: %s, PubKey: %s", conf.JWT.Audience, conf.JWT.PrivKey, conf.JWT.PubKey)
 
 	audience = conf.JWT.Audience
+	if conf.JWT.ConfirmExpiration > 0 {
+		confirmExpiration = time.Duration(conf.JWT.ConfirmExpiration) * time.Second
+	}
 
 	if signBytes, err = ioutil.ReadFile(conf.JWT.PrivKey); err != nil {
 		logger.Errorf("Error loading JWT Private Key File: %s", err.Error())
@@ -48,6 +56,11 @@ func Init(conf *config.Configuration) (err error) {
 	return
 }
 
+// ConfirmExpiration returns how long the email confirmation tokens are valid
+func ConfirmExpiration() time.Duration {
+	return confirmExpiration
+}
+
 // Verify parses token to see if is a valid JWT
 // It only validates "standard" JWT claims, we still need to validate Zale claims
 func Verify(jwtStr string) (*Claims, *apierror.Error) {
@@ -55,6 +68,7 @@ func Verify(jwtStr string) (*Claims, *apierror.Error) {
 	var (
 		ve     *_jwt.ValidationError
 		apierr *apierror.Error
+		ok     bool
 	)
 
 	// We parse JWT using Zale's user Claims
@@ -65,10 +79,12 @@ func Verify(jwtStr string) (*Claims, *apierror.Error) {
 		return verifyKey, nil
 	})
 
-	claims, ok := token.Claims.(*Claims)
-	if ok && token.Valid {
-		logger.Debug("Valid JWT")
-		return claims, nil
+	// The token is nil when it couldn't even be parsed
+	if token != nil {
+		if claims, isClaims := token.Claims.(*Claims); isClaims && token.Valid {
+			logger.Debug("Valid JWT")
+			return claims, nil
+		}
 	}
 
 	apierr = apierror.New(http.StatusUnauthorized, "Unauthorized", apierror.CodeUnauth)
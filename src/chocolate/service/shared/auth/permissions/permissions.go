@@ -0,0 +1,88 @@
+// Package permissions resolves the "resource:action" permissions granted to the roles defined in DB
+// and lets handlers check the ownership of the resources they serve
+package permissions
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"chocolate/service/database"
+	"chocolate/service/models/roles"
+	"chocolate/service/shared/reqcontext"
+)
+
+// Permissions required by the API routes
+const (
+	UsersList      = "users:list"
+	UsersRead      = "users:read"
+	UsersUpdate    = "users:update"
+	UsersDelete    = "users:delete"
+	TokensRefresh  = "tokens:refresh"
+	TokensDelete   = "tokens:delete"
+	SessionsRead   = "sessions:read"
+	SessionsDelete = "sessions:delete"
+	MFAUpdate      = "mfa:update"
+	MFADelete      = "mfa:delete"
+	RolesRead      = "roles:read"
+	RolesGrant     = "roles:grant"
+	RolesManage    = "roles:manage"
+	DBRead         = "db:read"
+	EmailsRead     = "emails:read"
+)
+
+// cacheTTL is how long the role permissions are kept in memory before reading them again from DB
+const cacheTTL = time.Minute
+
+type cachedSet struct {
+	permissions map[string]string
+	loadedAt    time.Time
+}
+
+var (
+	cacheMu sync.RWMutex
+	cache   = make(map[string]cachedSet)
+)
+
+// Scope returns the scope the role has over the permission, ok is false if the role doesn't have it
+func Scope(ctx context.Context, db *database.DB, role, permission, reqID string) (scope string, ok bool, dberr *database.Error) {
+	cacheMu.RLock()
+	set, cached := cache[role]
+	cacheMu.RUnlock()
+
+	if !cached || time.Since(set.loadedAt) > cacheTTL {
+		var permissions map[string]string
+		if permissions, dberr = roles.GetPermissions(ctx, db, role, reqID); dberr != nil {
+			return
+		}
+		set = cachedSet{permissions: permissions, loadedAt: time.Now()}
+		cacheMu.Lock()
+		cache[role] = set
+		cacheMu.Unlock()
+	}
+
+	scope, ok = set.permissions[permission]
+	return
+}
+
+// Invalidate drops the cached permissions of the role
+func Invalidate(role string) {
+	cacheMu.Lock()
+	delete(cache, role)
+	cacheMu.Unlock()
+}
+
+// CanAccess checks if the current request is allowed to reach the resource owned by ownerID,
+// the route permission must have been granted with the "any" scope or the user must be the owner
+func CanAccess(r *http.Request, ownerID string) bool {
+	if reqcontext.GetScope(r) == roles.ScopeAny {
+		return true
+	}
+	return ownerID != "" && ownerID == reqcontext.GetAuthJWT(r).UserID
+}
+
+// CanAccessAll checks if the route permission was granted with the "any" scope, i.e. to list the resources of every user
+func CanAccessAll(r *http.Request) bool {
+	return reqcontext.GetScope(r) == roles.ScopeAny
+}
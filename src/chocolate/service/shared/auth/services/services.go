@@ -0,0 +1,45 @@
+// Package services maps the client certificates of the internal services (mTLS) to service principals
+package services
+
+import (
+	"net/http"
+	"sync"
+
+	"chocolate/service/shared/config"
+)
+
+// Principal is an internal service authenticated by its client certificate
+type Principal struct {
+	Name string `json:"name"`
+	// Role is the DB defined role whose permissions are granted to the service
+	Role string `json:"role"`
+}
+
+var (
+	mu         sync.RWMutex
+	principals = make(map[string]Principal)
+)
+
+// Init loads the services configured, keyed by their certificate subject
+func Init(conf []config.ServiceConfig) {
+	mu.Lock()
+	defer mu.Unlock()
+	principals = make(map[string]Principal, len(conf))
+	for _, s := range conf {
+		principals[s.Subject] = Principal{Name: s.Name, Role: s.Role}
+	}
+}
+
+// FromRequest returns the principal of the client certificate of the request,
+// only certificates verified against the configured client CA are taken into account
+func FromRequest(r *http.Request) (principal Principal, ok bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject.CommonName
+
+	mu.RLock()
+	principal, ok = principals[subject]
+	mu.RUnlock()
+	return
+}
@@ -0,0 +1,101 @@
+// Package totp implements RFC 6238 Time-Based One-Time Passwords (HMAC-SHA1, 6 digits, 30 seconds)
+// compatible with the common authenticator apps
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"chocolate/service/shared/security"
+)
+
+const (
+	// Digits is the length of the generated codes
+	Digits = 6
+	// Period is the time step in seconds
+	Period = 30
+	// secretSize is the size in bytes of the shared secret, RFC 4226 recommends 160 bits
+	secretSize = 20
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random base32 encoded shared secret
+func GenerateSecret() (string, error) {
+	b, err := security.GenerateRandomBytes(secretSize)
+	if err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// URI returns the otpauth:// key URI used by authenticator apps (usually rendered as a QR code)
+func URI(issuer, account, secret string) string {
+	u := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + issuer + ":" + account,
+	}
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprintf("%d", Digits))
+	q.Set("period", fmt.Sprintf("%d", Period))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Counter returns the time step counter for t
+func Counter(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+// Code generates the code for the secret at the given counter
+func Code(secret string, counter int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.TrimSpace(secret)))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	// Dynamic truncation RFC 4226 Section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, value%mod), nil
+}
+
+// Validate checks the code against the secret at time t allowing skew steps of clock drift
+// in each direction. It returns the matched counter so callers can reject replayed codes
+func Validate(secret, code string, t time.Time, skew int) (counter int64, ok bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != Digits {
+		return 0, false
+	}
+	current := Counter(t)
+	for i := -skew; i <= skew; i++ {
+		c := current + int64(i)
+		expected, err := Code(secret, c)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return c, true
+		}
+	}
+	return 0, false
+}
@@ -1,23 +1,50 @@
 package utils
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"time"
 
 	"chocolate/service/api/shared/apierror"
+	"chocolate/service/database"
 	"chocolate/service/models/auth"
+	"chocolate/service/models/mfa"
+	"chocolate/service/models/tokens"
+	"chocolate/service/models/users"
 	"chocolate/service/shared/auth/jwt"
+	"chocolate/service/shared/auth/totp"
 	"chocolate/service/shared/logger"
+	"chocolate/service/shared/security"
+	"chocolate/service/shared/utils/uuid"
 )
 
-func GenerateAuthResponse(reqID, role, userID string, refreshExpiration time.Duration, eok bool) (authResponse *auth.Response, apierr *apierror.Error) {
+const (
+	// RefreshExpiration is the default refresh token lifetime
+	RefreshExpiration = time.Hour * 24 * 8
+	// RefreshExpirationRemember is the refresh token lifetime when the user asks to be remembered
+	RefreshExpirationRemember = time.Hour * 24 * 30
+)
+
+// GenerateAuthResponse generates an Access/Refresh Token pair and stores the refresh token in its family,
+// an empty familyID starts a new family (i.e. a new session)
+func GenerateAuthResponse(ctx context.Context, db *database.DB, reqID, role, userID, familyID string, refreshExpiration time.Duration, eok bool) (authResponse *auth.Response, apierr *apierror.Error) {
 	var (
 		accessClaims, refreshClaims jwt.Claims
 		accessToken, refreshToken   string
+		err                         error
 	)
+	if familyID == "" {
+		if familyID, err = uuid.New(); err != nil {
+			logger.Errorf("%s:auth:GenerateToken() Couldn't create family ID: %s", reqID, err.Error())
+			apierr = apierror.New(http.StatusInternalServerError, "Couldn't create token family", apierror.CodeInternal)
+			return
+		}
+	}
 	if accessClaims, apierr = GenerateAccessClaims(role, userID, eok); apierr != nil {
 		return
 	}
+	accessClaims.Family = familyID
 	logger.Debugf("%s:auth:GenerateToken() Access Claims: %+v:", reqID, accessClaims)
 	if accessToken, apierr = jwt.Create(accessClaims); apierr != nil {
 		return
@@ -32,6 +59,19 @@ func GenerateAuthResponse(reqID, role, userID string, refreshExpiration time.Dur
 	}
 	logger.Debugf("%s:auth:GenerateToken() Refresh Token: %s:", reqID, refreshToken)
 
+	refresh := &tokens.Refresh{
+		ID:        refreshClaims.Id,
+		FamilyID:  familyID,
+		UserID:    userID,
+		AccessID:  accessClaims.Id,
+		ExpiresAt: refreshClaims.ExpiresAt,
+	}
+	if dberr := refresh.Insert(ctx, db, reqID); dberr != nil {
+		logger.Errorf("%s:auth:GenerateToken() Got error from Insert Refresh: err: %v", reqID, dberr)
+		apierr = apierror.FromDB(dberr)
+		return
+	}
+
 	authResponse = &auth.Response{
 		AccessToken:  accessToken,
 		RefreshToken: refreshToken,
@@ -47,6 +87,7 @@ func GenerateAccessClaims(role, userID string, eok bool) (claims jwt.Claims, err
 	claims.EmailOK = eok
 	claims.ExpiresAt = now.Add(exp).Unix()
 	claims.IssuedAt = nowEpoch
+	claims.IssuedAtMs = now.UnixNano() / int64(time.Millisecond)
 	claims.NotBefore = nowEpoch
 	claims.UserID = userID
 	claims.Role = role
@@ -62,11 +103,112 @@ func GenerateRefreshClaims(accessClaims *jwt.Claims, refreshExpiration time.Dura
 
 	claims.ExpiresAt = now.Add(refreshExpiration).Unix()
 	claims.IssuedAt = nowEpoch
+	claims.IssuedAtMs = now.UnixNano() / int64(time.Millisecond)
 	claims.NotBefore = nowEpoch
 	claims.UserID = accessClaims.UserID
 	claims.Role = accessClaims.Role
 	// The subject in this case is the Access_token ID
 	claims.Subject = accessClaims.Id
+	claims.Family = accessClaims.Family
 	claims.TokenType = jwt.TokenTypeRefresh
 	return
 }
+
+// CheckRevoked verifies that the token was not revoked on logout, that its session (family) is still valid
+// and that it was not issued before the user revoked all of its tokens (logout everywhere, password reset)
+func CheckRevoked(ctx context.Context, db *database.DB, claims *jwt.Claims, reqID string) (apierr *apierror.Error) {
+	tokenIDs := []string{claims.Id}
+	if claims.TokenType == jwt.TokenTypeRefresh {
+		// The subject is the Access Token ID, revoking the access token also revokes its refresh token
+		tokenIDs = append(tokenIDs, claims.Subject)
+	}
+	for _, tokenID := range tokenIDs {
+		revoked, dberr := tokens.IsRevoked(ctx, db, tokenID, reqID)
+		if dberr != nil {
+			logger.Errorf("%s:auth:CheckRevoked() Got error from IsRevoked: err: %v", reqID, dberr)
+			return apierror.FromDB(dberr)
+		}
+		if revoked {
+			return apierror.New(http.StatusUnauthorized, "Token was revoked", apierror.CodeUnauthRevoked)
+		}
+	}
+	if claims.Family != "" {
+		revoked, dberr := tokens.IsFamilyRevoked(ctx, db, claims.Family, reqID)
+		if dberr != nil {
+			logger.Errorf("%s:auth:CheckRevoked() Got error from IsFamilyRevoked: err: %v", reqID, dberr)
+			return apierror.FromDB(dberr)
+		}
+		if revoked {
+			return apierror.New(http.StatusUnauthorized, "Session was revoked", apierror.CodeUnauthRevoked)
+		}
+	}
+
+	revokedAt, dberr := users.TokensRevokedAt(ctx, db, claims.UserID, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:auth:CheckRevoked() Got error from TokensRevokedAt: err: %v", reqID, dberr)
+		switch code := dberr.Code; code {
+		case database.ErrorNoRows:
+			apierr = apierror.New(http.StatusUnauthorized, "User is not registered", apierror.CodeUnauth)
+		default:
+			apierr = apierror.FromDB(dberr)
+		}
+		return
+	}
+	if claims.IssuedAtMillis() < revokedAt {
+		apierr = apierror.New(http.StatusUnauthorized, "Token was revoked", apierror.CodeUnauthRevoked)
+	}
+	return
+}
+
+// VerifyMFACode checks the TOTP code of the user, or the recovery code when code is empty, and uses it so
+// it can't be replayed. A wrong or already used code is a 401
+func VerifyMFACode(ctx context.Context, db *database.DB, userID, code, recoveryCode, reqID string) *apierror.Error {
+	if len(code) > 0 {
+		return verifyTOTPCode(ctx, db, userID, code, reqID)
+	}
+	return verifyRecoveryCode(ctx, db, userID, recoveryCode, reqID)
+}
+
+func verifyTOTPCode(ctx context.Context, db *database.DB, userID, code, reqID string) (apierr *apierror.Error) {
+	t, dberr := mfa.GetTOTP(ctx, db, userID, reqID)
+	if dberr != nil {
+		logger.Errorf("%s:utils:verifyTOTPCode() Got error from GetTOTP: err: %v", reqID, dberr)
+		switch code := dberr.Code; code {
+		case database.ErrorNoRows:
+			apierr = apierror.New(http.StatusUnauthorized, "MFA is not enabled", apierror.CodeUnauth)
+		default:
+			apierr = apierror.FromDB(dberr)
+		}
+		return
+	}
+	if !t.Enabled {
+		return apierror.New(http.StatusUnauthorized, "MFA is not enabled", apierror.CodeUnauth)
+	}
+	counter, ok := totp.Validate(t.Secret, code, time.Now(), 1)
+	if !ok {
+		return apierror.New(http.StatusUnauthorized, "Wrong MFA code", apierror.CodeUnauth)
+	}
+	if dberr = mfa.UseCounter(ctx, db, userID, counter, reqID); dberr != nil {
+		logger.Errorf("%s:utils:verifyTOTPCode() Got error from UseCounter: err: %v", reqID, dberr)
+		switch code := dberr.Code; code {
+		case database.ErrorNoRows:
+			apierr = apierror.New(http.StatusUnauthorized, "MFA code was already used", apierror.CodeUnauthRevoked)
+		default:
+			apierr = apierror.FromDB(dberr)
+		}
+	}
+	return
+}
+
+func verifyRecoveryCode(ctx context.Context, db *database.DB, userID, code, reqID string) (apierr *apierror.Error) {
+	if dberr := mfa.UseRecoveryCode(ctx, db, userID, security.HashToken(mfa.NormalizeRecoveryCode(code)), reqID); dberr != nil {
+		logger.Errorf("%s:utils:verifyRecoveryCode() Got error from UseRecoveryCode: err: %v", reqID, dberr)
+		switch code := dberr.Code; code {
+		case database.ErrorNoRows:
+			apierr = apierror.New(http.StatusUnauthorized, "Wrong or already used recovery code", apierror.CodeUnauth)
+		default:
+			apierr = apierror.FromDB(dberr)
+		}
+	}
+	return
+}
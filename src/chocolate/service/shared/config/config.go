@@ -11,27 +11,71 @@ type Configuration struct {
 	Server      ServerConfig     `json:"server"`
 	Environment string           `json:"env"`
 	Debug       bool             `json:"debug"`
+	Test        bool             `json:"test"`
 	JWT         jwtConfiguration `json:"jwt"`
 	DB          SQLConfig        `json:"db"`
 	Email       EmailConfig      `json:"email"`
+	MFA         MFAConfig        `json:"mfa"`
 }
 
 // ServerConfig holds all the server configurations
 type ServerConfig struct {
-	Host       string `json:"host"`
-	Port       string `json:"port"`
-	Protocol   string `json:"protocol"`
-	APIVersion string `json:"api_version"`
+	Host       string    `json:"host"`
+	Port       string    `json:"port"`
+	Protocol   string    `json:"protocol"`
+	APIVersion string    `json:"api_version"`
+	TLS        TLSConfig `json:"tls"`
+	// TrustedProxies are the IPs or CIDRs of the load balancers/proxies in front of the API,
+	// the client IP is taken from X-Forwarded-For only when the request comes from one of them
+	TrustedProxies []string `json:"trusted_proxies"`
+}
+
+// TLSConfig holds the configuration of the HTTPS server
+type TLSConfig struct {
+	// Enabled starts the HTTPS server instead of the HTTP one
+	Enabled bool `json:"enabled"`
+	// CertFile and KeyFile are the PEM encoded certificate (chain) and private key,
+	// they are read again when the process receives SIGHUP
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// MinVersion is the minimum TLS version accepted: "1.2" (default) or "1.3"
+	MinVersion string `json:"min_version"`
+	// Ciphers are the crypto/tls names of the TLS 1.2 cipher suites accepted,
+	// if empty Go secure defaults are used. TLS 1.3 suites are not configurable
+	Ciphers []string `json:"ciphers"`
+	// RedirectPort if set, starts an HTTP listener on it that redirects to HTTPS
+	RedirectPort string `json:"redirect_port"`
+	// ClientCAFile is the PEM CA bundle that signs the internal services client certificates,
+	// if set clients can authenticate with a certificate (mTLS) instead of a JWT
+	ClientCAFile string `json:"client_ca_file"`
+	// Services are the principals the client certificates are mapped to
+	Services []ServiceConfig `json:"services"`
+}
+
+// ServiceConfig maps a client certificate to an internal service principal
+type ServiceConfig struct {
+	// Subject is the Common Name of the client certificate subject
+	Subject string `json:"subject"`
+	// Name identifies the service in the logs
+	Name string `json:"name"`
+	// Role is the DB defined role whose permissions are granted to the service
+	Role string `json:"role"`
 }
 
 type jwtConfiguration struct {
 	PubKey   string `json:"pub_key"`
 	PrivKey  string `json:"priv_key"`
 	Audience string `json:"audience"`
+	// ConfirmExpiration is how long (seconds) the email confirmation links are valid, 48 hours if not set
+	ConfirmExpiration int `json:"confirm_expiration"`
 }
 
 // SQLConfig holds the configuration used for instantiating a new SQL DB.
 type SQLConfig struct {
+	// Driver is either "postgres" (default) or "sqlite3"
+	Driver string `json:"driver"`
+	// File is the SQLite database file, only used by the sqlite3 driver
+	File string `json:"file"`
 	// Address that locates our postgres instance
 	Host string `json:"host"`
 	// Port to connect to
@@ -42,20 +86,83 @@ type SQLConfig struct {
 	Password string `json:"password"`
 	// Database to connect to (must have been created priorly)
 	Database string `json:"database"`
+	// QueryTimeout is the default time in seconds a model call waits for the DB, 5 if not set
+	QueryTimeout int `json:"query_timeout"`
+	// SSLMode is the postgres sslmode (disable, require, verify-ca, verify-full), disable if not set
+	SSLMode string `json:"sslmode"`
+	// SSLRootCert is the CA certificate file used to verify the server with verify-ca and verify-full
+	SSLRootCert string `json:"sslrootcert"`
+	// SSLCert and SSLKey are the client certificate files, when the server requires one
+	SSLCert string `json:"sslcert"`
+	SSLKey  string `json:"sslkey"`
+	// MaxOpenConns limits the connections open at the same time, unlimited if not set
+	MaxOpenConns int `json:"max_open_conns"`
+	// MaxIdleConns is how many unused connections are kept in the pool, 2 if not set
+	MaxIdleConns int `json:"max_idle_conns"`
+	// ConnMaxLifetime is the time in seconds after which a connection is closed, forever if not set
+	ConnMaxLifetime int `json:"conn_max_lifetime"`
+	// ConnMaxIdleTime is the time in seconds an unused connection is kept, forever if not set
+	ConnMaxIdleTime int `json:"conn_max_idle_time"`
+	// PingRetries is how many times the first Ping is retried with backoff while the DB starts, 5 if not set
+	PingRetries int `json:"ping_retries"`
 }
 
-// EmailConfig hodls the configuration used for email sending
+// EmailConfig hodls the configuration used for email sending, TLSMode of the SMTP connection can be
+// none, starttls or implicit (port 465), if not set it is starttls when TLS is set and none otherwise.
+// Mailbox is the dir the file provider writes the emails to and Templates overrides by name the
+// templates of the default locale
 type EmailConfig struct {
 	Provider  string            `json:"provider"`
 	Host      string            `json:"host"`
 	Port      string            `json:"port"`
 	TLS       bool              `json:"tls"`
+	TLSMode   string            `json:"tls_mode"`
 	Auth      emailAuthConfig   `json:"auth"`
+	AWS       AWSConfig         `json:"aws"`
+	Mailbox   string            `json:"mailbox"`
 	Templates map[string]string `json:"templates"`
+	Outbox    OutboxConfig      `json:"outbox"`
+	// TemplatesDir has the <locale>/<name>.html templates and <locale>/messages.json
+	// catalogs that override the embedded ones
+	TemplatesDir string `json:"templates_dir"`
+	// DefaultLocale is used when the user locale isn't supported, es if not set
+	DefaultLocale string `json:"default_locale"`
+}
+
+// AWSConfig holds the AWS SES configuration, the credentials not set are read
+// from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN env vars
+type AWSConfig struct {
+	Region          string `json:"region"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	SessionToken    string `json:"session_token"`
+	// Endpoint overrides the regional SES endpoint, i.e. to use a local stub server
+	Endpoint string `json:"endpoint"`
+}
+
+// OutboxConfig holds how the emails written to the outbox are delivered,
+// anything not set keeps its default
+type OutboxConfig struct {
+	// Interval is how often (seconds) the due emails are delivered
+	Interval int `json:"interval"`
+	// BatchSize is how many emails are delivered on every interval
+	BatchSize int `json:"batch_size"`
+	// MaxAttempts is how many times an email is tried before it is dead-lettered
+	MaxAttempts int `json:"max_attempts"`
+	// Backoff is how long (seconds) the first retry waits, it doubles on every attempt
+	Backoff int `json:"backoff"`
 }
 type emailAuthConfig struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// Mechanism of the SMTP AUTH: plain (default), login or cram-md5
+	Mechanism string `json:"mechanism"`
+}
+
+// MFAConfig holds the multi factor authentication configurations
+type MFAConfig struct {
+	// Issuer is the account issuer name shown by the authenticator apps
+	Issuer string `json:"issuer"`
 }
 
 var (
@@ -1,5 +1,171 @@
 package email
 
-// SES is the Email sender for AWS SES
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"chocolate/service/shared/config"
+	"chocolate/service/shared/logger"
+)
+
+const (
+	sesService = "ses"
+	sesPath    = "/v2/email/outbound-emails"
+	// sesTimeout is how long a SendEmail request can take
+	sesTimeout = 10 * time.Second
+)
+
+// sesRetryableErrors are the SES error types of the requests that can succeed if retried
+var sesRetryableErrors = map[string]bool{
+	"TooManyRequestsException": true,
+	"LimitExceededException":   true,
+	"ThrottlingException":      true,
+}
+
+// SES is the Email sender for AWS SES, it calls the SES v2 SendEmail API
 type SES struct {
+	Region   string
+	Endpoint string
+	creds    awsCredentials
+	client   *http.Client
+}
+
+// NewSES creates a new SES sender, the endpoint defaults to the region one
+func NewSES(config config.EmailConfig) (*SES, *Error) {
+	aws := config.AWS
+	creds := awsCredentials{
+		AccessKeyID:     aws.AccessKeyID,
+		SecretAccessKey: aws.SecretAccessKey,
+		SessionToken:    aws.SessionToken,
+	}
+	if creds.AccessKeyID == "" && creds.SecretAccessKey == "" {
+		creds.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		creds.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		creds.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if aws.Region == "" || creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, NewError("Missing Configuration fields", nil)
+	}
+	endpoint := aws.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://email.%s.amazonaws.com", aws.Region)
+	}
+	return &SES{
+		Region:   aws.Region,
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		creds:    creds,
+		client:   &http.Client{Timeout: sesTimeout},
+	}, nil
+}
+
+type sesSendEmailRequest struct {
+	FromEmailAddress string `json:"FromEmailAddress"`
+	Destination      struct {
+		ToAddresses  []string `json:"ToAddresses"`
+		CcAddresses  []string `json:"CcAddresses,omitempty"`
+		BccAddresses []string `json:"BccAddresses,omitempty"`
+	} `json:"Destination"`
+	Content struct {
+		Raw struct {
+			// Data is the base64 encoded MIME message
+			Data []byte `json:"Data"`
+		} `json:"Raw"`
+	} `json:"Content"`
+}
+
+type sesSendEmailResponse struct {
+	MessageID string `json:"MessageId"`
+}
+
+type sesErrorResponse struct {
+	Type    string `json:"__type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Send sends an email
+func (s SES) Send(email *Email) (eErr *Error) {
+	msg, err := email.FormMessage()
+	if err != nil {
+		logger.Errorf("Couldn't form email body message: %s", err.Error())
+		eErr = NewError("Couldn't form email body message", err)
+		return
+	}
+
+	// The message is sent raw so it keeps its headers, alternatives and attachments
+	var sendReq sesSendEmailRequest
+	sendReq.FromEmailAddress = email.From
+	sendReq.Destination.ToAddresses = []string{email.To}
+	sendReq.Destination.CcAddresses = email.CC
+	sendReq.Destination.BccAddresses = email.Bcc
+	sendReq.Content.Raw.Data = []byte(msg)
+	body, err := json.Marshal(sendReq)
+	if err != nil {
+		eErr = NewError("Couldn't form SES request", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.Endpoint+sesPath, bytes.NewReader(body))
+	if err != nil {
+		eErr = NewError("Couldn't form SES request", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signV4(req, body, s.creds, s.Region, sesService, time.Now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		logger.Errorf("Couldn't send Email: %+v", err)
+		eErr = NewRetryableError("Couldn't reach SES", err)
+		return
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		eErr = NewRetryableError("Couldn't read SES response", err)
+		return
+	}
+
+	if res.StatusCode != http.StatusOK {
+		eErr = sesError(res, resBody)
+		logger.Errorf("Couldn't send Email: %s", eErr.Error())
+		return
+	}
+	var sendRes sesSendEmailResponse
+	if err = json.Unmarshal(resBody, &sendRes); err == nil {
+		logger.Debugf("SES sent email with MessageId %s", sendRes.MessageID)
+	}
+	return
+}
+
+// sesError maps the SES error response, the throttling errors and the server ones are retryable
+func sesError(res *http.Response, body []byte) *Error {
+	var sesErr sesErrorResponse
+	json.Unmarshal(body, &sesErr)
+	// The type is in the header and in the body, the header one can have a ":<url>" suffix
+	errType := res.Header.Get("X-Amzn-Errortype")
+	if errType == "" {
+		errType = sesErr.Type
+	}
+	if errType == "" {
+		errType = sesErr.Code
+	}
+	if i := strings.IndexByte(errType, ':'); i >= 0 {
+		errType = errType[:i]
+	}
+	if i := strings.LastIndex(errType, "#"); i >= 0 {
+		errType = errType[i+1:]
+	}
+
+	inner := fmt.Errorf("SES %d %s: %s", res.StatusCode, errType, sesErr.Message)
+	if sesRetryableErrors[errType] || res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+		return NewRetryableError("SES throttled or failed to send Email", inner)
+	}
+	return NewError("SES rejected Email", inner)
 }
@@ -0,0 +1,125 @@
+package email
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"chocolate/service/shared/config"
+)
+
+// newTestSES creates a SES sender that calls the stub server
+func newTestSES(t *testing.T, handler http.HandlerFunc) *SES {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	ses, eErr := NewSES(config.EmailConfig{AWS: config.AWSConfig{
+		Region:          "us-east-1",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "secret",
+		Endpoint:        srv.URL + "/",
+	}})
+	if eErr != nil {
+		t.Fatal(eErr)
+	}
+	return ses
+}
+
+func TestSESSend(t *testing.T) {
+	var (
+		got  sesSendEmailRequest
+		auth string
+	)
+	ses := newTestSES(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != sesPath {
+			t.Errorf("request = %s %s, want POST %s", r.Method, r.URL.Path, sesPath)
+		}
+		auth = r.Header.Get("Authorization")
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("request body %s is not JSON: %v", body, err)
+		}
+		w.Write([]byte(`{"MessageId":"id"}`))
+	})
+
+	eErr := ses.Send(&Email{
+		Type:    TextEmail,
+		Subject: "Hello",
+		Body:    "Hi there",
+		From:    "from@example.com",
+		To:      "to@example.com",
+		CC:      []string{"cc@example.com"},
+		Bcc:     []string{"bcc@example.com"},
+	})
+	if eErr != nil {
+		t.Fatalf("Send() got error %v", eErr)
+	}
+
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(auth, "/us-east-1/ses/aws4_request") {
+		t.Errorf("Authorization = %s, want a SES SigV4 signature", auth)
+	}
+	if got.FromEmailAddress != "from@example.com" {
+		t.Errorf("FromEmailAddress = %s, want from@example.com", got.FromEmailAddress)
+	}
+	d := got.Destination
+	if len(d.ToAddresses) != 1 || d.ToAddresses[0] != "to@example.com" ||
+		len(d.CcAddresses) != 1 || d.CcAddresses[0] != "cc@example.com" ||
+		len(d.BccAddresses) != 1 || d.BccAddresses[0] != "bcc@example.com" {
+		t.Errorf("Destination = %+v, want the to, cc and bcc addresses", d)
+	}
+	raw := string(got.Content.Raw.Data)
+	if !strings.Contains(raw, "Subject: Hello") || !strings.Contains(raw, "Hi there") {
+		t.Errorf("Raw Data = %q, want the MIME message", raw)
+	}
+	if strings.Contains(raw, "bcc@example.com") {
+		t.Errorf("Raw Data has the Bcc recipient in its headers")
+	}
+}
+
+func TestSESSendErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		errType   string
+		body      string
+		retryable bool
+	}{
+		{"throttled header", http.StatusBadRequest, "TooManyRequestsException:http://internal.amazon.com/", `{"message":"slow down"}`, true},
+		{"throttled body", http.StatusBadRequest, "", `{"__type":"com.amazonaws#LimitExceededException","message":"limit"}`, true},
+		{"429", http.StatusTooManyRequests, "", `{}`, true},
+		{"500", http.StatusInternalServerError, "InternalFailure", `{}`, true},
+		{"503", http.StatusServiceUnavailable, "", ``, true},
+		{"rejected", http.StatusBadRequest, "MessageRejected", `{"message":"Email address is not verified"}`, false},
+		{"bad request", http.StatusBadRequest, "BadRequestException", `{"message":"bad"}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ses := newTestSES(t, func(w http.ResponseWriter, r *http.Request) {
+				if tt.errType != "" {
+					w.Header().Set("X-Amzn-Errortype", tt.errType)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+			eErr := ses.Send(&Email{Type: TextEmail, Subject: "Hello", Body: "Hi", From: "from@example.com", To: "to@example.com"})
+			if eErr == nil {
+				t.Fatal("Send() got no error")
+			}
+			if eErr.Retryable != tt.retryable {
+				t.Errorf("Send() error %v Retryable = %v, want %v", eErr, eErr.Retryable, tt.retryable)
+			}
+		})
+	}
+}
+
+func TestSESUnreachable(t *testing.T) {
+	ses := newTestSES(t, func(w http.ResponseWriter, r *http.Request) {})
+	ses.Endpoint = "http://127.0.0.1:1"
+	eErr := ses.Send(&Email{Type: TextEmail, Subject: "Hello", Body: "Hi", From: "from@example.com", To: "to@example.com"})
+	if eErr == nil || !eErr.Retryable {
+		t.Errorf("Send() got error %v, want a retryable one", eErr)
+	}
+}
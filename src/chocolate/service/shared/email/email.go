@@ -1,20 +1,21 @@
 package email
 
 import (
-	"fmt"
-	"strings"
+	"time"
 
 	"chocolate/service/shared/config"
 )
 
 var conf config.EmailConfig
 
-var Templates map[string]string
+// testMode captures the emails in the mailbox instead of delivering them
+var testMode bool
 
-// Init initalizes package with correct configurations
-func Init(cnf config.EmailConfig) {
+// Init initalizes package with correct configurations, in test mode the emails
+// are captured in the mailbox instead of delivered
+func Init(cnf config.EmailConfig, test bool) {
 	conf = cnf
-	Templates = cnf.Templates
+	testMode = test
 }
 
 // Type of the type of email we are going to send
@@ -27,15 +28,35 @@ const (
 	HTMLEmail = Type("html")
 )
 
-// Email is the email object to send
+// Email is the email object to send, HTML emails are sent along with a plain text alternative,
+// Text or the Body without the markup if not set. Bcc recipients are not written in the message headers
 type Email struct {
-	Type     Type
-	Subject  string
-	Body     string
-	From     string
-	To       string
-	CC       []string
-	Template ITemplate
+	Type        Type
+	Subject     string
+	Body        string
+	Text        string
+	From        string
+	To          string
+	ReplyTo     string
+	CC          []string
+	Bcc         []string
+	Attachments []Attachment
+	// MessageID is generated when the message is formed if not set, without the angle brackets
+	MessageID string
+	Template  ITemplate
+}
+
+// Attachment is a file attached to the Email, ContentType is guessed from the Filename if not set
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Recipients returns the addresses the Email is delivered to, To, CC and Bcc
+func (e Email) Recipients() []string {
+	recipients := append([]string{e.To}, e.CC...)
+	return append(recipients, e.Bcc...)
 }
 
 // ITemplate is the interface to use to be able to have diffent types of templates for emails
@@ -43,33 +64,25 @@ type ITemplate interface {
 	Process() (string, error)
 }
 
-// FormMessage properly forms the Email message in RFC 822-style
+// FormMessage properly forms the Email message in RFC 5322 style with CRLF line endings,
+// the MIME structure is built by a messageBuilder
 func (e Email) FormMessage() (msg string, err error) {
-	/*
-		From: example@example.com
-		To: example2@example.com
-		Subject: As basic as it gets
-
-		This is the plain text body of the message.  Note the blank line
-		between the header information and the body of the message.
-	*/
-	var contentType, header, body string
-	if e.Type == TextEmail {
-		body = e.Body
-		// "MIME-version: 1.0;\nContent-Type: text/plain; charset=\"UTF-8\";\n\n"
-		contentType = `text/plain; charset="UTF-8"`
-	} else {
-		if body, err = e.Template.Process(); err != nil {
-			return "", err
-		}
-		contentType = `text/html; charset="UTF-8"`
+	body, err := e.Content()
+	if err != nil {
+		return "", err
+	}
+	raw, err := newMessageBuilder(e, body, time.Now()).build()
+	if err != nil {
+		return "", err
 	}
-	header = fmt.Sprintf("MIME-Version: 1.0;\nContent-Type:%s;\n", contentType)
-	if e.CC != nil && len(e.CC) > 0 {
-		cc := strings.Join(e.CC, ", ")
-		msg = fmt.Sprintf("%sFrom: %s\nTo: %s\nCc: %s\nSubject: %s\n\n%s", header, e.From, e.To, cc, e.Subject, body)
-	} else {
-		msg = fmt.Sprintf("%sFrom: %s\nTo: %s\nSubject: %s\n\n%s", header, e.From, e.To, e.Subject, body)
+	return string(raw), nil
+}
+
+// Content returns the body of the Email, the processed Template for HTML emails
+// unless the Body is already rendered (i.e. it was written to the outbox)
+func (e Email) Content() (string, error) {
+	if e.Type == TextEmail || e.Template == nil {
+		return e.Body, nil
 	}
-	return
+	return e.Template.Process()
 }
@@ -0,0 +1,13 @@
+package email
+
+import (
+	"os"
+	"testing"
+
+	"chocolate/service/shared/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.Init("", false)
+	os.Exit(m.Run())
+}
@@ -8,6 +8,9 @@ import (
 type Error struct {
 	Message string
 	Inner   error
+	// Retryable is set when sending the same email again later can succeed, i.e. the provider
+	// throttled it or couldn't be reached
+	Retryable bool
 }
 
 // NewError creates a new EmailError
@@ -18,6 +21,15 @@ func NewError(msg string, inner error) *Error {
 	}
 }
 
+// NewRetryableError creates a new EmailError that can succeed if retried
+func NewRetryableError(msg string, inner error) *Error {
+	return &Error{
+		Message:   msg,
+		Inner:     inner,
+		Retryable: true,
+	}
+}
+
 // Error returns error string
 func (e Error) Error() string {
 	return fmt.Sprintf("EmailError { message: '%s', inner: '%+v' }", e.Message, e.Inner)
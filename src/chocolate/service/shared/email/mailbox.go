@@ -0,0 +1,302 @@
+package email
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chocolate/service/shared/config"
+	"chocolate/service/shared/logger"
+	"chocolate/service/shared/utils/uuid"
+)
+
+const (
+	// defaultMailboxDir is where the file mailbox writes the emails if email.mailbox isn't set
+	defaultMailboxDir = "data/mailbox"
+	// memoryMailboxSize is how many emails the memory mailbox keeps, the oldest are dropped
+	memoryMailboxSize = 100
+)
+
+// mailIDRegexp matches the IDs the mailboxes give to the emails, so they are safe as file names
+var mailIDRegexp = regexp.MustCompile(`^[0-9]+-[0-9a-f]{8}$`)
+
+// Mail is an email captured by a Mailbox, Raw is the whole RFC 5322 message
+type Mail struct {
+	ID      string `json:"id"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Date    int64  `json:"date"`
+	Raw     string `json:"-"`
+}
+
+// Content returns the content type and decoded body of the message, the HTML alternative
+// of the multipart messages if there is one
+func (m Mail) Content() (contentType, body string, err error) {
+	msg, err := mail.ReadMessage(strings.NewReader(m.Raw))
+	if err != nil {
+		return
+	}
+	return readPart(textproto.MIMEHeader(msg.Header), msg.Body)
+}
+
+// readPart returns the content type and decoded body of the part, the preferred
+// one (HTML or the last) of the multipart ones
+func readPart(header textproto.MIMEHeader, r io.Reader) (contentType, body string, err error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// i.e. the messages without Content-Type are plain text
+		mediaType, err = "text/plain", nil
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		parts := multipart.NewReader(r, params["boundary"])
+		for {
+			part, err := parts.NextRawPart()
+			if err == io.EOF {
+				return contentType, body, nil
+			}
+			if err != nil {
+				return "", "", err
+			}
+			if part.Header.Get("Content-Disposition") != "" && !strings.HasPrefix(part.Header.Get("Content-Disposition"), "inline") {
+				continue
+			}
+			partType, partBody, err := readPart(part.Header, part)
+			if err != nil {
+				return "", "", err
+			}
+			if body == "" || !strings.HasPrefix(contentType, "text/html") {
+				contentType, body = partType, partBody
+			}
+		}
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+	return mediaType, string(b), nil
+}
+
+// Mailbox is a Sender for development that keeps the emails instead of delivering them
+type Mailbox interface {
+	Sender
+	// List returns the captured emails, newest first
+	List() ([]Mail, *Error)
+	// Get returns a captured email by ID
+	Get(id string) (Mail, *Error)
+}
+
+// GetMailbox returns the configured Mailbox, the file one is used in test mode
+// unless the memory one is configured. ok is false if the emails are delivered
+func GetMailbox() (mailbox Mailbox, ok bool) {
+	switch {
+	case conf.Provider == provMemory:
+		return memoryMailbox, true
+	case conf.Provider == provFile || testMode:
+		return NewFileMailbox(conf), true
+	}
+	return nil, false
+}
+
+// capture forms the message of the email as it would be delivered
+func capture(email *Email) (m Mail, eErr *Error) {
+	msg, err := email.FormMessage()
+	if err != nil {
+		logger.Errorf("Couldn't form email body message: %s", err.Error())
+		eErr = NewError("Couldn't form email body message", err)
+		return
+	}
+	random, err := uuid.New()
+	if err != nil {
+		eErr = NewError("Couldn't generate mail id", err)
+		return
+	}
+
+	now := time.Now()
+	m = Mail{
+		ID:      fmt.Sprintf("%d-%s", now.UnixNano(), random[:8]),
+		From:    email.From,
+		To:      email.To,
+		Subject: email.Subject,
+		Date:    now.Unix(),
+	}
+	m.Raw = msg
+	return
+}
+
+// parseMail reads the headers of the raw message
+func parseMail(id, raw string) (m Mail, eErr *Error) {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		eErr = NewError("Couldn't parse mail", err)
+		return
+	}
+	// The headers can have RFC 2047 encoded words
+	decoder := new(mime.WordDecoder)
+	decode := func(name string) string {
+		value, err := decoder.DecodeHeader(msg.Header.Get(name))
+		if err != nil {
+			return msg.Header.Get(name)
+		}
+		return value
+	}
+	m = Mail{
+		ID:      id,
+		From:    decode("From"),
+		To:      decode("To"),
+		Subject: decode("Subject"),
+		Raw:     raw,
+	}
+	if date, err := msg.Header.Date(); err == nil {
+		m.Date = date.Unix()
+	}
+	return
+}
+
+// FileMailbox writes every email to a .eml file of Dir, they can be opened with any email client
+type FileMailbox struct {
+	Dir string
+}
+
+// NewFileMailbox creates a FileMailbox in email.mailbox, data/mailbox if not set
+func NewFileMailbox(config config.EmailConfig) *FileMailbox {
+	dir := config.Mailbox
+	if dir == "" {
+		dir = defaultMailboxDir
+	}
+	return &FileMailbox{Dir: dir}
+}
+
+// Send writes the email to a new file
+func (f *FileMailbox) Send(email *Email) (eErr *Error) {
+	m, eErr := capture(email)
+	if eErr != nil {
+		return
+	}
+	if err := os.MkdirAll(f.Dir, 0700); err != nil {
+		eErr = NewError("Couldn't create mailbox dir", err)
+		return
+	}
+	file := filepath.Join(f.Dir, m.ID+".eml")
+	if err := ioutil.WriteFile(file, []byte(m.Raw), 0600); err != nil {
+		eErr = NewError("Couldn't write mail", err)
+		return
+	}
+	logger.Infof("Email to %s captured in %s", m.To, file)
+	return
+}
+
+// List returns the emails of Dir
+func (f *FileMailbox) List() (mails []Mail, eErr *Error) {
+	mails = []Mail{}
+	files, err := filepath.Glob(filepath.Join(f.Dir, "*.eml"))
+	if err != nil {
+		eErr = NewError("Couldn't list mailbox", err)
+		return
+	}
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), ".eml")
+		if !mailIDRegexp.MatchString(id) {
+			continue
+		}
+		m, eErr := f.Get(id)
+		if eErr != nil {
+			logger.Errorf("Couldn't read mail %s: %s", id, eErr.Error())
+			continue
+		}
+		mails = append(mails, m)
+	}
+	sortMails(mails)
+	return
+}
+
+// Get reads the email from its file
+func (f *FileMailbox) Get(id string) (m Mail, eErr *Error) {
+	if !mailIDRegexp.MatchString(id) {
+		eErr = NewError("Mail not found", os.ErrNotExist)
+		return
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(f.Dir, id+".eml"))
+	if err != nil {
+		eErr = NewError("Mail not found", err)
+		return
+	}
+	return parseMail(id, string(raw))
+}
+
+// MemoryMailbox keeps the last emails in memory, meant for tests
+type MemoryMailbox struct {
+	mu    sync.RWMutex
+	mails []Mail
+}
+
+// memoryMailbox is shared by every sender so the emails outlive them
+var memoryMailbox = &MemoryMailbox{}
+
+// Send keeps the email
+func (mb *MemoryMailbox) Send(email *Email) (eErr *Error) {
+	m, eErr := capture(email)
+	if eErr != nil {
+		return
+	}
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.mails = append(mb.mails, m)
+	if len(mb.mails) > memoryMailboxSize {
+		mb.mails = mb.mails[len(mb.mails)-memoryMailboxSize:]
+	}
+	logger.Infof("Email to %s captured in memory as %s", m.To, m.ID)
+	return
+}
+
+// List returns the kept emails
+func (mb *MemoryMailbox) List() (mails []Mail, eErr *Error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	mails = append([]Mail{}, mb.mails...)
+	sortMails(mails)
+	return
+}
+
+// Get returns a kept email
+func (mb *MemoryMailbox) Get(id string) (m Mail, eErr *Error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	for _, m = range mb.mails {
+		if m.ID == id {
+			return
+		}
+	}
+	eErr = NewError("Mail not found", os.ErrNotExist)
+	return
+}
+
+// sortMails sorts the mails newest first, the IDs start with the capture time
+func sortMails(mails []Mail) {
+	sort.Slice(mails, func(i, j int) bool {
+		if mails[i].Date != mails[j].Date {
+			return mails[i].Date > mails[j].Date
+		}
+		return mails[i].ID > mails[j].ID
+	})
+}
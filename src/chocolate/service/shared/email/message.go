@@ -0,0 +1,266 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	crlf = "\r\n"
+	// base64LineLength is the length of the lines of the base64 encoded attachments
+	base64LineLength = 76
+)
+
+var (
+	htmlDropRegexp    = regexp.MustCompile(`(?is)<(head|style|script)[^>]*>.*?</(head|style|script)>`)
+	htmlLinkRegexp    = regexp.MustCompile(`(?is)<a\s[^>]*href\s*=\s*["']([^"']*)["'][^>]*>(.*?)</a>`)
+	htmlBreakRegexp   = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|tr|h[1-6]|li|table)>`)
+	htmlTagRegexp     = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLinesRegexp  = regexp.MustCompile(`\n[ \t]*(\n[ \t]*)+`)
+	lineSpacingRegexp = regexp.MustCompile(`[ \t]+`)
+)
+
+// messageBuilder forms the MIME message of an Email: a text/plain part for text emails, or
+// multipart/alternative with the text and HTML parts for HTML ones, in multipart/mixed along
+// with the attachments if there are any
+type messageBuilder struct {
+	email Email
+	body  string
+	now   time.Time
+	buf   bytes.Buffer
+}
+
+func newMessageBuilder(email Email, body string, now time.Time) *messageBuilder {
+	return &messageBuilder{email: email, body: body, now: now}
+}
+
+// build returns the message bytes
+func (b *messageBuilder) build() ([]byte, error) {
+	e := b.email
+	from, err := formatAddress(e.From)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid From address: %s", err.Error())
+	}
+	to, err := formatAddresses([]string{e.To})
+	if err != nil {
+		return nil, fmt.Errorf("Invalid To address: %s", err.Error())
+	}
+	messageID := e.MessageID
+	if messageID == "" {
+		if messageID, err = newMessageID(e.From); err != nil {
+			return nil, err
+		}
+	}
+
+	b.header("Date", b.now.Format(time.RFC1123Z))
+	b.header("Message-ID", "<"+messageID+">")
+	b.header("From", from)
+	if e.ReplyTo != "" {
+		replyTo, err := formatAddress(e.ReplyTo)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Reply-To address: %s", err.Error())
+		}
+		b.header("Reply-To", replyTo)
+	}
+	b.header("To", to)
+	if len(e.CC) > 0 {
+		cc, err := formatAddresses(e.CC)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Cc address: %s", err.Error())
+		}
+		b.header("Cc", cc)
+	}
+	b.header("Subject", mime.QEncoding.Encode("UTF-8", e.Subject))
+	b.header("MIME-Version", "1.0")
+
+	header, content, err := b.content()
+	if err != nil {
+		return nil, err
+	}
+	if len(e.Attachments) == 0 {
+		b.mimeHeader(header)
+		b.buf.WriteString(crlf)
+		b.buf.Write(content)
+		return b.buf.Bytes(), nil
+	}
+
+	mixed := multipart.NewWriter(&b.buf)
+	b.header("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mixed.Boundary()}))
+	b.buf.WriteString(crlf)
+	part, err := mixed.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = part.Write(content); err != nil {
+		return nil, err
+	}
+	for _, attachment := range e.Attachments {
+		if err = writeAttachment(mixed, attachment); err != nil {
+			return nil, err
+		}
+	}
+	if err = mixed.Close(); err != nil {
+		return nil, err
+	}
+	return b.buf.Bytes(), nil
+}
+
+func (b *messageBuilder) header(name, value string) {
+	b.buf.WriteString(name + ": " + value + crlf)
+}
+
+func (b *messageBuilder) mimeHeader(header textproto.MIMEHeader) {
+	b.header("Content-Type", header.Get("Content-Type"))
+	if encoding := header.Get("Content-Transfer-Encoding"); encoding != "" {
+		b.header("Content-Transfer-Encoding", encoding)
+	}
+}
+
+// content returns the headers and body of the email content, the text/plain part or the
+// multipart/alternative one with the text and HTML parts (the last is the one preferred by the clients)
+func (b *messageBuilder) content() (header textproto.MIMEHeader, content []byte, err error) {
+	if b.email.Type == TextEmail {
+		content, err = quotedPrintable(b.body)
+		return textHeader("text/plain"), content, err
+	}
+
+	text := b.email.Text
+	if text == "" {
+		text = htmlToText(b.body)
+	}
+	var buf bytes.Buffer
+	alt := multipart.NewWriter(&buf)
+	for _, alternative := range [][2]string{{"text/plain", text}, {"text/html", b.body}} {
+		var part io.Writer
+		if part, err = alt.CreatePart(textHeader(alternative[0])); err != nil {
+			return
+		}
+		var encoded []byte
+		if encoded, err = quotedPrintable(alternative[1]); err != nil {
+			return
+		}
+		if _, err = part.Write(encoded); err != nil {
+			return
+		}
+	}
+	if err = alt.Close(); err != nil {
+		return
+	}
+	header = textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": alt.Boundary()}))
+	return header, buf.Bytes(), nil
+}
+
+func textHeader(contentType string) textproto.MIMEHeader {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType(contentType, map[string]string{"charset": "UTF-8"}))
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	return header
+}
+
+// quotedPrintable encodes the text, with CRLF line endings
+func quotedPrintable(text string) ([]byte, error) {
+	var buf bytes.Buffer
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(text)); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeAttachment(mixed *multipart.Writer, attachment Attachment) error {
+	contentType := attachment.ContentType
+	if contentType == "" {
+		if contentType = mime.TypeByExtension(filepath.Ext(attachment.Filename)); contentType == "" {
+			contentType = "application/octet-stream"
+		}
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "base64")
+	// FormatMediaType encodes the non ASCII file names as RFC 2231 says
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	part, err := mixed.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+	for len(encoded) > base64LineLength {
+		if _, err = part.Write([]byte(encoded[:base64LineLength] + crlf)); err != nil {
+			return err
+		}
+		encoded = encoded[base64LineLength:]
+	}
+	_, err = part.Write([]byte(encoded + crlf))
+	return err
+}
+
+// formatAddress parses the address (i.e. "Zale <hola@zale.mx>") and encodes its name as RFC 2047 says
+func formatAddress(address string) (string, error) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", err
+	}
+	return parsed.String(), nil
+}
+
+func formatAddresses(addresses []string) (string, error) {
+	formatted := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		f, err := formatAddress(address)
+		if err != nil {
+			return "", err
+		}
+		formatted = append(formatted, f)
+	}
+	return strings.Join(formatted, ", "), nil
+}
+
+// newMessageID generates a unique Message-ID in the domain of the from address
+func newMessageID(from string) (string, error) {
+	domain := "localhost"
+	if parsed, err := mail.ParseAddress(from); err == nil {
+		if at := strings.LastIndex(parsed.Address, "@"); at >= 0 {
+			domain = parsed.Address[at+1:]
+		}
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random) + "@" + domain, nil
+}
+
+// htmlToText returns the text of the HTML body, the links are kept after their text
+// so they can still be followed from the plain text alternative
+func htmlToText(body string) string {
+	text := htmlDropRegexp.ReplaceAllString(body, "")
+	text = htmlLinkRegexp.ReplaceAllString(text, "$2 ($1)")
+	text = htmlBreakRegexp.ReplaceAllString(text, "\n")
+	text = htmlTagRegexp.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+	text = lineSpacingRegexp.ReplaceAllString(text, " ")
+	text = blankLinesRegexp.ReplaceAllString(text, "\n\n")
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -3,6 +3,9 @@ package email
 const (
 	provGoogle = "google"
 	provAWS    = "aws"
+	provSMTP   = "smtp"
+	provFile   = "file"
+	provMemory = "memory"
 )
 
 // Sender is the object to use for Email
@@ -10,10 +13,24 @@ type Sender interface {
 	Send(*Email) *Error
 }
 
+// Closer is implemented by the senders that keep a connection open between emails,
+// it must be called once the batch of emails was sent
+type Closer interface {
+	Close() error
+}
+
 // NewSender creates a new sender depending on the provider specified in EmailConfig
 func NewSender() (Sender, *Error) {
-	if conf.Provider == provGoogle {
+	if mailbox, ok := GetMailbox(); ok {
+		return mailbox, nil
+	}
+	switch conf.Provider {
+	case provGoogle:
 		return NewGmail(conf)
+	case provAWS:
+		return NewSES(conf)
+	case provSMTP:
+		return NewSMTP(conf)
 	}
 	return nil, NewError("Provider Not Implemented", nil)
 }
@@ -0,0 +1,68 @@
+package email
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// The vectors are from the AWS Signature Version 4 test suite
+var sigV4Creds = awsCredentials{
+	AccessKeyID:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+
+func TestSignV4(t *testing.T) {
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		url     string
+		service string
+		headers map[string]string
+		want    string
+	}{
+		{
+			name:    "get-vanilla",
+			url:     "https://example.amazonaws.com/",
+			service: "service",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+				"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:    "iam-list-users",
+			url:     "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08",
+			service: "iam",
+			headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded; charset=utf-8"},
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+				"SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			signV4(req, nil, sigV4Creds, "us-east-1", tt.service, now)
+			if got := req.Header.Get("Authorization"); got != tt.want {
+				t.Errorf("signV4() Authorization =\n%s\nwant\n%s", got, tt.want)
+			}
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Errorf("signV4() X-Amz-Date = %s, want 20150830T123600Z", got)
+			}
+		})
+	}
+}
+
+func TestSignV4SessionToken(t *testing.T) {
+	creds := sigV4Creds
+	creds.SessionToken = "token"
+	req, _ := http.NewRequest(http.MethodPost, "https://email.us-east-1.amazonaws.com/v2/email/outbound-emails", nil)
+	signV4(req, []byte("{}"), creds, "us-east-1", sesService, time.Now())
+	if got := req.Header.Get("X-Amz-Security-Token"); got != "token" {
+		t.Errorf("signV4() X-Amz-Security-Token = %q, want %q", got, "token")
+	}
+}
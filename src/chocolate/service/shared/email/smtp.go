@@ -0,0 +1,258 @@
+package email
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"chocolate/service/shared/config"
+	"chocolate/service/shared/logger"
+)
+
+const (
+	// TLSNone sends the emails in plain text
+	TLSNone = "none"
+	// TLSStartTLS upgrades the plain connection with STARTTLS, the server must support it
+	TLSStartTLS = "starttls"
+	// TLSImplicit connects with TLS from the start, usually to port 465
+	TLSImplicit = "implicit"
+
+	authPlain   = "plain"
+	authLogin   = "login"
+	authCRAMMD5 = "cram-md5"
+
+	// smtpTimeout is how long connecting or sending an email can take
+	smtpTimeout = 30 * time.Second
+)
+
+// SMTP is the provider to send emails to any SMTP server, the connection is kept open
+// and reused by the next emails until Close is called
+type SMTP struct {
+	Host    string
+	Port    string
+	TLSMode string
+	// TLSConfig is used for STARTTLS and implicit TLS, if nil the server certificate
+	// is verified against the system roots
+	TLSConfig *tls.Config
+	auth      smtp.Auth
+
+	mu     sync.Mutex
+	conn   net.Conn
+	client *smtp.Client
+}
+
+// NewSMTP creates a new SMTP sender
+func NewSMTP(config config.EmailConfig) (*SMTP, *Error) {
+	if config.Host == "" || config.Port == "" {
+		return nil, NewError("Missing Configuration fields", nil)
+	}
+	tlsMode := config.TLSMode
+	if tlsMode == "" {
+		tlsMode = TLSNone
+		if config.TLS {
+			tlsMode = TLSStartTLS
+		}
+	}
+	switch tlsMode {
+	case TLSNone, TLSStartTLS, TLSImplicit:
+	default:
+		return nil, NewError(fmt.Sprintf("Unknown tls_mode %q, must be none, starttls or implicit", tlsMode), nil)
+	}
+
+	s := &SMTP{
+		Host:    config.Host,
+		Port:    config.Port,
+		TLSMode: tlsMode,
+	}
+	if user := config.Auth; user.Username != "" {
+		switch strings.ToLower(user.Mechanism) {
+		case "", authPlain:
+			s.auth = smtp.PlainAuth("", user.Username, user.Password, config.Host)
+		case authLogin:
+			s.auth = &loginAuth{user.Username, user.Password, config.Host}
+		case authCRAMMD5:
+			s.auth = smtp.CRAMMD5Auth(user.Username, user.Password)
+		default:
+			return nil, NewError(fmt.Sprintf("Unknown auth mechanism %q, must be plain, login or cram-md5", user.Mechanism), nil)
+		}
+	}
+	return s, nil
+}
+
+// Send sends an email, reusing the connection of the previous one if it is still open
+func (s *SMTP) Send(email *Email) (eErr *Error) {
+	msg, err := email.FormMessage()
+	if err != nil {
+		logger.Errorf("Couldn't form email body message: %s", err.Error())
+		eErr = NewError("Couldn't form email body message", err)
+		return
+	}
+	logger.Debugf("Email Message: %s", msg)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		// The server could have closed the idle connection, start over in a new one then
+		if err = s.client.Reset(); err != nil {
+			logger.Debugf("SMTP connection can't be reused: %s", err.Error())
+			s.close()
+		}
+	}
+	if s.client == nil {
+		if eErr = s.connect(); eErr != nil {
+			return
+		}
+	}
+	s.conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	if err = s.send(email.From, email.Recipients(), msg); err != nil {
+		logger.Errorf("Couldn't send Email: %+v", err)
+		// The connection state is unknown after an error so it isn't reused
+		s.close()
+		eErr = smtpError("Couldn't send Email", err)
+	}
+	return
+}
+
+// Close sends QUIT and closes the connection
+func (s *SMTP) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	err := s.client.Quit()
+	s.close()
+	return err
+}
+
+// connect dials the server with the TLS mode and authenticates
+func (s *SMTP) connect() (eErr *Error) {
+	addr := net.JoinHostPort(s.Host, s.Port)
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return NewRetryableError("Couldn't connect to SMTP server", err)
+	}
+	if s.TLSMode == TLSImplicit {
+		tlsConn := tls.Client(conn, s.tlsConfig())
+		tlsConn.SetDeadline(time.Now().Add(smtpTimeout))
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return NewRetryableError("Couldn't establish TLS with SMTP server", err)
+		}
+		conn = tlsConn
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return smtpError("Couldn't start SMTP session", err)
+	}
+	s.conn, s.client = conn, client
+
+	if s.TLSMode == TLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			s.close()
+			return NewError("SMTP server doesn't support STARTTLS", nil)
+		}
+		if err = client.StartTLS(s.tlsConfig()); err != nil {
+			s.close()
+			return smtpError("Couldn't establish TLS with SMTP server", err)
+		}
+	}
+	if s.auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			s.close()
+			return NewError("SMTP server doesn't support AUTH", nil)
+		}
+		if err = client.Auth(s.auth); err != nil {
+			s.close()
+			return smtpError("Couldn't authenticate with SMTP server", err)
+		}
+	}
+	return nil
+}
+
+// send runs the SMTP transaction of the message
+func (s *SMTP) send(from string, to []string, msg string) error {
+	if err := s.client.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := s.client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := s.client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (s *SMTP) tlsConfig() *tls.Config {
+	if s.TLSConfig != nil {
+		return s.TLSConfig.Clone()
+	}
+	return &tls.Config{ServerName: s.Host, MinVersion: tls.VersionTLS12}
+}
+
+// close closes the connection without QUIT
+func (s *SMTP) close() {
+	if s.client != nil {
+		s.client.Close()
+	}
+	s.conn, s.client = nil, nil
+}
+
+// smtpError maps the SMTP error, only the permanent (5xx) replies fail for good,
+// the transient ones and the connection errors can be retried
+func smtpError(msg string, err error) *Error {
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) && smtpErr.Code >= 500 {
+		return NewError(msg, err)
+	}
+	return NewRetryableError(msg, err)
+}
+
+// loginAuth implements the LOGIN authentication mechanism, the server asks for the
+// username and password one at a time
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Like PlainAuth the credentials are only sent encrypted or to localhost
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch prompt := strings.ToLower(strings.TrimSpace(string(fromServer))); prompt {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN prompt %q", prompt)
+	}
+}
@@ -0,0 +1,410 @@
+package email
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"chocolate/service/shared/config"
+)
+
+// fakeSMTP is an in-process SMTP server that records the sessions
+type fakeSMTP struct {
+	ln        net.Listener
+	tlsConfig *tls.Config
+	// implicit serves TLS from the start instead of offering STARTTLS
+	implicit bool
+	// rcptReply answers RCPT TO, 250 if not set
+	rcptReply string
+	// closeAfterData drops the connection after every message without QUIT
+	closeAfterData bool
+
+	mu       sync.Mutex
+	conns    int
+	resets   int
+	auths    []string
+	messages []string
+	tls      []bool
+}
+
+// newFakeSMTP starts the server, the TLS certificate is for 127.0.0.1
+func newFakeSMTP(t *testing.T, cert tls.Certificate, implicit bool) *fakeSMTP {
+	t.Helper()
+	s := &fakeSMTP{tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}}, implicit: implicit}
+	var err error
+	if implicit {
+		s.ln, err = tls.Listen("tcp", "127.0.0.1:0", s.tlsConfig)
+	} else {
+		s.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.ln.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeSMTP) port() string {
+	_, port, _ := net.SplitHostPort(s.ln.Addr().String())
+	return port
+}
+
+func (s *fakeSMTP) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns++
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSMTP) handle(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	secure := s.implicit
+	tp.PrintfLine("220 127.0.0.1 ESMTP fake")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			ext := []string{"250-127.0.0.1", "250-AUTH PLAIN LOGIN CRAM-MD5"}
+			if !secure {
+				ext = append(ext, "250-STARTTLS")
+			}
+			tp.PrintfLine("%s\r\n250 8BITMIME", strings.Join(ext, "\r\n"))
+		case "STARTTLS":
+			tp.PrintfLine("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err = tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, secure = tlsConn, true
+			tp = textproto.NewConn(conn)
+		case "AUTH":
+			if !s.auth(tp, arg) {
+				return
+			}
+		case "MAIL", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			if s.rcptReply != "" {
+				tp.PrintfLine(s.rcptReply)
+			} else {
+				tp.PrintfLine("250 OK")
+			}
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			data, err := ioutil.ReadAll(tp.DotReader())
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, string(data))
+			s.tls = append(s.tls, secure)
+			s.mu.Unlock()
+			tp.PrintfLine("250 Queued")
+			if s.closeAfterData {
+				return
+			}
+		case "RSET":
+			s.mu.Lock()
+			s.resets++
+			s.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Unknown command")
+		}
+	}
+}
+
+// auth runs the AUTH exchange and records "<mechanism> <username> <password>",
+// for CRAM-MD5 the password is recorded if the digest matches "secret"
+func (s *fakeSMTP) auth(tp *textproto.Conn, arg string) bool {
+	fields := strings.Fields(arg)
+	mechanism := strings.ToUpper(fields[0])
+	read := func(prompt string) (string, bool) {
+		tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt)))
+		line, err := tp.ReadLine()
+		if err != nil {
+			return "", false
+		}
+		decoded, _ := base64.StdEncoding.DecodeString(line)
+		return string(decoded), true
+	}
+
+	var username, password string
+	switch mechanism {
+	case "PLAIN":
+		var resp []byte
+		if len(fields) > 1 {
+			resp, _ = base64.StdEncoding.DecodeString(fields[1])
+		} else {
+			r, ok := read("")
+			if !ok {
+				return false
+			}
+			resp = []byte(r)
+		}
+		parts := strings.Split(string(resp), "\x00")
+		if len(parts) == 3 {
+			username, password = parts[1], parts[2]
+		}
+	case "LOGIN":
+		var ok bool
+		if username, ok = read("Username:"); !ok {
+			return false
+		}
+		if password, ok = read("Password:"); !ok {
+			return false
+		}
+	case "CRAM-MD5":
+		challenge := "<1234.5678@127.0.0.1>"
+		resp, ok := read(challenge)
+		if !ok {
+			return false
+		}
+		i := strings.LastIndexByte(resp, ' ')
+		mac := hmac.New(md5.New, []byte("secret"))
+		mac.Write([]byte(challenge))
+		username = resp[:i]
+		if resp[i+1:] == hex.EncodeToString(mac.Sum(nil)) {
+			password = "secret"
+		}
+	default:
+		tp.PrintfLine("504 Unrecognized authentication type")
+		return true
+	}
+
+	s.mu.Lock()
+	s.auths = append(s.auths, strings.Join([]string{mechanism, username, password}, " "))
+	s.mu.Unlock()
+	tp.PrintfLine("235 Authentication successful")
+	return true
+}
+
+// newTestCert creates a self-signed certificate for 127.0.0.1 and the pool that trusts it
+func newTestCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// newTestSMTP creates the sender of the server, trusting its certificate
+func newTestSMTP(t *testing.T, srv *fakeSMTP, pool *x509.CertPool, conf config.EmailConfig) *SMTP {
+	t.Helper()
+	conf.Host, conf.Port = "127.0.0.1", srv.port()
+	s, eErr := NewSMTP(conf)
+	if eErr != nil {
+		t.Fatal(eErr)
+	}
+	s.TLSConfig = &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func testEmail(subject string) *Email {
+	return &Email{Type: TextEmail, Subject: subject, Body: "Hi there", From: "from@example.com", To: "to@example.com"}
+}
+
+func TestSMTPTLSModes(t *testing.T) {
+	cert, pool := newTestCert(t)
+	tests := []struct {
+		mode     string
+		secure   bool
+		implicit bool
+	}{
+		{TLSNone, false, false},
+		{TLSStartTLS, true, false},
+		{TLSImplicit, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			srv := newFakeSMTP(t, cert, tt.implicit)
+			s := newTestSMTP(t, srv, pool, config.EmailConfig{TLSMode: tt.mode})
+			if eErr := s.Send(testEmail("Hello")); eErr != nil {
+				t.Fatalf("Send() got error %v", eErr)
+			}
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			if len(srv.messages) != 1 || !strings.Contains(srv.messages[0], "Subject: Hello") {
+				t.Fatalf("server got messages %q, want the email", srv.messages)
+			}
+			if srv.tls[0] != tt.secure {
+				t.Errorf("message sent with TLS = %v, want %v", srv.tls[0], tt.secure)
+			}
+		})
+	}
+}
+
+func TestSMTPAuth(t *testing.T) {
+	cert, pool := newTestCert(t)
+	tests := []struct {
+		mechanism string
+		want      string
+	}{
+		{"", "PLAIN user secret"},
+		{authPlain, "PLAIN user secret"},
+		{authLogin, "LOGIN user secret"},
+		{authCRAMMD5, "CRAM-MD5 user secret"},
+	}
+	for _, tt := range tests {
+		t.Run("mechanism "+tt.mechanism, func(t *testing.T) {
+			srv := newFakeSMTP(t, cert, false)
+			conf := config.EmailConfig{TLSMode: TLSStartTLS}
+			conf.Auth.Username, conf.Auth.Password, conf.Auth.Mechanism = "user", "secret", tt.mechanism
+			s := newTestSMTP(t, srv, pool, conf)
+			if eErr := s.Send(testEmail("Hello")); eErr != nil {
+				t.Fatalf("Send() got error %v", eErr)
+			}
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			if len(srv.auths) != 1 || srv.auths[0] != tt.want {
+				t.Errorf("server got auths %q, want %q", srv.auths, tt.want)
+			}
+		})
+	}
+}
+
+func TestSMTPUnknownAuth(t *testing.T) {
+	conf := config.EmailConfig{Host: "127.0.0.1", Port: "25"}
+	conf.Auth.Username, conf.Auth.Mechanism = "user", "xoauth2"
+	if _, eErr := NewSMTP(conf); eErr == nil {
+		t.Error("NewSMTP() got no error for an unknown mechanism")
+	}
+}
+
+func TestSMTPReusesConnection(t *testing.T) {
+	cert, pool := newTestCert(t)
+	srv := newFakeSMTP(t, cert, false)
+	s := newTestSMTP(t, srv, pool, config.EmailConfig{TLSMode: TLSNone})
+	for _, subject := range []string{"First", "Second"} {
+		if eErr := s.Send(testEmail(subject)); eErr != nil {
+			t.Fatalf("Send(%s) got error %v", subject, eErr)
+		}
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.conns != 1 || srv.resets != 1 || len(srv.messages) != 2 {
+		t.Errorf("server got %d connections, %d resets and %d messages, want 1, 1 and 2", srv.conns, srv.resets, len(srv.messages))
+	}
+}
+
+func TestSMTPReconnectsAfterFailedReset(t *testing.T) {
+	cert, pool := newTestCert(t)
+	srv := newFakeSMTP(t, cert, false)
+	srv.closeAfterData = true
+	s := newTestSMTP(t, srv, pool, config.EmailConfig{TLSMode: TLSNone})
+	for _, subject := range []string{"First", "Second"} {
+		if eErr := s.Send(testEmail(subject)); eErr != nil {
+			t.Fatalf("Send(%s) got error %v", subject, eErr)
+		}
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.conns != 2 || len(srv.messages) != 2 {
+		t.Errorf("server got %d connections and %d messages, want 2 and 2", srv.conns, len(srv.messages))
+	}
+}
+
+func TestSMTPSendErrors(t *testing.T) {
+	cert, pool := newTestCert(t)
+	tests := []struct {
+		reply     string
+		retryable bool
+	}{
+		{"450 Mailbox busy", true},
+		{"421 Service not available", true},
+		{"550 No such user", false},
+		{"554 Rejected", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reply, func(t *testing.T) {
+			srv := newFakeSMTP(t, cert, false)
+			srv.rcptReply = tt.reply
+			s := newTestSMTP(t, srv, pool, config.EmailConfig{TLSMode: TLSNone})
+			eErr := s.Send(testEmail("Hello"))
+			if eErr == nil {
+				t.Fatal("Send() got no error")
+			}
+			if eErr.Retryable != tt.retryable {
+				t.Errorf("Send() error %v Retryable = %v, want %v", eErr, eErr.Retryable, tt.retryable)
+			}
+		})
+	}
+}
+
+func TestSMTPError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"4xx", &textproto.Error{Code: 451, Msg: "try later"}, true},
+		{"5xx", &textproto.Error{Code: 550, Msg: "no such user"}, false},
+		{"wrapped 5xx", fmt.Errorf("rcpt: %w", &textproto.Error{Code: 553, Msg: "bad address"}), false},
+		{"connection", errors.New("connection reset by peer"), true},
+		{"eof", io.EOF, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := smtpError("msg", tt.err); got.Retryable != tt.retryable {
+				t.Errorf("smtpError(%v) Retryable = %v, want %v", tt.err, got.Retryable, tt.retryable)
+			}
+		})
+	}
+}
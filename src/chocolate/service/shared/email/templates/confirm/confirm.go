@@ -1,16 +1,16 @@
 package confirm
 
 import (
-	"bytes"
-	"html/template"
-
-	"chocolate/service/shared/email"
+	"chocolate/service/shared/email/templates"
 )
 
+// name of the confirmation email template and the prefix of its messages
+const name = "confirm"
+
 // Template is the template for confirmaiton emails
 type Template struct {
-	Location string
-	Data     TemplateData
+	Locale string
+	Data   TemplateData
 }
 
 // TemplateData is the data structure for confirmation email
@@ -19,10 +19,10 @@ type TemplateData struct {
 	ConfirmURL string
 }
 
-// NewTemplate creates a confirmation template
-func NewTemplate(username, confirmURL string) *Template {
+// NewTemplate creates a confirmation template in the locale
+func NewTemplate(locale, username, confirmURL string) *Template {
 	return &Template{
-		Location: email.Templates["confirm"],
+		Locale: locale,
 		Data: TemplateData{
 			Username:   username,
 			ConfirmURL: confirmURL,
@@ -32,19 +32,10 @@ func NewTemplate(username, confirmURL string) *Template {
 
 // Process returns the string ot the template with the data
 func (ct Template) Process() (string, error) {
-	t, err := template.ParseFiles(ct.Location)
-	if err != nil {
-		return "", err
-	}
-	/* t := template.New("confirm")      //name of the template is main
-	t, err = t.Parse(confirmTemplate) // parsing of template string */
-	if err != nil {
-		return "", err
-	}
-	buf := new(bytes.Buffer)
-	if err = t.Execute(buf, ct.Data); err != nil {
-		return "", err
-	}
+	return templates.Render(name, ct.Locale, ct.Data)
+}
 
-	return buf.String(), nil
+// Subject returns the confirmation email subject in the locale
+func Subject(locale string) string {
+	return templates.Message(name+".subject", locale)
 }
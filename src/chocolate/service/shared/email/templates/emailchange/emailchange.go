@@ -0,0 +1,68 @@
+package emailchange
+
+import (
+	"chocolate/service/shared/email/templates"
+)
+
+const (
+	// name of the email sent to the new address to verify it and the prefix of its messages
+	name = "email_change"
+	// noticeName of the email sent to the old address with the undo link
+	noticeName = "email_change_notice"
+)
+
+// Template is the template for the email change emails
+type Template struct {
+	Locale string
+	Name   string
+	Data   TemplateData
+}
+
+// TemplateData is the data structure for the email change emails
+type TemplateData struct {
+	OldEmail   string
+	NewEmail   string
+	ConfirmURL string
+	UndoURL    string
+}
+
+// NewTemplate creates the template of the email that verifies the new address in the locale
+func NewTemplate(locale, oldEmail, newEmail, confirmURL string) *Template {
+	return &Template{
+		Locale: locale,
+		Name:   name,
+		Data: TemplateData{
+			OldEmail:   oldEmail,
+			NewEmail:   newEmail,
+			ConfirmURL: confirmURL,
+		},
+	}
+}
+
+// NewNoticeTemplate creates the template of the email that notifies the old address in the locale
+func NewNoticeTemplate(locale, oldEmail, newEmail, undoURL string) *Template {
+	return &Template{
+		Locale: locale,
+		Name:   noticeName,
+		Data: TemplateData{
+			OldEmail: oldEmail,
+			NewEmail: newEmail,
+			UndoURL:  undoURL,
+		},
+	}
+}
+
+// Process returns the string ot the template with the data
+func (et Template) Process() (string, error) {
+	return templates.Render(et.Name, et.Locale, et.Data)
+}
+
+// Subject returns the subject of the email that verifies the new address in the locale
+func Subject(locale string) string {
+	return templates.Message(name+".subject", locale)
+}
+
+// NoticeSubject returns the subject of the email that notifies the old address in the locale
+func NoticeSubject(locale string) string {
+	return templates.Message(noticeName+".subject", locale)
+}
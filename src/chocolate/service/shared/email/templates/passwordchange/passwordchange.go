@@ -0,0 +1,39 @@
+package passwordchange
+
+import (
+	"chocolate/service/shared/email/templates"
+)
+
+// name of the email that notifies a password change and the prefix of its messages
+const name = "password_changed"
+
+// Template is the template for the password changed emails
+type Template struct {
+	Locale string
+	Data   TemplateData
+}
+
+// TemplateData is the data structure for the password changed email
+type TemplateData struct {
+	Username string
+}
+
+// NewTemplate creates a password changed template in the locale
+func NewTemplate(locale, username string) *Template {
+	return &Template{
+		Locale: locale,
+		Data: TemplateData{
+			Username: username,
+		},
+	}
+}
+
+// Process returns the string ot the template with the data
+func (pt Template) Process() (string, error) {
+	return templates.Render(name, pt.Locale, pt.Data)
+}
+
+// Subject returns the password changed email subject in the locale
+func Subject(locale string) string {
+	return templates.Message(name+".subject", locale)
+}
@@ -0,0 +1,43 @@
+package reset
+
+import (
+	"chocolate/service/shared/email/templates"
+)
+
+// name of the password reset email template and the prefix of its messages
+const name = "reset"
+
+// Template is the template for password reset emails
+type Template struct {
+	Locale string
+	Data   TemplateData
+}
+
+// TemplateData is the data structure for password reset email
+type TemplateData struct {
+	Username string
+	ResetURL string
+	Token    string
+}
+
+// NewTemplate creates a password reset template in the locale
+func NewTemplate(locale, username, resetURL, token string) *Template {
+	return &Template{
+		Locale: locale,
+		Data: TemplateData{
+			Username: username,
+			ResetURL: resetURL,
+			Token:    token,
+		},
+	}
+}
+
+// Process returns the string ot the template with the data
+func (rt Template) Process() (string, error) {
+	return templates.Render(name, rt.Locale, rt.Data)
+}
+
+// Subject returns the password reset email subject in the locale
+func Subject(locale string) string {
+	return templates.Message(name+".subject", locale)
+}
@@ -0,0 +1,276 @@
+// Package templates is the registry of the localized email templates and pages, and the message
+// catalogs with their subjects. The defaults are embedded in the binary and every file can be
+// overridden on disk, all of them are parsed once when the registry is loaded.
+package templates
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"chocolate/service/shared/config"
+	"chocolate/service/shared/logger"
+)
+
+// defaultLocale is used when email.default_locale isn't set
+const defaultLocale = "es"
+
+// messagesFile is the message catalog of every locale dir
+const messagesFile = "messages.json"
+
+// defaults has a dir per locale with its <name>.html templates and messages.json
+//
+//go:embed defaults
+var defaults embed.FS
+
+var (
+	registry     *Registry
+	registryOnce sync.Once
+)
+
+// Registry holds the parsed templates and message catalogs by locale
+type Registry struct {
+	defaultLocale string
+	templates     map[string]map[string]*template.Template
+	messages      map[string]map[string]string
+}
+
+// Init loads the registry used by the package functions
+func Init(conf config.EmailConfig) (err error) {
+	r, err := Load(conf)
+	if err != nil {
+		return
+	}
+	registry = r
+	return
+}
+
+// Load parses the embedded templates and catalogs, then the ones in email.templates_dir
+// (<dir>/<locale>/<name>.html and <dir>/<locale>/messages.json) which override them,
+// and last the default locale templates set by name in email.templates
+func Load(conf config.EmailConfig) (r *Registry, err error) {
+	r = &Registry{
+		defaultLocale: normalize(conf.DefaultLocale),
+		templates:     make(map[string]map[string]*template.Template),
+		messages:      make(map[string]map[string]string),
+	}
+	if r.defaultLocale == "" {
+		r.defaultLocale = defaultLocale
+	}
+
+	embedded, err := fs.Sub(defaults, "defaults")
+	if err != nil {
+		return nil, err
+	}
+	if err = r.load(embedded); err != nil {
+		return nil, fmt.Errorf("Couldn't load default templates: %s", err.Error())
+	}
+	if conf.TemplatesDir != "" {
+		if err = r.load(os.DirFS(conf.TemplatesDir)); err != nil {
+			return nil, fmt.Errorf("Couldn't load templates from %s: %s", conf.TemplatesDir, err.Error())
+		}
+	}
+	for name, file := range conf.Templates {
+		t, err := template.ParseFiles(file)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load template %s: %s", name, err.Error())
+		}
+		r.set(r.defaultLocale, name, t)
+	}
+
+	if _, ok := r.templates[r.defaultLocale]; !ok {
+		return nil, fmt.Errorf("There are no templates for the default locale %q", r.defaultLocale)
+	}
+	return
+}
+
+// load parses the locale dirs of fsys
+func (r *Registry) load(fsys fs.FS) error {
+	dirs, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		locale := normalize(dir.Name())
+		files, err := fs.Glob(fsys, dir.Name()+"/*.html")
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			t, err := template.ParseFS(fsys, file)
+			if err != nil {
+				return err
+			}
+			r.set(locale, strings.TrimSuffix(path.Base(file), ".html"), t)
+		}
+
+		data, err := fs.ReadFile(fsys, path.Join(dir.Name(), messagesFile))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var messages map[string]string
+		if err = json.Unmarshal(data, &messages); err != nil {
+			return fmt.Errorf("%s/%s: %s", dir.Name(), messagesFile, err.Error())
+		}
+		if r.messages[locale] == nil {
+			r.messages[locale] = make(map[string]string)
+		}
+		for key, message := range messages {
+			r.messages[locale][key] = message
+		}
+	}
+	return nil
+}
+
+func (r *Registry) set(locale, name string, t *template.Template) {
+	if r.templates[locale] == nil {
+		r.templates[locale] = make(map[string]*template.Template)
+	}
+	r.templates[locale][name] = t
+}
+
+// Locales returns the supported locales sorted
+func (r *Registry) Locales() []string {
+	locales := make([]string, 0, len(r.templates))
+	for locale := range r.templates {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Resolve returns the first supported locale of the candidates, "es-mx" is supported if there are
+// "es-mx" or "es" templates. The default locale is returned if none is supported
+func (r *Registry) Resolve(candidates ...string) string {
+	for _, candidate := range candidates {
+		locale := normalize(candidate)
+		if locale == "" {
+			continue
+		}
+		if _, ok := r.templates[locale]; ok {
+			return locale
+		}
+		if i := strings.IndexByte(locale, '-'); i > 0 {
+			if _, ok := r.templates[locale[:i]]; ok {
+				return locale[:i]
+			}
+		}
+	}
+	return r.defaultLocale
+}
+
+// Render executes the name template of the locale, or of the default locale if it doesn't have it
+func (r *Registry) Render(name, locale string, data interface{}) (string, error) {
+	t, ok := r.templates[r.Resolve(locale)][name]
+	if !ok {
+		if t, ok = r.templates[r.defaultLocale][name]; !ok {
+			return "", fmt.Errorf("Unknown template %q", name)
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := t.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Message returns the key message of the locale catalog, or of the default locale catalog
+// if it doesn't have it. The key is returned if no catalog has it
+func (r *Registry) Message(key, locale string) string {
+	if message, ok := r.messages[r.Resolve(locale)][key]; ok {
+		return message
+	}
+	if message, ok := r.messages[r.defaultLocale][key]; ok {
+		return message
+	}
+	logger.Warnf("templates:Message() Missing message %q", key)
+	return key
+}
+
+// current returns the registry loaded by Init, or the embedded defaults if Init wasn't called
+func current() *Registry {
+	registryOnce.Do(func() {
+		if registry != nil {
+			return
+		}
+		r, err := Load(config.EmailConfig{})
+		if err != nil {
+			panic(err)
+		}
+		registry = r
+	})
+	return registry
+}
+
+// Locale resolves the locale to show the user, the stored one or else the best of the
+// Accept-Language header the registry supports
+func Locale(stored, acceptLanguage string) string {
+	return current().Resolve(append([]string{stored}, ParseAcceptLanguage(acceptLanguage)...)...)
+}
+
+// Render executes the name template of the locale
+func Render(name, locale string, data interface{}) (string, error) {
+	return current().Render(name, locale, data)
+}
+
+// Message returns the key message of the locale catalog
+func Message(key, locale string) string {
+	return current().Message(key, locale)
+}
+
+// ParseAcceptLanguage returns the languages of the Accept-Language header by their quality, i.e.
+// "en-US,en;q=0.8,es;q=0.9" returns [en-US es en]. The ones with q=0 and "*" are left out
+func ParseAcceptLanguage(header string) []string {
+	type language struct {
+		tag     string
+		quality float64
+	}
+	var languages []language
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			languages = append(languages, language{tag, quality})
+		}
+	}
+	sort.SliceStable(languages, func(i, j int) bool { return languages[i].quality > languages[j].quality })
+
+	tags := make([]string, 0, len(languages))
+	for _, l := range languages {
+		tags = append(tags, l.tag)
+	}
+	return tags
+}
+
+// normalize lowercases the locale and uses "-" as separator, "es_MX" is "es-mx"
+func normalize(locale string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+}
@@ -6,7 +6,9 @@ import (
 	"time"
 
 	"chocolate/service/database"
+	"chocolate/service/models/users"
 	"chocolate/service/shared/auth/jwt"
+	"chocolate/service/shared/auth/services"
 )
 
 type contextKey int
@@ -26,6 +28,14 @@ const (
 	EnvKey contextKey = 5
 	// PathParams key to get the gorilla mux vars = path params
 	PathParamsKey contextKey = 6
+	// ScopeKey is the context key to get the scope of the permission granted for the route
+	ScopeKey contextKey = 7
+	// ServiceKey is the context key to get the service principal that authenticated with a client certificate
+	ServiceKey contextKey = 8
+	// UserRepositoryKey is the context key to get the users repository
+	UserRepositoryKey contextKey = 9
+	// ClientIPKey is the context key to get the client IP, resolved thru the trusted proxies
+	ClientIPKey contextKey = 10
 )
 
 // GetReqID return the Request ID
@@ -38,9 +48,35 @@ func GetStartTime(r *http.Request) time.Time {
 	return r.Context().Value(StartTimeKey).(time.Time)
 }
 
-// GetAuthJWT gets the current request user claims
+// GetUserRepository gets the repository the users are stored in
+func GetUserRepository(r *http.Request) users.UserRepository {
+	repo, _ := r.Context().Value(UserRepositoryKey).(users.UserRepository)
+	return repo
+}
+
+// GetAuthJWT gets the current request user claims,
+// they are empty if the request was authenticated by a service principal
 func GetAuthJWT(r *http.Request) jwt.Claims {
-	return r.Context().Value(AuthJWTKey).(jwt.Claims)
+	claims, _ := r.Context().Value(AuthJWTKey).(jwt.Claims)
+	return claims
+}
+
+// GetService gets the service principal that authenticated the request, ok is false for user requests
+func GetService(r *http.Request) (principal services.Principal, ok bool) {
+	principal, ok = r.Context().Value(ServiceKey).(services.Principal)
+	return
+}
+
+// GetClientIP gets the client IP, it is empty when the ClientIP middleware wasn't executed
+func GetClientIP(r *http.Request) string {
+	ip, _ := r.Context().Value(ClientIPKey).(string)
+	return ip
+}
+
+// GetScope gets the scope ("any"|"own") of the permission that granted access to the route
+func GetScope(r *http.Request) string {
+	scope, _ := r.Context().Value(ScopeKey).(string)
+	return scope
 }
 
 // GetEnvironment gets server business environment
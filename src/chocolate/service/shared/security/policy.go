@@ -0,0 +1,51 @@
+package security
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	// MinPasswordLength is the minimum number of characters of a password
+	MinPasswordLength = 8
+	// MaxPasswordLength is the maximum number of bytes of a password, bcrypt only hashes 72 bytes
+	// and the salt takes 44 of them
+	MaxPasswordLength = 28
+	// minUsernameMatchLength is the shortest username the password is checked not to contain,
+	// shorter ones like "jo" would reject too many passwords for no security gain
+	minUsernameMatchLength = 4
+)
+
+// CheckPasswordPolicy checks that the password is strong enough for the user with username,
+// it must have a letter and a digit and can't contain the username (the part before the @) when it
+// has at least 4 characters
+func CheckPasswordPolicy(password, username string) error {
+	if len([]rune(password)) < MinPasswordLength {
+		return fmt.Errorf("The password must have at least %d characters", MinPasswordLength)
+	}
+	if len(password) > MaxPasswordLength {
+		return fmt.Errorf("The password can't be longer than %d bytes", MaxPasswordLength)
+	}
+	var letter, digit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	if !letter || !digit {
+		return errors.New("The password must have letters and digits")
+	}
+	name := strings.ToLower(username)
+	if i := strings.Index(name, "@"); i > 0 {
+		name = name[:i]
+	}
+	if len([]rune(name)) >= minUsernameMatchLength && strings.Contains(strings.ToLower(password), name) {
+		return errors.New("The password can't contain the username")
+	}
+	return nil
+}
@@ -2,7 +2,9 @@ package security
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 )
 
 // GenerateRandomBytes returns securely generated random bytes.
@@ -29,3 +31,10 @@ func GenerateRandomString(s int) (string, error) {
 	b, err := GenerateRandomBytes(s)
 	return base64.URLEncoding.EncodeToString(b), err
 }
+
+// HashToken returns the hex encoded SHA-256 of a random token (recovery codes, nonces),
+// tokens have enough entropy so they don't need a slow password hash
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -11,3 +11,9 @@ func New() (string, error) {
 	}
 	return _uuid.String(), nil
 }
+
+// Valid checks if id is an UUID, so it can be compared against the uuid columns
+func Valid(id string) bool {
+	_, err := gouuid.FromString(id)
+	return err == nil
+}
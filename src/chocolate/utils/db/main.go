@@ -0,0 +1,106 @@
+// dbutils manages the service database schema migrations
+//
+// Usage:
+//
+//	dbutils [-config file] up          applies the pending migrations
+//	dbutils [-config file] down [n]    reverts the last n applied migrations (default 1)
+//	dbutils [-config file] status      lists the migrations and if they were applied
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"chocolate/service/database"
+	"chocolate/service/models"
+	"chocolate/service/shared/config"
+	"chocolate/service/shared/logger"
+)
+
+var (
+	configFile = flag.String("config", "config/chocolate.conf.json", "Configuration File")
+	debug      = flag.Bool("debug", false, "Log debug messages")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-config file] [-debug] up | down [n] | status\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	file := os.Getenv("CHOCO_CONFIG")
+	if file == "" {
+		file = *configFile
+	}
+	conf, err := config.LoadConfiguration(file)
+	if err != nil {
+		fail(err)
+	}
+	// Log to stdout only
+	if err = logger.Init("", *debug); err != nil {
+		fail(err)
+	}
+
+	db, err := database.New(conf.DB)
+	if err != nil {
+		fail(err)
+	}
+	defer db.Close()
+	migrations, err := models.GetMigrations(db.Dialect())
+	if err != nil {
+		fail(err)
+	}
+
+	switch cmd := flag.Arg(0); cmd {
+	case "up":
+		if dberr := db.Migrate(migrations); dberr != nil {
+			fail(dberr)
+		}
+		fmt.Println("Migrations applied")
+	case "down":
+		steps := 1
+		if flag.NArg() > 1 {
+			if steps, err = strconv.Atoi(flag.Arg(1)); err != nil || steps < 1 {
+				fail(fmt.Errorf("down expects a positive number of migrations, got %q", flag.Arg(1)))
+			}
+		}
+		if dberr := db.Rollback(migrations, steps); dberr != nil {
+			fail(dberr)
+		}
+		fmt.Printf("Reverted %d migration(s)\n", steps)
+	case "status":
+		status, dberr := db.MigrationsStatus(migrations)
+		if dberr != nil {
+			fail(dberr)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tDESCRIPTION\tAPPLIED AT")
+		for _, s := range status {
+			appliedAt := "pending"
+			if s.Applied {
+				appliedAt = s.AppliedAt.Time.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", s.Version, s.Description, appliedAt)
+		}
+		w.Flush()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "[EROR] %s\n", err.Error())
+	os.Exit(1)
+}